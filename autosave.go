@@ -0,0 +1,171 @@
+package memstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type (
+	// AutoSaveOptions configures the background auto-save loop of InMemoryStorage
+	AutoSaveOptions struct {
+		// Interval is the period of the regular save, a dirty storage is saved
+		// when the last save is older than Interval
+		Interval time.Duration
+
+		// MaxStaleness is the longest time a modification may stay unsaved,
+		// zero means modifications are only bounded by Interval
+		MaxStaleness time.Duration
+
+		// Timeout is the timeout of each background save, zero means no timeout
+		Timeout time.Duration
+
+		// OnError is called when a background save fails, it can be nil
+		OnError func(err error)
+	}
+
+	// autoSaver is a running background auto-save loop
+	autoSaver struct {
+		opt     AutoSaveOptions
+		started time.Time
+		stop    chan struct{}
+		done    chan struct{}
+	}
+)
+
+// tick returns the polling period of the loop
+func (opt AutoSaveOptions) tick() time.Duration {
+	tick := opt.Interval
+	// poll more frequently than MaxStaleness, so that it can be respected
+	if opt.MaxStaleness > 0 && (tick <= 0 || opt.MaxStaleness/2 < tick) {
+		tick = opt.MaxStaleness / 2
+	}
+	return tick
+}
+
+// StartAutoSave starts a background loop that saves the storage periodically,
+// the loop is stopped by Close
+func (s *InMemoryStorage[TData]) StartAutoSave(opt AutoSaveOptions) error {
+	// validate input
+	if opt.Interval <= 0 && opt.MaxStaleness <= 0 {
+		return fmt.Errorf("%w, either interval or max staleness must be positive", ErrInvalidInput)
+	}
+	if opt.Interval < 0 || opt.MaxStaleness < 0 || opt.Timeout < 0 {
+		return fmt.Errorf("%w, durations cannot be negative", ErrInvalidInput)
+	}
+	if opt.tick() <= 0 {
+		return fmt.Errorf("%w, max staleness is too small", ErrInvalidInput)
+	}
+	// lock the mutex
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// if the dumper is not set, return an error
+	if s.Dumper == nil {
+		return fmt.Errorf("%w, dumper is not set", ErrStatusError)
+	}
+	if s.autoSave != nil {
+		return fmt.Errorf("%w, auto save is already started", ErrStatusError)
+	}
+
+	s.autoSave = &autoSaver{
+		opt:     opt,
+		started: time.Now(),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.runAutoSave(s.autoSave)
+	return nil
+}
+
+// runAutoSave is the background auto-save loop
+func (s *InMemoryStorage[TData]) runAutoSave(as *autoSaver) {
+	defer close(as.done)
+
+	ticker := time.NewTicker(as.opt.tick())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-as.stop:
+			return
+		case now := <-ticker.C:
+			if !s.shouldAutoSave(as, now) {
+				continue
+			}
+			if err := s.autoSaveOnce(as.opt); err != nil && as.opt.OnError != nil {
+				as.opt.OnError(err)
+			}
+		}
+	}
+}
+
+// shouldAutoSave returns true if the storage is dirty and one of the triggers is reached
+func (s *InMemoryStorage[TData]) shouldAutoSave(as *autoSaver, now time.Time) bool {
+	s.dirtyMu.Lock()
+	dirty, dirtySince := s.dirtyCount > 0, s.dirtySince
+	s.dirtyMu.Unlock()
+	if !dirty {
+		return false
+	}
+	// the interval is counted from the last save, or from the start of the loop
+	since := s.LastSaveTime()
+	if since.Before(as.started) {
+		since = as.started
+	}
+	if as.opt.Interval > 0 && now.Sub(since) >= as.opt.Interval {
+		return true
+	}
+	return as.opt.MaxStaleness > 0 && now.Sub(dirtySince) >= as.opt.MaxStaleness
+}
+
+// autoSaveOnce saves the storage with the timeout of the loop
+func (s *InMemoryStorage[TData]) autoSaveOnce(opt AutoSaveOptions) error {
+	ctx := context.Background()
+	if opt.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opt.Timeout)
+		defer cancel()
+	}
+	return s.Save(ctx)
+}
+
+// Close stops the background loops if they are running,
+// and then saves the storage for the last time, and releases the lease
+func (s *InMemoryStorage[TData]) Close(ctx context.Context) error {
+	// detach the loops, so that they can not be stopped twice
+	s.mu.Lock()
+	as, r := s.autoSave, s.reaper
+	s.autoSave, s.reaper = nil, nil
+	unsubscribe := s.unsubscribe
+	s.unsubscribe = nil
+	s.mu.Unlock()
+
+	if as != nil {
+		close(as.stop)
+		<-as.done
+	}
+	if r != nil {
+		close(r.stop)
+		<-r.done
+	}
+	if unsubscribe != nil {
+		_ = unsubscribe()
+	}
+
+	err := s.Save(ctx)
+	// the broadcast is stopped after the last save, so that it is published
+	s.mu.Lock()
+	b := s.broadcast
+	s.broadcast = nil
+	s.mu.Unlock()
+	if b != nil {
+		b.close()
+	}
+	if s.Lease != nil {
+		if rErr := s.Lease.release(ctx); err == nil {
+			err = rErr
+		}
+	}
+	return err
+}
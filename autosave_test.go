@@ -0,0 +1,92 @@
+package memstore_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/khgame/memstore"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingDumper is a dumper that fails to dump while fail is set
+type failingDumper[T any] struct {
+	memstore.Dumper[T]
+	fail atomic.Bool
+}
+
+var errDumpFailed = errors.New("dump failed")
+
+func (d *failingDumper[T]) DumpChanged(ctx context.Context, permanentKey string, changed map[memstore.UID]memstore.DataMap[T]) error {
+	if d.fail.Load() {
+		return errDumpFailed
+	}
+	return d.Dumper.DumpChanged(ctx, permanentKey, changed)
+}
+
+// Test_InMemStorage_AutoSave tests the background auto-save loop of InMemStorage with testify
+func Test_InMemStorage_AutoSave(t *testing.T) {
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	opt := memstore.AutoSaveOptions{Interval: 20 * time.Millisecond}
+
+	// the dumper is required
+	assert.ErrorIs(t, storage.StartAutoSave(opt), memstore.ErrStatusError)
+	assert.ErrorIs(t, storage.StartAutoSave(memstore.AutoSaveOptions{}), memstore.ErrInvalidInput)
+
+	dp := &failingDumper[TestDataType]{Dumper: createCacheDumper[TestDataType]()}
+	storage.Dumper = dp
+	assert.NoError(t, storage.StartAutoSave(opt))
+	assert.ErrorIs(t, storage.StartAutoSave(opt), memstore.ErrStatusError)
+	assert.True(t, storage.LastSaveTime().IsZero())
+
+	// the storage is saved in background
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: 1}))
+	assert.Eventually(t, func() bool { return !storage.IsDirty() }, time.Second, 5*time.Millisecond)
+	assert.False(t, storage.LastSaveTime().IsZero())
+	assert.NoError(t, storage.LastSaveError())
+
+	// failures are reported, and the storage stays dirty
+	dp.fail.Store(true)
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: 2}))
+	assert.Eventually(t, func() bool { return storage.LastSaveError() != nil }, time.Second, 5*time.Millisecond)
+	assert.ErrorIs(t, storage.LastSaveError(), errDumpFailed)
+	assert.True(t, storage.IsDirty())
+
+	// close does the final save
+	dp.fail.Store(false)
+	assert.NoError(t, storage.Close(context.Background()))
+	assert.False(t, storage.IsDirty())
+	assert.NoError(t, storage.LastSaveError())
+
+	// the loop is stopped after close
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: 3}))
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, storage.IsDirty())
+
+	storage2 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage2.Dumper = dp
+	assert.NoError(t, storage2.Load(context.Background()))
+	data := TestDataType{Name: "res001"}
+	assert.NoError(t, storage2.Get("uid001", &data))
+	assert.Equal(t, int64(2), data.Quantity)
+}
+
+// Test_InMemStorage_AutoSaveMaxStaleness tests that MaxStaleness triggers a save before Interval
+func Test_InMemStorage_AutoSaveMaxStaleness(t *testing.T) {
+	var failures atomic.Int32
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = createCacheDumper[TestDataType]()
+	assert.NoError(t, storage.Save(context.Background()))
+	assert.NoError(t, storage.StartAutoSave(memstore.AutoSaveOptions{
+		Interval:     time.Hour,
+		MaxStaleness: 40 * time.Millisecond,
+		OnError:      func(err error) { failures.Add(1) },
+	}))
+	defer storage.Close(context.Background())
+
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: 1}))
+	assert.Eventually(t, func() bool { return !storage.IsDirty() }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int32(0), failures.Load())
+}
@@ -0,0 +1,129 @@
+package memstore
+
+import (
+	"fmt"
+	"time"
+)
+
+// GetMany retrieves several resources of a user under a single lock. the
+// found resources are returned by store name, and the missing or expired
+// ones are returned as missing, in the order of storeNames
+func (s *InMemoryStorage[TData]) GetMany(user string, storeNames []string) (found map[string]TData, missing []string, err error) {
+	// validate input
+	if user == "" {
+		return nil, nil, fmt.Errorf("%w, user cannot be empty", ErrInvalidUser)
+	}
+	for _, storeName := range storeNames {
+		if storeName == "" {
+			return nil, nil, fmt.Errorf("%w, storeName cannot be empty", ErrInvalidInput)
+		}
+	}
+	// load the user if it is not in memory
+	release, err := s.loadUser(user)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+	// lock the user
+	unlock := s.rlockUser(user)
+	defer unlock()
+
+	// get the resources of the user
+	r, ok := s.shardOf(user).data[user]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w, user: %s", ErrUserNotFound, user)
+	}
+
+	// record the access
+	s.touch(user)
+
+	// get the resources, an expired resource is treated as missing
+	now := time.Now()
+	found = make(map[string]TData, len(storeNames))
+	seen := make(map[string]struct{}, len(storeNames))
+	for _, storeName := range storeNames {
+		if _, dup := seen[storeName]; dup {
+			continue
+		}
+		seen[storeName] = struct{}{}
+		v, ok := r[storeName]
+		if !ok || s.expiredLocked(user, storeName, now) {
+			missing = append(missing, storeName)
+			continue
+		}
+		found[storeName] = v
+	}
+	return found, missing, nil
+}
+
+// SetMany stores several resources of a user under a single lock, the same
+// as calling Set for each of them. the resources are applied all together,
+// and the later one wins if several of them have the same store name
+func (s *InMemoryStorage[TData]) SetMany(user string, values []*TData) error {
+	// validate input
+	for _, in := range values {
+		if in == nil {
+			return fmt.Errorf("%w, input cannot be nil", ErrInvalidInput)
+		}
+	}
+	// the resources are written as a transaction, so that they are
+	// journaled and applied as a whole
+	return s.Txn(user, func(tx *Txn[TData]) error {
+		for _, in := range values {
+			if err := tx.Set(in); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetForUsers retrieves a resource of several users under a single lock. the
+// found resources are returned by user, and the users that do not exist or do
+// not have the resource are returned as missing, in the order of users
+func (s *InMemoryStorage[TData]) GetForUsers(users []UID, storeName string) (found map[UID]TData, missing []UID, err error) {
+	// validate input
+	for _, user := range users {
+		if user == "" {
+			return nil, nil, fmt.Errorf("%w, user cannot be empty", ErrInvalidUser)
+		}
+	}
+	if storeName == "" {
+		return nil, nil, fmt.Errorf("%w, storeName cannot be empty", ErrInvalidInput)
+	}
+	// load the users if they are not in memory
+	for _, user := range sortedUsers(users) {
+		release, err := s.loadUser(user)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer release()
+	}
+	// lock the users
+	unlock := s.rlockUsers(users)
+	defer unlock()
+
+	// get the resources, an expired resource is treated as missing
+	now := time.Now()
+	found = make(map[UID]TData, len(users))
+	seen := make(map[UID]struct{}, len(users))
+	for _, user := range users {
+		if _, dup := seen[user]; dup {
+			continue
+		}
+		seen[user] = struct{}{}
+		r, ok := s.shardOf(user).data[user]
+		if !ok {
+			missing = append(missing, user)
+			continue
+		}
+		s.touch(user)
+		v, ok := r[storeName]
+		if !ok || s.expiredLocked(user, storeName, now) {
+			missing = append(missing, user)
+			continue
+		}
+		found[user] = v
+	}
+	return found, missing, nil
+}
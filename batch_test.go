@@ -0,0 +1,67 @@
+package memstore_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/khgame/memstore"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_InMemStorage_GetManySetMany tests the GetMany & SetMany method of InMemStorage with testify
+func Test_InMemStorage_GetManySetMany(t *testing.T) {
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	w := storage.Watch(memstore.WatchOptions{})
+	defer w.Close()
+
+	assert.ErrorIs(t, storage.SetMany("uid001", []*TestDataType{{Name: "res001"}, nil}), memstore.ErrInvalidInput)
+	assert.False(t, storage.IsDirty())
+	assert.NoError(t, storage.SetMany("uid001", []*TestDataType{
+		{Name: "res001", Quantity: 1},
+		{Name: "res002", Quantity: 2},
+		{Name: "res001", Quantity: 10},
+	}))
+	assert.NoError(t, storage.SetWithExpiry("uid001", &TestDataType{Name: "ticket", Quantity: 1}, time.Now().Add(-time.Second)))
+	assert.Equal(t, 3, len(drain(w)))
+
+	found, missing, err := storage.GetMany("uid001", []string{"res001", "res003", "res002", "ticket", "res003"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]TestDataType{
+		"res001": {Name: "res001", Quantity: 10},
+		"res002": {Name: "res002", Quantity: 2},
+	}, found)
+	assert.Equal(t, []string{"res003", "ticket"}, missing)
+
+	_, _, err = storage.GetMany("uid002", []string{"res001"})
+	assert.ErrorIs(t, err, memstore.ErrUserNotFound)
+	_, _, err = storage.GetMany("uid001", []string{""})
+	assert.ErrorIs(t, err, memstore.ErrInvalidInput)
+}
+
+// Test_InMemStorage_GetForUsers tests the GetForUsers method of InMemStorage with testify
+func Test_InMemStorage_GetForUsers(t *testing.T) {
+	ctx := context.Background()
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = createCacheDumper[TestDataType]()
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "gold", Quantity: 1}))
+	assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "gold", Quantity: 2}))
+	assert.NoError(t, storage.Set("uid003", &TestDataType{Name: "wood", Quantity: 3}))
+	assert.NoError(t, storage.Save(ctx))
+
+	// the users are loaded on demand
+	storage2 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage2.Dumper = storage.Dumper
+	storage2.LazyLoad = true
+	assert.NoError(t, storage2.Load(ctx))
+	found, missing, err := storage2.GetForUsers([]memstore.UID{"uid004", "uid002", "uid001", "uid003", "uid001"}, "gold")
+	assert.NoError(t, err)
+	assert.Equal(t, map[memstore.UID]TestDataType{
+		"uid001": {Name: "gold", Quantity: 1},
+		"uid002": {Name: "gold", Quantity: 2},
+	}, found)
+	assert.Equal(t, []memstore.UID{"uid004", "uid003"}, missing)
+
+	_, _, err = storage2.GetForUsers([]memstore.UID{"uid001", ""}, "gold")
+	assert.ErrorIs(t, err, memstore.ErrInvalidUser)
+}
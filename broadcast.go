@@ -0,0 +1,379 @@
+package memstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bagaking/goulp/jsonex"
+
+	"github.com/khgame/memstore/cache"
+	"github.com/khgame/memstore/cachekey"
+)
+
+const (
+	// BroadcastOnSave publishes the users written by a successful Save, so
+	// that the subscribers reload what has been saved
+	BroadcastOnSave BroadcastMode = iota
+	// BroadcastOnMutation publishes every change as soon as it is applied,
+	// and the users written by a successful Save again, since a subscriber
+	// may reload the user before the change is saved
+	BroadcastOnMutation
+)
+
+// SchemeInvalidation is the pub/sub channel of the invalidations of a storage
+const SchemeInvalidation cachekey.KeyFormat = "store_invalidate:%s"
+
+var _ Broadcaster = (*RedisBroadcaster)(nil)
+
+type (
+	// BroadcastMode defines when the invalidations are published
+	BroadcastMode int
+
+	// Invalidation tells the other instances that a user has changed
+	Invalidation struct {
+		// PersistentKey is the permanent key of the storage
+		PersistentKey string `json:"key"`
+		// User is the changed user
+		User UID `json:"uid"`
+		// StoreName is the changed resource, empty means the whole user
+		StoreName string `json:"store_name,omitempty"`
+		// Source is the instance that published the invalidation
+		Source string `json:"source,omitempty"`
+	}
+
+	// Broadcaster delivers the invalidations between the instances that
+	// share a PersistentKey
+	Broadcaster interface {
+		// Publish sends an invalidation to the subscribers of its PersistentKey
+		Publish(ctx context.Context, inv Invalidation) error
+		// Subscribe calls fn with the invalidations of the persistent key in
+		// the order they are published, until stop is called
+		Subscribe(ctx context.Context, persistentKey string, fn func(inv Invalidation)) (stop func() error, err error)
+	}
+
+	// BroadcastOptions configures the publishing and the subscribing of the invalidations
+	BroadcastOptions struct {
+		// Broadcaster delivers the invalidations
+		Broadcaster Broadcaster
+		// Source identifies this instance, the invalidations published by
+		// itself are ignored by its subscription. it cannot be empty
+		Source string
+		// Mode is when the invalidations are published
+		Mode BroadcastMode
+		// Buffer is the buffer size of the changes waiting to be published
+		// by BroadcastOnMutation, DefaultWatchBuffer is used when it is not positive
+		Buffer int
+		// Timeout is the timeout of each publishing or reloading, zero means no timeout
+		Timeout time.Duration
+		// OnError is called when an invalidation fails to be published or
+		// applied, it can be nil
+		OnError func(err error)
+	}
+
+	// broadcaster is a running publisher of the invalidations
+	broadcaster[TData any] struct {
+		opt BroadcastOptions
+		// w is the watcher of the changes in BroadcastOnMutation, nil otherwise
+		w    *Watcher[TData]
+		stop chan struct{}
+		done chan struct{}
+	}
+
+	// RedisBroadcaster is a Broadcaster on the redis pub/sub
+	RedisBroadcaster struct {
+		Cache *cache.Cache
+	}
+)
+
+// validate checks the options
+func (opt BroadcastOptions) validate() error {
+	if opt.Broadcaster == nil {
+		return fmt.Errorf("%w, broadcaster cannot be nil", ErrInvalidInput)
+	}
+	if opt.Source == "" {
+		return fmt.Errorf("%w, source cannot be empty", ErrInvalidInput)
+	}
+	if opt.Buffer < 0 || opt.Timeout < 0 {
+		return fmt.Errorf("%w, buffer and timeout cannot be negative", ErrInvalidInput)
+	}
+	return nil
+}
+
+// context returns the context of a publishing or a reloading
+func (opt BroadcastOptions) context() (context.Context, context.CancelFunc) {
+	if opt.Timeout > 0 {
+		return context.WithTimeout(context.Background(), opt.Timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// onError reports an error if OnError is set
+func (opt BroadcastOptions) onError(err error) {
+	if err != nil && opt.OnError != nil {
+		opt.OnError(err)
+	}
+}
+
+// StartBroadcast starts publishing the invalidations of the storage to the
+// other instances, it is stopped by Close
+func (s *InMemoryStorage[TData]) StartBroadcast(opt BroadcastOptions) error {
+	// validate input
+	if err := opt.validate(); err != nil {
+		return err
+	}
+	// lock the mutex
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.broadcast != nil {
+		return fmt.Errorf("%w, broadcast is already started", ErrStatusError)
+	}
+
+	b := &broadcaster[TData]{opt: opt}
+	if opt.Mode == BroadcastOnMutation {
+		b.w = s.Watch(WatchOptions{Buffer: opt.Buffer})
+		b.stop, b.done = make(chan struct{}), make(chan struct{})
+		go s.runBroadcast(b)
+	}
+	s.broadcast = b
+	return nil
+}
+
+// StartSubscribe starts applying the invalidations published by the other
+// instances, it is stopped by Close. a user in memory is reloaded from the
+// Dumper, unless it has unsaved changes. a user not in memory is loaded
+// only if neither LazyLoad nor Capacity is enabled, since it is loaded on
+// demand otherwise. the reloaded resources are delivered to the watchers as ChangeReload
+func (s *InMemoryStorage[TData]) StartSubscribe(ctx context.Context, opt BroadcastOptions) error {
+	// validate input
+	if err := opt.validate(); err != nil {
+		return err
+	}
+	// if the dumper is not set, return an error
+	s.mu.RLock()
+	noDumper, started := s.Dumper == nil, s.unsubscribe != nil
+	s.mu.RUnlock()
+	if noDumper {
+		return fmt.Errorf("%w, dumper is not set", ErrStatusError)
+	}
+	if started {
+		return fmt.Errorf("%w, subscribe is already started", ErrStatusError)
+	}
+
+	// subscribe without the lock, which is a round trip to the broadcaster
+	stop, err := opt.Broadcaster.Subscribe(ctx, s.PersistentKey, func(inv Invalidation) {
+		if inv.Source == opt.Source || inv.User == "" {
+			return
+		}
+		ctx, cancel := opt.context()
+		defer cancel()
+		opt.onError(s.reloadUser(ctx, inv.User))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to subscribe invalidations, err: %w", err)
+	}
+
+	// lock the mutex
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// another subscription is started during the round trip
+	if s.unsubscribe != nil {
+		_ = stop()
+		return fmt.Errorf("%w, subscribe is already started", ErrStatusError)
+	}
+	s.unsubscribe = stop
+	return nil
+}
+
+// runBroadcast publishes the changes received by the watcher
+func (s *InMemoryStorage[TData]) runBroadcast(b *broadcaster[TData]) {
+	defer close(b.done)
+
+	dropped := uint64(0)
+	for {
+		select {
+		case <-b.stop:
+			return
+		case ev, ok := <-b.w.Events():
+			if !ok {
+				return
+			}
+			// the reloaded resources are published by their source
+			if ev.Kind != ChangeReload {
+				b.publish(s.PersistentKey, ev.User, ev.StoreName)
+			}
+		}
+		if n := b.w.Dropped(); n > dropped {
+			b.opt.onError(fmt.Errorf("%w, %d changes are not broadcast", ErrWatcherOverflow, n-dropped))
+			dropped = n
+		}
+	}
+}
+
+// publishSaved publishes the users saved by Save, so that the subscribers
+// reloading the users published by BroadcastOnMutation before the save get
+// the saved data
+func (s *InMemoryStorage[TData]) publishSaved(changed map[UID]DataMap[TData]) {
+	// lock the mutex
+	s.mu.RLock()
+	b := s.broadcast
+	s.mu.RUnlock()
+
+	if b == nil {
+		return
+	}
+	for user := range changed {
+		b.publish(s.PersistentKey, user, "")
+	}
+}
+
+// publish publishes an invalidation, the error is reported to OnError
+func (b *broadcaster[TData]) publish(persistentKey string, user UID, storeName string) {
+	ctx, cancel := b.opt.context()
+	defer cancel()
+
+	err := b.opt.Broadcaster.Publish(ctx, Invalidation{
+		PersistentKey: persistentKey,
+		User:          user,
+		StoreName:     storeName,
+		Source:        b.opt.Source,
+	})
+	if err != nil {
+		b.opt.onError(fmt.Errorf("failed to publish invalidation of user %s, err: %w", user, err))
+	}
+}
+
+// close stops the publishing
+func (b *broadcaster[TData]) close() {
+	if b.w == nil {
+		return
+	}
+	close(b.stop)
+	<-b.done
+	b.w.Close()
+}
+
+// reloadUser replaces the user in memory with its data in the Dumper, the
+// user is kept if it is modified or purged during the fetch
+func (s *InMemoryStorage[TData]) reloadUser(ctx context.Context, user UID) error {
+	// the user not in memory is loaded on demand
+	sh := s.shardOf(user)
+	unlock := s.rlockUser(user)
+	_, loaded := sh.data[user]
+	written := sh.written[user]
+	unlock()
+	if !loaded && (s.LazyLoad || s.Capacity.enabled()) {
+		return nil
+	}
+
+	epoch := s.purgeEpoch.Load()
+	r, err := s.Dumper.LoadUser(ctx, s.PersistentKey, user)
+	removed := errors.Is(err, ErrUserNotFound)
+	if err != nil && !removed {
+		return fmt.Errorf("failed to reload user %s from permanent storage, err: %w", user, err)
+	}
+	var meta map[UID]MetaMap
+	if !removed {
+		if meta, err = s.loadMeta(ctx, []UID{user}); err != nil {
+			return fmt.Errorf("failed to reload metadata of user %s from permanent storage, err: %w", user, err)
+		}
+	}
+
+	// the reloaded user may exceed the capacity, check it after unlocking
+	defer s.evictIfNeeded()
+	// lock the user
+	unlock = s.lockUser(user)
+	defer unlock()
+
+	// do not override the modifications or the purges made during the fetch,
+	// even if they are saved before the fetch returns
+	if _, dirty := sh.dirty[user]; dirty || sh.written[user] != written || epoch != s.purgeEpoch.Load() {
+		return nil
+	}
+	old := sh.data[user]
+	delete(sh.shared, user)
+	// the user written by another instance is loaded, it is repaired
+	s.clearFailureLocked(user)
+	if removed {
+		delete(sh.data, user)
+		delete(sh.meta, user)
+		s.lru.forget(user)
+	} else {
+		if r == nil {
+			r = make(DataMap[TData])
+		}
+		sh.data[user] = r
+		if m, ok := meta[user]; ok {
+			sh.meta[user] = m
+		} else {
+			delete(sh.meta, user)
+		}
+		s.raiseWriteSeqByMeta(meta)
+		s.resize(user)
+	}
+	s.indexUserLocked(user)
+
+	// deliver the reloaded and the removed resources to the watchers
+	for _, storeName := range sortedStoreNames(r) {
+		v := r[storeName]
+		var prev *TData
+		if o, ok := old[storeName]; ok {
+			prev = &o
+		}
+		s.emitLocked(ChangeReload, user, storeName, prev, &v)
+	}
+	for _, storeName := range sortedStoreNames(old) {
+		if _, ok := r[storeName]; !ok {
+			o := old[storeName]
+			s.emitLocked(ChangeReload, user, storeName, &o, nil)
+		}
+	}
+	return nil
+}
+
+// NewRedisBroadcaster creates a Broadcaster on the redis pub/sub of c
+func NewRedisBroadcaster(c *cache.Cache) *RedisBroadcaster {
+	return &RedisBroadcaster{
+		Cache: c,
+	}
+}
+
+// Publish publishes the invalidation to the channel of its PersistentKey
+func (b *RedisBroadcaster) Publish(ctx context.Context, inv Invalidation) error {
+	payload, err := jsonex.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	return b.Cache.Publish(ctx, SchemeInvalidation.Make(inv.PersistentKey), payload).Err()
+}
+
+// Subscribe subscribes the channel of the persistent key, the malformed
+// messages are ignored
+func (b *RedisBroadcaster) Subscribe(ctx context.Context, persistentKey string, fn func(inv Invalidation)) (func() error, error) {
+	ps := b.Cache.Subscribe(ctx, SchemeInvalidation.Make(persistentKey))
+	// wait for the confirmation, so that no invalidation is missed afterward
+	if _, err := ps.Receive(ctx); err != nil {
+		_ = ps.Close()
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for msg := range ps.Channel() {
+			inv := Invalidation{}
+			if err := jsonex.Unmarshal([]byte(msg.Payload), &inv); err != nil {
+				continue
+			}
+			fn(inv)
+		}
+	}()
+	return func() error {
+		err := ps.Close()
+		<-done
+		return err
+	}, nil
+}
@@ -0,0 +1,218 @@
+package memstore_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/khgame/memstore"
+	"github.com/stretchr/testify/assert"
+)
+
+// memBroadcaster is an in-process Broadcaster that delivers the invalidations synchronously
+type memBroadcaster struct {
+	mu        sync.Mutex
+	subs      map[string][]func(inv memstore.Invalidation)
+	published []memstore.Invalidation
+}
+
+func (b *memBroadcaster) Publish(ctx context.Context, inv memstore.Invalidation) error {
+	b.mu.Lock()
+	b.published = append(b.published, inv)
+	subs := b.subs[inv.PersistentKey]
+	b.mu.Unlock()
+	for _, fn := range subs {
+		fn(inv)
+	}
+	return nil
+}
+
+func (b *memBroadcaster) Subscribe(ctx context.Context, persistentKey string, fn func(inv memstore.Invalidation)) (func() error, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs == nil {
+		b.subs = make(map[string][]func(inv memstore.Invalidation))
+	}
+	b.subs[persistentKey] = append(b.subs[persistentKey], fn)
+	return func() error { return nil }, nil
+}
+
+func (b *memBroadcaster) Published() []memstore.Invalidation {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]memstore.Invalidation(nil), b.published...)
+}
+
+// Test_InMemStorage_Broadcast tests the invalidations between the instances of InMemStorage with testify
+func Test_InMemStorage_Broadcast(t *testing.T) {
+	ctx := context.Background()
+	bc := &memBroadcaster{}
+	primary := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	primary.Dumper = createCacheDumper[TestDataType]()
+	assert.NoError(t, primary.Set("uid001", &TestDataType{Name: "gold", Quantity: 1}))
+	assert.NoError(t, primary.Set("uid002", &TestDataType{Name: "gold", Quantity: 2}))
+	assert.NoError(t, primary.Save(ctx))
+	assert.NoError(t, primary.StartBroadcast(memstore.BroadcastOptions{Broadcaster: bc, Source: "node1"}))
+
+	var errs []error
+	replica := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	replica.Dumper = primary.Dumper
+	assert.NoError(t, replica.Load(ctx))
+	assert.NoError(t, replica.StartSubscribe(ctx, memstore.BroadcastOptions{
+		Broadcaster: bc,
+		Source:      "node2",
+		OnError:     func(err error) { errs = append(errs, err) },
+	}))
+	w := replica.Watch(memstore.WatchOptions{})
+	defer w.Close()
+
+	// the saved users are reloaded by the replica
+	assert.NoError(t, primary.Set("uid001", &TestDataType{Name: "gold", Quantity: 10}))
+	assert.NoError(t, primary.Set("uid003", &TestDataType{Name: "wood", Quantity: 3}))
+	assert.NoError(t, primary.Save(ctx))
+	assert.ElementsMatch(t, []memstore.Invalidation{
+		{PersistentKey: "test_storage", User: "uid001", Source: "node1"},
+		{PersistentKey: "test_storage", User: "uid003", Source: "node1"},
+	}, bc.Published())
+	data := TestDataType{Name: "gold"}
+	assert.NoError(t, replica.Get("uid001", &data))
+	assert.Equal(t, int64(10), data.Quantity)
+	data = TestDataType{Name: "wood"}
+	assert.NoError(t, replica.Get("uid003", &data))
+	assert.Equal(t, int64(3), data.Quantity)
+	assert.ElementsMatch(t, []memstore.ChangeEvent[TestDataType]{
+		{Kind: memstore.ChangeReload, User: "uid001", StoreName: "gold", Old: &TestDataType{Name: "gold", Quantity: 1}, New: &TestDataType{Name: "gold", Quantity: 10}},
+		{Kind: memstore.ChangeReload, User: "uid003", StoreName: "wood", New: &TestDataType{Name: "wood", Quantity: 3}},
+	}, drain(w))
+	assert.False(t, replica.IsDirty())
+
+	// the unsaved changes of the replica are kept
+	assert.NoError(t, replica.Set("uid002", &TestDataType{Name: "gold", Quantity: 200}))
+	assert.NoError(t, primary.Set("uid002", &TestDataType{Name: "gold", Quantity: 20}))
+	assert.NoError(t, primary.Save(ctx))
+	data = TestDataType{Name: "gold"}
+	assert.NoError(t, replica.Get("uid002", &data))
+	assert.Equal(t, int64(200), data.Quantity)
+	drain(w)
+
+	// the purged users are removed from the replica
+	assert.NoError(t, primary.Purge("uid003"))
+	assert.NoError(t, primary.Save(ctx))
+	_, err := replica.List("uid003")
+	assert.ErrorIs(t, err, memstore.ErrUserNotFound)
+	assert.Equal(t, []memstore.ChangeEvent[TestDataType]{
+		{Kind: memstore.ChangeReload, User: "uid003", StoreName: "wood", Old: &TestDataType{Name: "wood", Quantity: 3}},
+	}, drain(w))
+	assert.Empty(t, errs)
+
+	// the replica loading on demand does not load the users it does not hold
+	lazy := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	lazy.Dumper = primary.Dumper
+	lazy.LazyLoad = true
+	assert.NoError(t, lazy.Load(ctx))
+	assert.NoError(t, lazy.StartSubscribe(ctx, memstore.BroadcastOptions{Broadcaster: bc, Source: "node3"}))
+	assert.NoError(t, primary.Set("uid004", &TestDataType{Name: "gold", Quantity: 4}))
+	assert.NoError(t, primary.Save(ctx))
+	entries, err := lazy.Query(func(user memstore.UID, storeName string, value TestDataType) bool { return true })
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+	assert.NoError(t, lazy.Close(ctx))
+	assert.NoError(t, replica.Close(ctx))
+	assert.NoError(t, primary.Close(ctx))
+}
+
+// Test_InMemStorage_BroadcastOnMutation tests the invalidations published on mutation with testify
+func Test_InMemStorage_BroadcastOnMutation(t *testing.T) {
+	ctx := context.Background()
+	bc := &memBroadcaster{}
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = createCacheDumper[TestDataType]()
+	assert.ErrorIs(t, storage.StartBroadcast(memstore.BroadcastOptions{Broadcaster: bc}), memstore.ErrInvalidInput)
+	assert.NoError(t, storage.StartBroadcast(memstore.BroadcastOptions{
+		Broadcaster: bc,
+		Source:      "node1",
+		Mode:        memstore.BroadcastOnMutation,
+	}))
+	assert.ErrorIs(t, storage.StartBroadcast(memstore.BroadcastOptions{Broadcaster: bc, Source: "node1"}), memstore.ErrStatusError)
+
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "gold", Quantity: 1}))
+	assert.NoError(t, storage.Delete("uid001", "gold"))
+	assert.Eventually(t, func() bool {
+		return len(bc.Published()) == 2
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, []memstore.Invalidation{
+		{PersistentKey: "test_storage", User: "uid001", StoreName: "gold", Source: "node1"},
+		{PersistentKey: "test_storage", User: "uid001", StoreName: "gold", Source: "node1"},
+	}, bc.Published())
+
+	// the replica reloading before the save gets the saved data after the save
+	replica := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	replica.Dumper = storage.Dumper
+	assert.NoError(t, replica.Load(ctx))
+	assert.NoError(t, replica.StartSubscribe(ctx, memstore.BroadcastOptions{Broadcaster: bc, Source: "node2"}))
+	assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "gold", Quantity: 2}))
+	assert.Eventually(t, func() bool {
+		return len(bc.Published()) == 3
+	}, time.Second, time.Millisecond)
+	data := TestDataType{Name: "gold"}
+	assert.ErrorIs(t, replica.Get("uid002", &data), memstore.ErrUserNotFound)
+
+	// the saved users are published again by Save
+	assert.NoError(t, storage.Save(ctx))
+	assert.ElementsMatch(t, []memstore.Invalidation{
+		{PersistentKey: "test_storage", User: "uid001", Source: "node1"},
+		{PersistentKey: "test_storage", User: "uid002", Source: "node1"},
+	}, bc.Published()[3:])
+	assert.NoError(t, replica.Get("uid002", &data))
+	assert.Equal(t, int64(2), data.Quantity)
+	assert.NoError(t, replica.Close(ctx))
+	assert.NoError(t, storage.Close(ctx))
+}
+
+// hookedLoadDumper is a dumper that calls hook after LoadUser fetches the user
+type hookedLoadDumper[T any] struct {
+	memstore.Dumper[T]
+	hook func()
+}
+
+func (d *hookedLoadDumper[T]) LoadUser(ctx context.Context, permanentKey string, uid memstore.UID) (memstore.DataMap[T], error) {
+	r, err := d.Dumper.LoadUser(ctx, permanentKey, uid)
+	if hook := d.hook; hook != nil {
+		d.hook = nil
+		hook()
+	}
+	return r, err
+}
+
+// Test_InMemStorage_ReloadDuringSave tests that a reloading does not override the writes saved during the fetch with testify
+func Test_InMemStorage_ReloadDuringSave(t *testing.T) {
+	ctx := context.Background()
+	bc := &memBroadcaster{}
+	primary := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	primary.Dumper = createCacheDumper[TestDataType]()
+	assert.NoError(t, primary.Set("uid001", &TestDataType{Name: "gold", Quantity: 1}))
+	assert.NoError(t, primary.Save(ctx))
+	assert.NoError(t, primary.StartBroadcast(memstore.BroadcastOptions{Broadcaster: bc, Source: "node1"}))
+
+	dp := &hookedLoadDumper[TestDataType]{Dumper: primary.Dumper}
+	replica := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	replica.Dumper = dp
+	assert.NoError(t, replica.Load(ctx))
+	assert.NoError(t, replica.StartSubscribe(ctx, memstore.BroadcastOptions{Broadcaster: bc, Source: "node2"}))
+
+	// the replica writes and saves the user after the fetch of the reloading
+	dp.hook = func() {
+		assert.NoError(t, replica.Set("uid001", &TestDataType{Name: "gold", Quantity: 2}))
+		assert.NoError(t, replica.Save(ctx))
+	}
+	assert.NoError(t, primary.Set("uid001", &TestDataType{Name: "wood", Quantity: 1}))
+	assert.NoError(t, primary.Save(ctx))
+	assert.Nil(t, dp.hook)
+
+	data := TestDataType{Name: "gold"}
+	assert.NoError(t, replica.Get("uid001", &data))
+	assert.Equal(t, int64(2), data.Quantity)
+	assert.NoError(t, replica.Close(ctx))
+	assert.NoError(t, primary.Close(ctx))
+}
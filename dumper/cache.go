@@ -2,7 +2,9 @@ package dumper
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
 
 	"github.com/khgame/memstore/cachekey"
 
@@ -19,14 +21,73 @@ type (
 	// should implement the memstore.Dumper[T any] interface
 	CacheDumper[T any] struct {
 		Cache *cache.Cache
+		// KeepGenerations is the count of the generations kept for rolling
+		// back, each dump except the write-backs makes a new generation of
+		// the previous values of the changed users when it is positive.
+		// generations are disabled when it is not positive
+		KeepGenerations int
+		// Codec encodes the data of each user, the untagged JSON is written
+		// when it is nil. the payloads written by any built-in codec, or by
+		// the versions without codecs, are always loaded
+		Codec Codec
+		// Compression compresses the large payloads, it is optional
+		Compression *Compression
+		// Encryption encrypts the payloads, it is optional. the payloads are
+		// compressed before they are encrypted. the compressed or encrypted
+		// payloads are always detected and loaded, as long as their keys are kept
+		Encryption *Encryption
+		// Checksum prefixes each payload with its checksum, which is verified
+		// on loading. the payloads without checksums are loaded as they are
+		Checksum bool
+		// LoadPolicy defines what Load does with the users that can not be loaded
+		LoadPolicy LoadPolicy
+
+		// reportMu protects lastReport
+		reportMu sync.Mutex
+		// lastReport is the report of the last Load
+		lastReport *LoadReport
+		// migrated records the permanent keys whose legacy index is migrated
+		migrated sync.Map
 	}
 )
 
 const (
 	SchemeMemStoreSaving cachekey.KeyFormat = "store:%s:%s"
+	// SchemeMemStoreMeta is the key of the resources' metadata of a user
+	SchemeMemStoreMeta cachekey.KeyFormat = "store_meta:%s:%s"
+	// SchemeMemStoreIndex is the key of the uid set of a storage, the saved
+	// users are added to it and the purged users are removed from it
+	SchemeMemStoreIndex cachekey.KeyFormat = "store_index:%s"
+	// SchemeMemStoreWriteSeq is the key of the largest write sequence of a
+	// storage dumped, see memstore.WriteSeqDumper
+	SchemeMemStoreWriteSeq cachekey.KeyFormat = "store_seq:%s"
+
+	// legacyIndexKey is the key (in SchemeMemStoreSaving) of the uid list
+	// written by the previous versions, it is migrated to SchemeMemStoreIndex
+	// by the first write
+	legacyIndexKey = "__index"
 )
 
-var _ memstore.Dumper[any] = (*CacheDumper[any])(nil)
+// fenceRetries is how many times a fenced write is retried when the lease is
+// touched during the write, such as renewed by its holder
+const fenceRetries = 3
+
+// raiseSeqScript sets the write sequence if it is larger than the stored one
+var raiseSeqScript = redis.NewScript(`
+local cur = tonumber(redis.call('GET', KEYS[1]) or '0')
+if cur < tonumber(ARGV[1]) then
+	redis.call('SET', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+var (
+	_ memstore.Dumper[any]           = (*CacheDumper[any])(nil)
+	_ memstore.MetaDumper            = (*CacheDumper[any])(nil)
+	_ memstore.ChangeDumper[any]     = (*CacheDumper[any])(nil)
+	_ memstore.GenerationDumper[any] = (*CacheDumper[any])(nil)
+	_ memstore.WriteSeqDumper        = (*CacheDumper[any])(nil)
+)
 
 // CreateCacheDumperByAddr - create a CacheDumper algorithm instance of given type T
 func CreateCacheDumperByAddr[T any](addr string) *CacheDumper[T] {
@@ -45,22 +106,273 @@ func CreateCacheDumperByRedisInstance[T any](c *redis.Client) *CacheDumper[T] {
 	return CreateCacheDumperByCacheInstance[T](cache.NewClientByRedisCli(c))
 }
 
-// Dump - dump the data to the cache
+// Dump - dump the data to the cache, and delete the users that are no longer in data
 func (m *CacheDumper[T]) Dump(ctx context.Context, permanentKey string, data map[memstore.UID]memstore.DataMap[T]) error {
 	makeKey := SchemeMemStoreSaving.Partial(permanentKey)
+	if err := m.migrateIndex(ctx, permanentKey); err != nil {
+		return err
+	}
+
+	// load the previous index, to find the users that are dropped
+	prev, err := m.loadIndex(ctx, permanentKey)
+	if err != nil {
+		return fmt.Errorf("get index of storage %s error: %w", permanentKey, err)
+	}
+
+	// find the users that have dropped out of the index
+	stale := make([]memstore.UID, 0)
+	for _, uid := range prev {
+		if _, ok := data[uid]; !ok {
+			stale = append(stale, uid)
+		}
+	}
+
+	// record the previous values of the written and the deleted users
+	users := make([]memstore.UID, 0, len(data)+len(stale))
+	for uid := range data {
+		users = append(users, uid)
+	}
+	undo, err := m.readUndo(ctx, permanentKey, append(users, stale...), stale)
+	if err != nil {
+		return err
+	}
+	if len(undo) > 0 {
+		_, err = m.Cache.Pipelined(ctx, func(p redis.Pipeliner) error {
+			recordUndo(ctx, p, SchemeMemStoreGenerationPending.Make(permanentKey), undo)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("record generation of storage %s error: %w", permanentKey, err)
+		}
+	}
+
+	keysLst, err := m.saveUsers(ctx, makeKey, data)
+	if err != nil {
+		return err
+	}
+	if err = m.updateIndex(ctx, permanentKey, keysLst, stale); err != nil {
+		return err
+	}
+	return m.createGeneration(ctx, permanentKey)
+}
+
+// DumpChanged - dump the changed users to the cache, and add them to the index,
+// the users with nil data are removed from the index and deleted, also from
+// all the kept generations. only the changed users are touched, whatever the
+// size of the storage is
+func (m *CacheDumper[T]) DumpChanged(ctx context.Context, permanentKey string, changed map[memstore.UID]memstore.DataMap[T]) error {
+	return m.dumpChanged(ctx, permanentKey, changed, nil, memstore.DumpOptions{})
+}
+
+// DumpChangedWithMeta - dump the changed users with their metadata. with
+// opt.Fence, they are written in one transaction, which is made only if the
+// lease is still held by it
+func (m *CacheDumper[T]) DumpChangedWithMeta(ctx context.Context, permanentKey string, changed map[memstore.UID]memstore.DataMap[T], meta map[memstore.UID]memstore.MetaMap, opt memstore.DumpOptions) error {
+	return m.dumpChanged(ctx, permanentKey, changed, meta, opt)
+}
+
+// dumpChanged - write the changed users, the index, and the metadata of the
+// users in meta. the payloads are written in batches before the transaction
+// of the rest, unless the writes are fenced
+func (m *CacheDumper[T]) dumpChanged(ctx context.Context, permanentKey string, changed map[memstore.UID]memstore.DataMap[T], meta map[memstore.UID]memstore.MetaMap, opt memstore.DumpOptions) error {
+	makeKey, makeMetaKey := SchemeMemStoreSaving.Partial(permanentKey), SchemeMemStoreMeta.Partial(permanentKey)
+	if err := m.migrateIndex(ctx, permanentKey); err != nil {
+		return err
+	}
+
+	// encode the changed users, the purged users are split out
+	payloads := make(map[string]string, len(changed))
+	saved, purged := make([]memstore.UID, 0, len(changed)), make([]memstore.UID, 0)
+	for uid, v := range changed {
+		if v == nil {
+			purged = append(purged, uid)
+			continue
+		}
+		key := makeKey(uid)
+		str, err := m.encodeUser(key, v)
+		if err != nil {
+			return err
+		}
+		payloads[key] = string(str)
+		saved = append(saved, uid)
+	}
+	// encode the metadata, the empty ones are deleted
+	metas := make(map[string]string, len(meta))
+	metaUsers := make([]memstore.UID, 0, len(meta))
+	for uid, mm := range meta {
+		if v, ok := changed[uid]; ok && v == nil {
+			continue
+		}
+		metaUsers = append(metaUsers, uid)
+		if len(mm) == 0 {
+			metas[makeMetaKey(uid)] = ""
+			continue
+		}
+		str, err := jsonex.Marshal(mm)
+		if err != nil {
+			return err
+		}
+		metas[makeMetaKey(uid)] = string(str)
+	}
+
+	// record the previous values of the changed users with the writes, the
+	// purged users are erased from the generations instead
+	undo, err := m.readUndo(ctx, permanentKey, saved, metaUsers)
+	if err != nil {
+		return err
+	}
+	genKeys, err := m.generationKeys(ctx, permanentKey, len(purged) > 0)
+	if err != nil {
+		return err
+	}
+
+	// the payloads are written in batches before the rest, unless the writes
+	// are fenced, which makes all of them in one transaction
+	if !m.fenced(opt.Fence) {
+		if err = m.savePayloads(ctx, payloads); err != nil {
+			return fmt.Errorf("dump storage %s error: %w", permanentKey, err)
+		}
+		payloads = nil
+	}
+	indexKey, pendingKey := SchemeMemStoreIndex.Make(permanentKey), SchemeMemStoreGenerationPending.Make(permanentKey)
+	err = m.writeFenced(ctx, opt.Fence, func(p redis.Pipeliner) error {
+		recordUndo(ctx, p, pendingKey, undo)
+		if opt.WriteSeq > 0 {
+			raiseSeqScript.Eval(ctx, p, []string{SchemeMemStoreWriteSeq.Make(permanentKey)}, opt.WriteSeq)
+		}
+		for key, v := range payloads {
+			p.Set(ctx, key, v, 0)
+		}
+		for key, v := range metas {
+			if v == "" {
+				p.Del(ctx, key)
+				continue
+			}
+			p.Set(ctx, key, v, 0)
+		}
+		if len(saved) > 0 {
+			p.SAdd(ctx, indexKey, uidsToAny(saved)...)
+		}
+		if len(purged) > 0 {
+			p.SRem(ctx, indexKey, uidsToAny(purged)...)
+			p.Del(ctx, m.userKeys(permanentKey, purged)...)
+			eraseUndo(ctx, p, genKeys, purged)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("dump storage %s error: %w", permanentKey, err)
+	}
+	// the previous values of a write-back are kept for the next generation
+	if opt.WriteBack {
+		return nil
+	}
+	return m.createGeneration(ctx, permanentKey)
+}
 
-	keysLst := make([]string, 0, len(data))
+// writeFenced - make the writes in a transaction, which is made only if the
+// lease still holds the value of the fence, memstore.ErrLeaseLost is returned
+// otherwise. the writes are not fenced if fence is nil, or the lease is kept
+// in another client, where the key of the lease can not be watched
+func (m *CacheDumper[T]) writeFenced(ctx context.Context, fence *memstore.Fence, write func(p redis.Pipeliner) error) error {
+	if !m.fenced(fence) {
+		_, err := m.Cache.TxPipelined(ctx, write)
+		return err
+	}
+	for i := 0; ; i++ {
+		err := m.Cache.Watch(ctx, func(tx *redis.Tx) error {
+			holder, err := tx.Get(ctx, fence.Key).Result()
+			if err != nil && !cache.IsRedisNil(err) {
+				return err
+			}
+			if holder != fence.Value {
+				return fmt.Errorf("%w, key: %s, token: %d", memstore.ErrLeaseLost, fence.Key, fence.Token)
+			}
+			_, err = tx.TxPipelined(ctx, write)
+			return err
+		}, fence.Key)
+		// the lease is touched during the write, check it again
+		if errors.Is(err, redis.TxFailedErr) && i < fenceRetries {
+			continue
+		}
+		return err
+	}
+}
+
+// fenced - whether the writes with the fence are fenced by writeFenced
+func (m *CacheDumper[T]) fenced(fence *memstore.Fence) bool {
+	return fence != nil && fence.Cache == m.Cache
+}
+
+// savePayloads - save the encoded payloads by their keys in batches
+func (m *CacheDumper[T]) savePayloads(ctx context.Context, payloads map[string]string) error {
+	return m.Cache.BatchSave(ctx, func(fn func(key, v string) error) error {
+		for key, v := range payloads {
+			if err := fn(key, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, 0)
+}
+
+// updateIndex - add the saved users to the index, and remove the dropped
+// users from the index with their data and metadata, in one transaction
+func (m *CacheDumper[T]) updateIndex(ctx context.Context, permanentKey string, saved, dropped []memstore.UID) error {
+	if len(saved) == 0 && len(dropped) == 0 {
+		return nil
+	}
+	indexKey := SchemeMemStoreIndex.Make(permanentKey)
+	_, err := m.Cache.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		if len(saved) > 0 {
+			p.SAdd(ctx, indexKey, uidsToAny(saved)...)
+		}
+		if len(dropped) > 0 {
+			p.SRem(ctx, indexKey, uidsToAny(dropped)...)
+			p.Del(ctx, m.userKeys(permanentKey, dropped)...)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("update index of storage %s error: %w", permanentKey, err)
+	}
+	return nil
+}
+
+// userKeys - the keys of the data and the metadata of the given users
+func (m *CacheDumper[T]) userKeys(permanentKey string, users []memstore.UID) []string {
+	makeKey, makeMetaKey := SchemeMemStoreSaving.Partial(permanentKey), SchemeMemStoreMeta.Partial(permanentKey)
+	keys := make([]string, 0, 2*len(users))
+	for _, uid := range users {
+		keys = append(keys, makeKey(uid), makeMetaKey(uid))
+	}
+	return keys
+}
+
+// uidsToAny - convert the uid list to the arguments of a redis command
+func uidsToAny(users []memstore.UID) []any {
+	ret := make([]any, 0, len(users))
+	for _, uid := range users {
+		ret = append(ret, uid)
+	}
+	return ret
+}
+
+// saveUsers - save the data of each user to the cache, and returns the saved uid list
+func (m *CacheDumper[T]) saveUsers(ctx context.Context, makeKey func(...any) string, data map[memstore.UID]memstore.DataMap[T]) ([]memstore.UID, error) {
+	keysLst := make([]memstore.UID, 0, len(data))
 
 	// use pipeline to save data, group by data length
 	// set expire time to forever
 	err := m.Cache.BatchSave(ctx,
 		func(fn func(key, v string) error) error {
 			for uid, v := range data {
-				str, err := jsonex.Marshal(v)
+				key := makeKey(uid)
+				str, err := m.encodeUser(key, v)
 				if err != nil {
 					return err
 				}
-				if err = fn(makeKey(uid), string(str)); err != nil {
+				if err = fn(key, string(str)); err != nil {
 					return err
 				}
 				keysLst = append(keysLst, uid)
@@ -68,43 +380,183 @@ func (m *CacheDumper[T]) Dump(ctx context.Context, permanentKey string, data map
 			return nil
 		}, 0)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return keysLst, nil
+}
+
+// loadIndex - load the uid list of the storage, the legacy list is read if
+// it is not migrated yet. the list is empty if nothing is stored
+func (m *CacheDumper[T]) loadIndex(ctx context.Context, permanentKey string) ([]memstore.UID, error) {
+	keys, err := m.Cache.SMembers(ctx, SchemeMemStoreIndex.Make(permanentKey)).Result()
+	if err != nil || len(keys) > 0 {
+		return keys, err
 	}
+	return m.loadLegacyIndex(ctx, permanentKey)
+}
 
-	// marshal the key list
-	strLst, err := jsonex.Marshal(keysLst)
+// loadLegacyIndex - load the uid list written by the previous versions,
+// nil is returned if there is none
+func (m *CacheDumper[T]) loadLegacyIndex(ctx context.Context, permanentKey string) ([]memstore.UID, error) {
+	var keys []memstore.UID
+	cmd := m.Cache.Get(ctx, SchemeMemStoreSaving.Make(permanentKey, legacyIndexKey))
+	if err := cmd.Err(); err != nil {
+		if cache.IsRedisNil(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err := jsonex.Unmarshal([]byte(cmd.Val()), &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// migrateIndex - move the legacy uid list into the uid set before the
+// first write of the storage, it is checked once per permanent key
+func (m *CacheDumper[T]) migrateIndex(ctx context.Context, permanentKey string) error {
+	if _, ok := m.migrated.Load(permanentKey); ok {
+		return nil
+	}
+	keys, err := m.loadLegacyIndex(ctx, permanentKey)
 	if err != nil {
-		return err
+		return fmt.Errorf("get legacy index of storage %s error: %w", permanentKey, err)
+	}
+	if keys != nil {
+		_, err = m.Cache.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			if len(keys) > 0 {
+				p.SAdd(ctx, SchemeMemStoreIndex.Make(permanentKey), uidsToAny(keys)...)
+			}
+			p.Del(ctx, SchemeMemStoreSaving.Make(permanentKey, legacyIndexKey))
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("migrate index of storage %s error: %w", permanentKey, err)
+		}
 	}
-	return m.Cache.Set(ctx, makeKey("__index"), strLst, 0).Err()
+	m.migrated.Store(permanentKey, struct{}{})
+	return nil
 }
 
-// Load - load the data from the cache
+// Load - load the data from the cache by LoadPolicy, the users that can not
+// be loaded are listed by LastLoadReport
 func (m *CacheDumper[T]) Load(ctx context.Context, permanentKey string, data *map[memstore.UID]memstore.DataMap[T]) error {
-	makeKey := SchemeMemStoreSaving.Partial(permanentKey)
+	_, err := m.LoadWithFailures(ctx, permanentKey, data, memstore.LoadOptions{})
+	return err
+}
 
-	// load index
-	var keys []string
-	cmd := m.Cache.Get(ctx, makeKey("__index"))
-	if err := cmd.Err(); err != nil {
-		return fmt.Errorf("get index of storage %s error: %w", permanentKey, err)
+// LoadWithFailures - load the data like Load, and return the users that can
+// not be loaded, so that the storage keeps them from being overwritten
+func (m *CacheDumper[T]) LoadWithFailures(ctx context.Context, permanentKey string, data *map[memstore.UID]memstore.DataMap[T], opt memstore.LoadOptions) ([]memstore.LoadFailure, error) {
+	report, err := m.loadWithReport(ctx, permanentKey, data, opt.Fence)
+
+	m.reportMu.Lock()
+	m.lastReport = report
+	m.reportMu.Unlock()
+	if err != nil || report == nil {
+		return nil, err
 	}
-	if err := jsonex.Unmarshal([]byte(cmd.Val()), &keys); err != nil {
-		return fmt.Errorf("unmarshal index of storage %s error: %w", permanentKey, err)
+	return report.Failures, nil
+}
+
+// LoadUser - load the data of a single user from the cache
+func (m *CacheDumper[T]) LoadUser(ctx context.Context, permanentKey string, uid memstore.UID) (memstore.DataMap[T], error) {
+	return m.loadUser(ctx, SchemeMemStoreSaving.Partial(permanentKey), uid)
+}
+
+// loadUser - load the data of a user, memstore.ErrUserNotFound is returned if the key is missing
+func (m *CacheDumper[T]) loadUser(ctx context.Context, makeKey func(...any) string, uid memstore.UID) (memstore.DataMap[T], error) {
+	key := makeKey(uid)
+	get := m.Cache.Get(ctx, key)
+	if err := get.Err(); err != nil {
+		if cache.IsRedisNil(err) {
+			return nil, fmt.Errorf("%w, user: %s", memstore.ErrUserNotFound, uid)
+		}
+		return nil, err
 	}
+	v, err := m.decodeUser(key, []byte(get.Val()))
+	if err != nil {
+		return nil, fmt.Errorf("decode user %s error: %w", uid, err)
+	}
+	return v, nil
+}
 
-	// load data
-	for _, uid := range keys {
-		get := m.Cache.Get(ctx, makeKey(uid))
-		if err := get.Err(); err != nil {
+// DumpMeta - dump the metadata of the given users to the cache,
+// the key is deleted when a user has no metadata
+func (m *CacheDumper[T]) DumpMeta(ctx context.Context, permanentKey string, changed map[memstore.UID]memstore.MetaMap) error {
+	makeKey := SchemeMemStoreMeta.Partial(permanentKey)
+
+	// record the previous metadata in the generation of the data dumped before
+	users := make([]memstore.UID, 0, len(changed))
+	for uid := range changed {
+		users = append(users, uid)
+	}
+	undo, err := m.readUndo(ctx, permanentKey, nil, users)
+	if err != nil {
+		return err
+	}
+	undoKey := ""
+	if len(undo) > 0 {
+		if undoKey, err = m.metaUndoKey(ctx, permanentKey); err != nil {
 			return err
 		}
-		var v memstore.DataMap[T]
-		if err := jsonex.Unmarshal([]byte(get.Val()), &v); err != nil {
-			return err
+	}
+
+	_, err = m.Cache.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		recordUndo(ctx, p, undoKey, undo)
+		for uid, mm := range changed {
+			if len(mm) == 0 {
+				p.Del(ctx, makeKey(uid))
+				continue
+			}
+			str, err := jsonex.Marshal(mm)
+			if err != nil {
+				return err
+			}
+			p.Set(ctx, makeKey(uid), str, 0)
+		}
+		return nil
+	})
+	return err
+}
+
+// LoadMeta - load the metadata of the given users from the cache
+func (m *CacheDumper[T]) LoadMeta(ctx context.Context, permanentKey string, users []memstore.UID) (map[memstore.UID]memstore.MetaMap, error) {
+	makeKey := SchemeMemStoreMeta.Partial(permanentKey)
+
+	cmds := make([]*redis.StringCmd, 0, len(users))
+	_, err := m.Cache.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, uid := range users {
+			cmds = append(cmds, p.Get(ctx, makeKey(uid)))
 		}
-		(*data)[uid] = v
+		return nil
+	})
+	if err != nil && !cache.IsRedisNil(err) {
+		return nil, err
 	}
 
-	return nil
+	ret := make(map[memstore.UID]memstore.MetaMap)
+	for i, cmd := range cmds {
+		if err = cmd.Err(); err != nil {
+			if cache.IsRedisNil(err) {
+				continue
+			}
+			return nil, err
+		}
+		var mm memstore.MetaMap
+		if err = jsonex.Unmarshal([]byte(cmd.Val()), &mm); err != nil {
+			return nil, fmt.Errorf("unmarshal metadata of user %s error: %w", users[i], err)
+		}
+		ret[users[i]] = mm
+	}
+	return ret, nil
+}
+
+// LoadWriteSeq - load the largest write sequence dumped, zero if there is none
+func (m *CacheDumper[T]) LoadWriteSeq(ctx context.Context, permanentKey string) (uint64, error) {
+	seq, err := m.Cache.Get(ctx, SchemeMemStoreWriteSeq.Make(permanentKey)).Uint64()
+	if cache.IsRedisNil(err) {
+		return 0, nil
+	}
+	return seq, err
 }
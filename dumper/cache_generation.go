@@ -0,0 +1,340 @@
+package dumper
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bagaking/goulp/jsonex"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/khgame/memstore"
+	"github.com/khgame/memstore/cache"
+	"github.com/khgame/memstore/cachekey"
+)
+
+const (
+	// SchemeMemStoreGeneration is the key of a generation, it is a hash of the
+	// previous data and metadata of the users changed since the previous
+	// generation, so that a generation is restored by rolling the latest data
+	// back. an empty value means that the user had no data or no metadata
+	SchemeMemStoreGeneration cachekey.KeyFormat = "store_gen:%s:%v"
+	// SchemeMemStoreGenerationPending is the key of the previous values of the
+	// users changed since the latest generation, it becomes the next generation
+	SchemeMemStoreGenerationPending cachekey.KeyFormat = "store_gen_pending:%s"
+	// SchemeMemStoreGenerations is the key of the generation list of a storage,
+	// it is a sorted set of the generation ids
+	SchemeMemStoreGenerations cachekey.KeyFormat = "store_gens:%s"
+	// SchemeMemStoreGenerationSeq is the key of the generation id sequence of a storage
+	SchemeMemStoreGenerationSeq cachekey.KeyFormat = "store_gen_seq:%s"
+
+	// the fields of a generation hash
+	generationFieldCreatedAt = "created_at"
+	generationFieldData      = "data:"
+	generationFieldMeta      = "meta:"
+)
+
+// readUndo - read the current data of dataUsers and the current metadata of
+// metaUsers as they are, by the fields of a generation. nothing is read if
+// the generations are disabled
+func (m *CacheDumper[T]) readUndo(ctx context.Context, permanentKey string, dataUsers, metaUsers []memstore.UID) (map[string]string, error) {
+	if m.KeepGenerations <= 0 || len(dataUsers)+len(metaUsers) == 0 {
+		return nil, nil
+	}
+	makeKey, makeMetaKey := SchemeMemStoreSaving.Partial(permanentKey), SchemeMemStoreMeta.Partial(permanentKey)
+	fields := make([]string, 0, len(dataUsers)+len(metaUsers))
+	cmds := make([]*redis.StringCmd, 0, len(dataUsers)+len(metaUsers))
+	_, err := m.Cache.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, uid := range dataUsers {
+			fields = append(fields, generationFieldData+uid)
+			cmds = append(cmds, p.Get(ctx, makeKey(uid)))
+		}
+		for _, uid := range metaUsers {
+			fields = append(fields, generationFieldMeta+uid)
+			cmds = append(cmds, p.Get(ctx, makeMetaKey(uid)))
+		}
+		return nil
+	})
+	if err != nil && !cache.IsRedisNil(err) {
+		return nil, fmt.Errorf("read storage %s error: %w", permanentKey, err)
+	}
+	undo := make(map[string]string, len(fields))
+	for i, cmd := range cmds {
+		v, err := cmd.Result()
+		if err != nil && !cache.IsRedisNil(err) {
+			return nil, fmt.Errorf("read storage %s error: %w", permanentKey, err)
+		}
+		undo[fields[i]] = v
+	}
+	return undo, nil
+}
+
+// recordUndo - record the previous values into the generation hash of key,
+// the values recorded earlier since the generation began are kept
+func recordUndo(ctx context.Context, p redis.Pipeliner, key string, undo map[string]string) {
+	for field, v := range undo {
+		p.HSetNX(ctx, key, field, v)
+	}
+}
+
+// generationKeys - the keys of the kept generations and the pending one,
+// nothing is listed if need is false
+func (m *CacheDumper[T]) generationKeys(ctx context.Context, permanentKey string, need bool) ([]string, error) {
+	if !need {
+		return nil, nil
+	}
+	ids, err := m.Cache.ZRange(ctx, SchemeMemStoreGenerations.Make(permanentKey), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("get generations of storage %s error: %w", permanentKey, err)
+	}
+	keys := make([]string, 0, len(ids)+1)
+	for _, id := range ids {
+		keys = append(keys, SchemeMemStoreGeneration.Make(permanentKey, id))
+	}
+	return append(keys, SchemeMemStoreGenerationPending.Make(permanentKey)), nil
+}
+
+// eraseUndo - remove the data and the metadata of the users from the given
+// generations, so that a purged user is never restored by a rollback
+func eraseUndo(ctx context.Context, p redis.Pipeliner, keys []string, users []memstore.UID) {
+	fields := make([]string, 0, 2*len(users))
+	for _, uid := range users {
+		fields = append(fields, generationFieldData+uid, generationFieldMeta+uid)
+	}
+	for _, key := range keys {
+		p.HDel(ctx, key, fields...)
+	}
+}
+
+// createGeneration - turn the previous values recorded since the latest
+// generation into a new generation, and prune the generations beyond
+// KeepGenerations. only the changed users are copied, whatever the size of
+// the storage is
+func (m *CacheDumper[T]) createGeneration(ctx context.Context, permanentKey string) error {
+	if m.KeepGenerations <= 0 {
+		return nil
+	}
+	gen, err := m.Cache.Incr(ctx, SchemeMemStoreGenerationSeq.Make(permanentKey)).Result()
+	if err != nil {
+		return fmt.Errorf("create generation of storage %s error: %w", permanentKey, err)
+	}
+	pendingKey := SchemeMemStoreGenerationPending.Make(permanentKey)
+	_, err = m.Cache.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		// the creation time makes sure the pending hash exists to be renamed
+		p.HSet(ctx, pendingKey, generationFieldCreatedAt, time.Now().UnixMilli())
+		p.Rename(ctx, pendingKey, SchemeMemStoreGeneration.Make(permanentKey, gen))
+		p.ZAdd(ctx, SchemeMemStoreGenerations.Make(permanentKey), redis.Z{Score: float64(gen), Member: gen})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("write generation %d of storage %s error: %w", gen, permanentKey, err)
+	}
+	return m.PruneGenerations(ctx, permanentKey, m.KeepGenerations)
+}
+
+// metaUndoKey - the generation hash that records the previous metadata
+// dumped by DumpMeta, which is the latest generation since the metadata
+// belongs to the data dumped right before it
+func (m *CacheDumper[T]) metaUndoKey(ctx context.Context, permanentKey string) (string, error) {
+	latest, err := m.Cache.ZRevRange(ctx, SchemeMemStoreGenerations.Make(permanentKey), 0, 0).Result()
+	if err != nil {
+		return "", fmt.Errorf("get generations of storage %s error: %w", permanentKey, err)
+	}
+	if len(latest) == 0 {
+		return SchemeMemStoreGenerationPending.Make(permanentKey), nil
+	}
+	return SchemeMemStoreGeneration.Make(permanentKey, latest[0]), nil
+}
+
+// Generations - list the kept generations of a storage, in ascending order
+func (m *CacheDumper[T]) Generations(ctx context.Context, permanentKey string) ([]memstore.Generation, error) {
+	ids, err := m.Cache.ZRange(ctx, SchemeMemStoreGenerations.Make(permanentKey), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("get generations of storage %s error: %w", permanentKey, err)
+	}
+	cmds := make([]*redis.StringCmd, 0, len(ids))
+	_, err = m.Cache.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, id := range ids {
+			cmds = append(cmds, p.HGet(ctx, SchemeMemStoreGeneration.Make(permanentKey, id), generationFieldCreatedAt))
+		}
+		return nil
+	})
+	if err != nil && !cache.IsRedisNil(err) {
+		return nil, fmt.Errorf("get generations of storage %s error: %w", permanentKey, err)
+	}
+
+	gens := make([]memstore.Generation, 0, len(ids))
+	for i, id := range ids {
+		gen, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid generation %q of storage %s: %w", id, permanentKey, err)
+		}
+		createdAt, _ := cmds[i].Int64()
+		gens = append(gens, memstore.Generation{ID: gen, CreatedAt: time.UnixMilli(createdAt)})
+	}
+	return gens, nil
+}
+
+// rollback - the previous values of the users changed after the given
+// generation by field, which roll the latest data back to the generation
+func (m *CacheDumper[T]) rollback(ctx context.Context, permanentKey string, gen uint64) (map[string]string, error) {
+	listKey, id := SchemeMemStoreGenerations.Make(permanentKey), strconv.FormatUint(gen, 10)
+	if err := m.Cache.ZScore(ctx, listKey, id).Err(); err != nil {
+		if cache.IsRedisNil(err) {
+			return nil, fmt.Errorf("%w, storage: %s, generation: %d", memstore.ErrGenerationNotFound, permanentKey, gen)
+		}
+		return nil, fmt.Errorf("get generation %d of storage %s error: %w", gen, permanentKey, err)
+	}
+	later, err := m.Cache.ZRangeByScore(ctx, listKey, &redis.ZRangeBy{Min: "(" + id, Max: "+inf"}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("get generations of storage %s error: %w", permanentKey, err)
+	}
+
+	// the later generations in ascending order, then the pending one
+	cmds := make([]*redis.MapStringStringCmd, 0, len(later)+1)
+	_, err = m.Cache.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, id := range later {
+			cmds = append(cmds, p.HGetAll(ctx, SchemeMemStoreGeneration.Make(permanentKey, id)))
+		}
+		cmds = append(cmds, p.HGetAll(ctx, SchemeMemStoreGenerationPending.Make(permanentKey)))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get generations of storage %s error: %w", permanentKey, err)
+	}
+
+	// the value recorded right after the generation wins
+	undo := make(map[string]string)
+	for _, cmd := range cmds {
+		for field, v := range cmd.Val() {
+			if _, ok := undo[field]; !ok && field != generationFieldCreatedAt {
+				undo[field] = v
+			}
+		}
+	}
+	return undo, nil
+}
+
+// LoadGeneration - load the data of the given generation, it is used to roll back
+func (m *CacheDumper[T]) LoadGeneration(ctx context.Context, permanentKey string, gen uint64, data *map[memstore.UID]memstore.DataMap[T]) error {
+	undo, err := m.rollback(ctx, permanentKey, gen)
+	if err != nil {
+		return err
+	}
+	index, err := m.loadIndex(ctx, permanentKey)
+	if err != nil {
+		return fmt.Errorf("get index of storage %s error: %w", permanentKey, err)
+	}
+
+	// the users not changed after the generation are read as they are now
+	makeKey := SchemeMemStoreSaving.Partial(permanentKey)
+	unchanged := make([]memstore.UID, 0, len(index))
+	for _, uid := range index {
+		if _, ok := undo[generationFieldData+uid]; !ok {
+			unchanged = append(unchanged, uid)
+		}
+	}
+	cmds := make([]*redis.StringCmd, 0, len(unchanged))
+	_, err = m.Cache.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, uid := range unchanged {
+			cmds = append(cmds, p.Get(ctx, makeKey(uid)))
+		}
+		return nil
+	})
+	if err != nil && !cache.IsRedisNil(err) {
+		return fmt.Errorf("read storage %s error: %w", permanentKey, err)
+	}
+	payloads := make(map[memstore.UID]string, len(index))
+	for i, uid := range unchanged {
+		if v, err := cmds[i].Result(); err == nil {
+			payloads[uid] = v
+		} else if !cache.IsRedisNil(err) {
+			return fmt.Errorf("read user %s of storage %s error: %w", uid, permanentKey, err)
+		}
+	}
+	for field, v := range undo {
+		if uid := strings.TrimPrefix(field, generationFieldData); uid != field && v != "" {
+			payloads[uid] = v
+		}
+	}
+
+	for uid, str := range payloads {
+		// the payloads are copied from the saved users as they are
+		v, err := m.decodeUser(makeKey(uid), []byte(str))
+		if err != nil {
+			return fmt.Errorf("decode user %s of generation %d error: %w", uid, gen, err)
+		}
+		(*data)[uid] = v
+	}
+	return nil
+}
+
+// LoadGenerationMeta - load the metadata of all the users in the given generation
+func (m *CacheDumper[T]) LoadGenerationMeta(ctx context.Context, permanentKey string, gen uint64) (map[memstore.UID]memstore.MetaMap, error) {
+	undo, err := m.rollback(ctx, permanentKey, gen)
+	if err != nil {
+		return nil, err
+	}
+	index, err := m.loadIndex(ctx, permanentKey)
+	if err != nil {
+		return nil, fmt.Errorf("get index of storage %s error: %w", permanentKey, err)
+	}
+
+	// the users not changed after the generation are read as they are now
+	unchanged := make([]memstore.UID, 0, len(index))
+	for _, uid := range index {
+		if _, ok := undo[generationFieldMeta+uid]; !ok {
+			unchanged = append(unchanged, uid)
+		}
+	}
+	ret, err := m.LoadMeta(ctx, permanentKey, unchanged)
+	if err != nil {
+		return nil, err
+	}
+	for field, v := range undo {
+		uid := strings.TrimPrefix(field, generationFieldMeta)
+		if uid == field || v == "" {
+			continue
+		}
+		var mm memstore.MetaMap
+		if err = jsonex.Unmarshal([]byte(v), &mm); err != nil {
+			return nil, fmt.Errorf("unmarshal metadata of user %s of generation %d error: %w", uid, gen, err)
+		}
+		ret[uid] = mm
+	}
+	return ret, nil
+}
+
+// PruneGenerations - remove the generations except the latest keep ones
+func (m *CacheDumper[T]) PruneGenerations(ctx context.Context, permanentKey string, keep int) error {
+	if keep < 1 {
+		return fmt.Errorf("%w, at least 1 generation must be kept", memstore.ErrInvalidInput)
+	}
+	listKey := SchemeMemStoreGenerations.Make(permanentKey)
+	ids, err := m.Cache.ZRange(ctx, listKey, 0, -1).Result()
+	if err != nil {
+		return fmt.Errorf("get generations of storage %s error: %w", permanentKey, err)
+	}
+	if len(ids) <= keep {
+		return nil
+	}
+	pruned := ids[:len(ids)-keep]
+	_, err = m.Cache.Pipelined(ctx, func(p redis.Pipeliner) error {
+		members := make([]any, 0, len(pruned))
+		for _, id := range pruned {
+			members = append(members, id)
+		}
+		// the generations are unlisted before their content is removed
+		p.ZRem(ctx, listKey, members...)
+		for _, id := range pruned {
+			p.Del(ctx, SchemeMemStoreGeneration.Make(permanentKey, id))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("prune generations of storage %s error: %w", permanentKey, err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package dumper_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/khgame/memstore"
+	"github.com/khgame/memstore/dumper"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_CacheGenerations tests the generations of CacheDumper with testify
+func Test_CacheGenerations(t *testing.T) {
+	dp := createCacheDumper().(*dumper.CacheDumper[TestDataType])
+	ctx := context.Background()
+
+	// no generation is created when it is disabled
+	assert.NoError(t, dp.Dump(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}},
+	}))
+	gens, err := dp.Generations(ctx, "test_storage")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(gens))
+
+	dp.KeepGenerations = 2
+	for i := int64(1); i <= 3; i++ {
+		assert.NoError(t, dp.DumpChanged(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+			"uid002": {"res001": {Name: "res001", Quantity: i}},
+		}))
+		assert.NoError(t, dp.DumpMeta(ctx, "test_storage", map[memstore.UID]memstore.MetaMap{
+			"uid002": {"res001": {ExpireAt: 100 * i}},
+		}))
+	}
+	gens, err = dp.Generations(ctx, "test_storage")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(gens))
+	assert.Equal(t, uint64(2), gens[0].ID)
+	assert.Equal(t, uint64(3), gens[1].ID)
+	assert.False(t, gens[0].CreatedAt.IsZero())
+
+	// load a previous generation
+	data := map[memstore.UID]memstore.DataMap[TestDataType]{}
+	assert.NoError(t, dp.LoadGeneration(ctx, "test_storage", 2, &data))
+	assert.Equal(t, map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}},
+		"uid002": {"res001": {Name: "res001", Quantity: 2}},
+	}, data)
+	meta, err := dp.LoadGenerationMeta(ctx, "test_storage", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, map[memstore.UID]memstore.MetaMap{"uid002": {"res001": {ExpireAt: 200}}}, meta)
+	assert.ErrorIs(t, dp.LoadGeneration(ctx, "test_storage", 1, &data), memstore.ErrGenerationNotFound)
+
+	// prune
+	assert.ErrorIs(t, dp.PruneGenerations(ctx, "test_storage", 0), memstore.ErrInvalidInput)
+	assert.NoError(t, dp.PruneGenerations(ctx, "test_storage", 1))
+	gens, err = dp.Generations(ctx, "test_storage")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(gens))
+	assert.Equal(t, uint64(3), gens[0].ID)
+	assert.ErrorIs(t, dp.LoadGeneration(ctx, "test_storage", 2, &data), memstore.ErrGenerationNotFound)
+}
+
+// Test_CacheGenerationsDelta tests that the generations of CacheDumper hold the changed users only
+func Test_CacheGenerationsDelta(t *testing.T) {
+	dp := createCacheDumper().(*dumper.CacheDumper[TestDataType])
+	dp.KeepGenerations = 3
+	ctx := context.Background()
+
+	assert.NoError(t, dp.DumpChanged(ctx, "test_storage_delta", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}},
+		"uid002": {"res001": {Name: "res001", Quantity: 1}},
+		"uid003": {"res001": {Name: "res001", Quantity: 1}},
+	}))
+	assert.NoError(t, dp.DumpChanged(ctx, "test_storage_delta", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid002": {"res001": {Name: "res001", Quantity: 2}},
+	}))
+
+	// a generation holds the changed users only
+	fields, err := dp.Cache.HKeys(ctx, dumper.SchemeMemStoreGeneration.Make("test_storage_delta", 2)).Result()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"created_at", "data:uid002"}, fields)
+
+	// a write-back makes no generation, but keeps the rollback
+	assert.NoError(t, dp.DumpChangedWithMeta(ctx, "test_storage_delta", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid003": {"res001": {Name: "res001", Quantity: 3}},
+	}, nil, memstore.DumpOptions{WriteBack: true}))
+	gens, err := dp.Generations(ctx, "test_storage_delta")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(gens))
+
+	data := map[memstore.UID]memstore.DataMap[TestDataType]{}
+	assert.NoError(t, dp.LoadGeneration(ctx, "test_storage_delta", 2, &data))
+	assert.Equal(t, map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}},
+		"uid002": {"res001": {Name: "res001", Quantity: 2}},
+		"uid003": {"res001": {Name: "res001", Quantity: 1}},
+	}, data)
+
+	// the users created after a generation are not in it
+	assert.NoError(t, dp.DumpChanged(ctx, "test_storage_delta", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid004": {"res001": {Name: "res001", Quantity: 1}},
+	}))
+	data = map[memstore.UID]memstore.DataMap[TestDataType]{}
+	assert.NoError(t, dp.LoadGeneration(ctx, "test_storage_delta", 1, &data))
+	assert.Equal(t, map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}},
+		"uid002": {"res001": {Name: "res001", Quantity: 1}},
+		"uid003": {"res001": {Name: "res001", Quantity: 1}},
+	}, data)
+}
@@ -18,6 +18,10 @@ type (
 	}
 )
 
+func (t TestDataType) StoreName() string {
+	return t.Name
+}
+
 func createCacheDumper() memstore.Dumper[TestDataType] {
 	// create mini redis server
 	mini, err := miniredis.Run()
@@ -66,4 +70,159 @@ func Test_DumpAndLoad(t *testing.T) {
 			},
 		},
 	}, data)
+
+	// a storage with nothing stored yet is loaded as empty
+	data = map[memstore.UID]memstore.DataMap[TestDataType]{}
+	assert.NoError(t, dp.Load(ctx, "test_storage_new", &data))
+	assert.Empty(t, data)
+}
+
+// Test_DumpChanged tests the DumpChanged method of CacheDumper with testify
+func Test_DumpChanged(t *testing.T) {
+	dp := createCacheDumper()
+	ctx := context.Background()
+	err := dp.Dump(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}},
+		"uid002": {"res001": {Name: "res001", Quantity: 2}},
+	})
+	assert.NoError(t, err)
+
+	// only uid002 and uid003 are changed
+	err = dp.DumpChanged(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid002": {"res001": {Name: "res001", Quantity: 20}},
+		"uid003": {"res002": {Name: "res002", Quantity: 3}},
+	})
+	assert.NoError(t, err)
+
+	// load
+	data := map[memstore.UID]memstore.DataMap[TestDataType]{}
+	err = dp.Load(ctx, "test_storage", &data)
+	assert.NoError(t, err)
+	assert.Equal(t, map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}},
+		"uid002": {"res001": {Name: "res001", Quantity: 20}},
+		"uid003": {"res002": {Name: "res002", Quantity: 3}},
+	}, data)
+
+	// the index holds the users as a set
+	cli := dp.(*dumper.CacheDumper[TestDataType]).Cache
+	assert.ElementsMatch(t, []string{"uid001", "uid002", "uid003"}, cli.SMembers(ctx, dumper.SchemeMemStoreIndex.Make("test_storage")).Val())
+
+	// dump changed to an empty storage creates the index
+	err = dp.DumpChanged(ctx, "test_storage_new", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}},
+	})
+	assert.NoError(t, err)
+	data = map[memstore.UID]memstore.DataMap[TestDataType]{}
+	err = dp.Load(ctx, "test_storage_new", &data)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(data))
+}
+
+// Test_DumpRemovesStaleUsers tests that Dump and DumpChanged delete the users dropped out of the index
+func Test_DumpRemovesStaleUsers(t *testing.T) {
+	dp := createCacheDumper()
+	cli := dp.(*dumper.CacheDumper[TestDataType]).Cache
+	ctx := context.Background()
+	err := dp.Dump(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}},
+		"uid002": {"res001": {Name: "res001", Quantity: 2}},
+		"uid003": {"res001": {Name: "res001", Quantity: 3}},
+	})
+	assert.NoError(t, err)
+
+	// uid003 is no longer in the data
+	err = dp.Dump(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}},
+		"uid002": {"res001": {Name: "res001", Quantity: 2}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), cli.Exists(ctx, dumper.SchemeMemStoreSaving.Make("test_storage", "uid003")).Val())
+
+	// uid002 is purged
+	err = dp.DumpChanged(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 10}},
+		"uid002": nil,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), cli.Exists(ctx, dumper.SchemeMemStoreSaving.Make("test_storage", "uid002")).Val())
+
+	data := map[memstore.UID]memstore.DataMap[TestDataType]{}
+	err = dp.Load(ctx, "test_storage", &data)
+	assert.NoError(t, err)
+	assert.Equal(t, map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 10}},
+	}, data)
+}
+
+// Test_DumpChangedMigratesLegacyIndex tests that the uid list of the previous versions is loaded and migrated
+func Test_DumpChangedMigratesLegacyIndex(t *testing.T) {
+	dp := createCacheDumper().(*dumper.CacheDumper[TestDataType])
+	ctx := context.Background()
+	legacyKey := dumper.SchemeMemStoreSaving.Make("test_storage", "__index")
+	assert.NoError(t, dp.Cache.Set(ctx, dumper.SchemeMemStoreSaving.Make("test_storage", "uid001"), `{"res001":{"Name":"res001","Quantity":1}}`, 0).Err())
+	assert.NoError(t, dp.Cache.Set(ctx, legacyKey, `["uid001"]`, 0).Err())
+
+	// the legacy index is loaded as it is
+	data := map[memstore.UID]memstore.DataMap[TestDataType]{}
+	assert.NoError(t, dp.Load(ctx, "test_storage", &data))
+	assert.Equal(t, map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}},
+	}, data)
+
+	// the first write moves it into the set
+	assert.NoError(t, dp.DumpChanged(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid002": {"res001": {Name: "res001", Quantity: 2}},
+	}))
+	assert.Equal(t, int64(0), dp.Cache.Exists(ctx, legacyKey).Val())
+	assert.ElementsMatch(t, []string{"uid001", "uid002"}, dp.Cache.SMembers(ctx, dumper.SchemeMemStoreIndex.Make("test_storage")).Val())
+	data = map[memstore.UID]memstore.DataMap[TestDataType]{}
+	assert.NoError(t, dp.Load(ctx, "test_storage", &data))
+	assert.Equal(t, 2, len(data))
+}
+
+// Test_LoadUser tests the LoadUser method of CacheDumper with testify
+func Test_LoadUser(t *testing.T) {
+	dp := createCacheDumper()
+	ctx := context.Background()
+	err := dp.Dump(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}},
+		"uid002": {"res001": {Name: "res001", Quantity: 2}},
+	})
+	assert.NoError(t, err)
+
+	v, err := dp.LoadUser(ctx, "test_storage", "uid002")
+	assert.NoError(t, err)
+	assert.Equal(t, memstore.DataMap[TestDataType]{"res001": {Name: "res001", Quantity: 2}}, v)
+
+	_, err = dp.LoadUser(ctx, "test_storage", "uid003")
+	assert.ErrorIs(t, err, memstore.ErrUserNotFound)
+}
+
+// Test_DumpAndLoadMeta tests the DumpMeta & LoadMeta method of CacheDumper with testify
+func Test_DumpAndLoadMeta(t *testing.T) {
+	dp := createCacheDumper().(*dumper.CacheDumper[TestDataType])
+	ctx := context.Background()
+	err := dp.DumpMeta(ctx, "test_storage", map[memstore.UID]memstore.MetaMap{
+		"uid001": {"res001": {ExpireAt: 100}},
+		"uid002": {"res001": {ExpireAt: 200}},
+	})
+	assert.NoError(t, err)
+
+	meta, err := dp.LoadMeta(ctx, "test_storage", []memstore.UID{"uid001", "uid002", "uid003"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[memstore.UID]memstore.MetaMap{
+		"uid001": {"res001": {ExpireAt: 100}},
+		"uid002": {"res001": {ExpireAt: 200}},
+	}, meta)
+
+	// empty and nil metadata are removed
+	err = dp.DumpMeta(ctx, "test_storage", map[memstore.UID]memstore.MetaMap{
+		"uid001": {},
+		"uid002": nil,
+	})
+	assert.NoError(t, err)
+	meta, err = dp.LoadMeta(ctx, "test_storage", []memstore.UID{"uid001", "uid002"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(meta))
 }
@@ -0,0 +1,127 @@
+package dumper
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+
+	"github.com/bagaking/goulp/jsonex"
+)
+
+const (
+	// CodecTagJSON is the tag of JSONCodec
+	CodecTagJSON byte = 0x01
+	// CodecTagGob is the tag of GobCodec
+	CodecTagGob byte = 0x02
+	// CodecTagBinary is the tag of BinaryCodec
+	CodecTagBinary byte = 0x03
+)
+
+var (
+	// ErrUnknownCodec is returned when a payload is tagged by a codec that is not known
+	ErrUnknownCodec = errors.New("unknown codec")
+	// ErrInvalidCodecTag is returned when a payload is written by a codec
+	// whose tag starts a JSON value or is reserved for the transforms
+	ErrInvalidCodecTag = errors.New("invalid codec tag")
+
+	_ Codec = JSONCodec{}
+	_ Codec = GobCodec{}
+	_ Codec = BinaryCodec{}
+
+	// builtinCodecs are the codecs that can always be decoded
+	builtinCodecs = []Codec{JSONCodec{}, GobCodec{}, BinaryCodec{}}
+)
+
+type (
+	// Codec encodes the data of a user into a payload, the payload is
+	// prefixed with the tag of the codec, so that it can be decoded after
+	// the codec is changed
+	Codec interface {
+		// Tag identifies the codec in the payloads, it must not be a byte
+		// that starts a JSON value, which is the legacy untagged payload,
+		// nor a tag reserved for the transforms, 0x10 to 0x1f
+		Tag() byte
+		// Marshal encodes v
+		Marshal(v any) ([]byte, error)
+		// Unmarshal decodes data into v, which is a pointer
+		Unmarshal(data []byte, v any) error
+	}
+
+	// JSONCodec is the Codec of JSON
+	JSONCodec struct{}
+
+	// GobCodec is the Codec of encoding/gob, each payload carries its own type information
+	GobCodec struct{}
+)
+
+// Tag implements Codec
+func (JSONCodec) Tag() byte { return CodecTagJSON }
+
+// Marshal implements Codec
+func (JSONCodec) Marshal(v any) ([]byte, error) { return jsonex.Marshal(v) }
+
+// Unmarshal implements Codec
+func (JSONCodec) Unmarshal(data []byte, v any) error { return jsonex.Unmarshal(data, v) }
+
+// Tag implements Codec
+func (GobCodec) Tag() byte { return CodecTagGob }
+
+// Marshal implements Codec
+func (GobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal implements Codec
+func (GobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// encodePayload encodes v into a payload tagged by the codec, the untagged
+// JSON is written when the codec is nil, so that it can be read by the
+// versions without codecs
+func encodePayload(c Codec, v any) ([]byte, error) {
+	if c == nil {
+		return jsonex.Marshal(v)
+	}
+	// the payload must not be read as the legacy JSON or as a transform
+	if tag := c.Tag(); isJSONStart(tag) || (tag >= transformTagFirst && tag <= transformTagLast) {
+		return nil, fmt.Errorf("%w, tag: 0x%02x", ErrInvalidCodecTag, tag)
+	}
+	body, err := c.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{c.Tag()}, body...), nil
+}
+
+// decodePayload decodes a payload by the codec of its tag, which is either
+// c or a built-in codec. the untagged payload is decoded as JSON
+func decodePayload(c Codec, payload []byte, v any) error {
+	if len(payload) == 0 || isJSONStart(payload[0]) {
+		return jsonex.Unmarshal(payload, v)
+	}
+	tag, body := payload[0], payload[1:]
+	if c != nil && c.Tag() == tag {
+		return c.Unmarshal(body, v)
+	}
+	for _, bc := range builtinCodecs {
+		if bc.Tag() == tag {
+			return bc.Unmarshal(body, v)
+		}
+	}
+	return fmt.Errorf("%w, tag: 0x%02x", ErrUnknownCodec, tag)
+}
+
+// isJSONStart returns true if b can be the first byte of a JSON value
+func isJSONStart(b byte) bool {
+	switch b {
+	case '{', '[', '"', '-', 't', 'f', 'n', ' ', '\t', '\r', '\n':
+		return true
+	}
+	return b >= '0' && b <= '9'
+}
@@ -0,0 +1,385 @@
+package dumper
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+)
+
+var (
+	// ErrUnsupportedType is returned by BinaryCodec for the types it can not encode
+	ErrUnsupportedType = errors.New("unsupported type")
+	// errBinaryTruncated is returned when a binary payload ends unexpectedly
+	errBinaryTruncated = errors.New("binary payload is truncated")
+
+	binaryMarshalerType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+)
+
+type (
+	// BinaryCodec is a compact binary Codec. the values are written in the
+	// order of their exported fields without names or types, so the data must
+	// be decoded into the type it is encoded from. the integers are varints,
+	// and the map entries are sorted, so the encoding is deterministic. the
+	// types implementing both encoding.BinaryMarshaler and
+	// encoding.BinaryUnmarshaler, such as time.Time, are encoded by them.
+	// interfaces, channels and functions are not supported
+	BinaryCodec struct{}
+
+	// binaryReader reads the values from a binary payload
+	binaryReader struct {
+		data []byte
+		off  int
+	}
+)
+
+// Tag implements Codec
+func (BinaryCodec) Tag() byte { return CodecTagBinary }
+
+// Marshal implements Codec
+func (BinaryCodec) Marshal(v any) ([]byte, error) {
+	return appendBinary(nil, reflect.ValueOf(v))
+}
+
+// Unmarshal implements Codec
+func (BinaryCodec) Unmarshal(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("%w, unmarshal into %T", ErrUnsupportedType, v)
+	}
+	r := &binaryReader{data: data}
+	if err := r.read(rv.Elem()); err != nil {
+		return err
+	}
+	if r.off != len(r.data) {
+		return fmt.Errorf("binary payload has %d trailing bytes", len(r.data)-r.off)
+	}
+	return nil
+}
+
+// usesBinaryMarshaler returns true if the type is encoded by its own methods
+func usesBinaryMarshaler(t reflect.Type) bool {
+	pt := reflect.PtrTo(t)
+	return pt.Implements(binaryMarshalerType) && pt.Implements(binaryUnmarshalerType)
+}
+
+// appendBinary appends the encoded value to buf
+func appendBinary(buf []byte, rv reflect.Value) ([]byte, error) {
+	if !rv.IsValid() {
+		return nil, fmt.Errorf("%w, nil interface", ErrUnsupportedType)
+	}
+	t := rv.Type()
+	if usesBinaryMarshaler(t) {
+		p := reflect.New(t)
+		p.Elem().Set(rv)
+		b, err := p.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(b)))
+		return append(buf, b...), nil
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		if rv.Bool() {
+			return append(buf, 1), nil
+		}
+		return append(buf, 0), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return binary.AppendVarint(buf, rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return binary.AppendUvarint(buf, rv.Uint()), nil
+	case reflect.Float32:
+		return binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(rv.Float()))), nil
+	case reflect.Float64:
+		return binary.LittleEndian.AppendUint64(buf, math.Float64bits(rv.Float())), nil
+	case reflect.Complex64:
+		c := rv.Complex()
+		buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(real(c))))
+		return binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(imag(c)))), nil
+	case reflect.Complex128:
+		c := rv.Complex()
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(real(c)))
+		return binary.LittleEndian.AppendUint64(buf, math.Float64bits(imag(c))), nil
+	case reflect.String:
+		buf = binary.AppendUvarint(buf, uint64(rv.Len()))
+		return append(buf, rv.String()...), nil
+	case reflect.Slice:
+		// the length is increased by 1, so that 0 means nil
+		if rv.IsNil() {
+			return append(buf, 0), nil
+		}
+		buf = binary.AppendUvarint(buf, uint64(rv.Len())+1)
+		if t.Elem().Kind() == reflect.Uint8 {
+			return append(buf, rv.Bytes()...), nil
+		}
+		return appendBinaryElems(buf, rv)
+	case reflect.Array:
+		return appendBinaryElems(buf, rv)
+	case reflect.Map:
+		if rv.IsNil() {
+			return append(buf, 0), nil
+		}
+		buf = binary.AppendUvarint(buf, uint64(rv.Len())+1)
+		// the entries are sorted by their encoded keys, so that the same map
+		// is always encoded into the same bytes
+		entries := make([][2][]byte, 0, rv.Len())
+		for it := rv.MapRange(); it.Next(); {
+			k, err := appendBinary(nil, it.Key())
+			if err != nil {
+				return nil, err
+			}
+			v, err := appendBinary(nil, it.Value())
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, [2][]byte{k, v})
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return bytes.Compare(entries[i][0], entries[j][0]) < 0
+		})
+		for _, e := range entries {
+			buf = append(append(buf, e[0]...), e[1]...)
+		}
+		return buf, nil
+	case reflect.Pointer:
+		if rv.IsNil() {
+			return append(buf, 0), nil
+		}
+		return appendBinary(append(buf, 1), rv.Elem())
+	case reflect.Struct:
+		var err error
+		for i := 0; i < t.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				continue
+			}
+			if buf, err = appendBinary(buf, rv.Field(i)); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	default:
+		return nil, fmt.Errorf("%w, type: %s", ErrUnsupportedType, t)
+	}
+}
+
+// appendBinaryElems appends the elements of a slice or an array
+func appendBinaryElems(buf []byte, rv reflect.Value) ([]byte, error) {
+	var err error
+	for i := 0; i < rv.Len(); i++ {
+		if buf, err = appendBinary(buf, rv.Index(i)); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// read decodes a value into rv, which must be settable
+func (r *binaryReader) read(rv reflect.Value) error {
+	t := rv.Type()
+	if usesBinaryMarshaler(t) {
+		b, err := r.bytes()
+		if err != nil {
+			return err
+		}
+		return rv.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(b)
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		b, err := r.fixed(1)
+		if err != nil {
+			return err
+		}
+		rv.SetBool(b[0] != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v, n := binary.Varint(r.data[r.off:])
+		if n <= 0 {
+			return errBinaryTruncated
+		}
+		r.off += n
+		if rv.OverflowInt(v) {
+			return fmt.Errorf("value %d overflows %s", v, t)
+		}
+		rv.SetInt(v)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		v, err := r.uvarint()
+		if err != nil {
+			return err
+		}
+		if rv.OverflowUint(v) {
+			return fmt.Errorf("value %d overflows %s", v, t)
+		}
+		rv.SetUint(v)
+	case reflect.Float32:
+		b, err := r.fixed(4)
+		if err != nil {
+			return err
+		}
+		rv.SetFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(b))))
+	case reflect.Float64:
+		b, err := r.fixed(8)
+		if err != nil {
+			return err
+		}
+		rv.SetFloat(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+	case reflect.Complex64:
+		b, err := r.fixed(8)
+		if err != nil {
+			return err
+		}
+		rv.SetComplex(complex(float64(math.Float32frombits(binary.LittleEndian.Uint32(b))),
+			float64(math.Float32frombits(binary.LittleEndian.Uint32(b[4:])))))
+	case reflect.Complex128:
+		b, err := r.fixed(16)
+		if err != nil {
+			return err
+		}
+		rv.SetComplex(complex(math.Float64frombits(binary.LittleEndian.Uint64(b)),
+			math.Float64frombits(binary.LittleEndian.Uint64(b[8:]))))
+	case reflect.String:
+		b, err := r.bytes()
+		if err != nil {
+			return err
+		}
+		rv.SetString(string(b))
+	case reflect.Slice:
+		n, err := r.length()
+		if err != nil || n < 0 {
+			rv.Set(reflect.Zero(t))
+			return err
+		}
+		if t.Elem().Kind() == reflect.Uint8 {
+			b, err := r.fixed(n)
+			if err != nil {
+				return err
+			}
+			rv.SetBytes(append(make([]byte, 0, n), b...))
+			return nil
+		}
+		// the capacity is bounded by the remaining bytes, in case the length is corrupted
+		sl := reflect.MakeSlice(t, 0, minInt(n, len(r.data)-r.off))
+		for i := 0; i < n; i++ {
+			e := reflect.New(t.Elem()).Elem()
+			if err = r.read(e); err != nil {
+				return err
+			}
+			sl = reflect.Append(sl, e)
+		}
+		rv.Set(sl)
+	case reflect.Array:
+		return r.readElems(rv)
+	case reflect.Map:
+		n, err := r.length()
+		if err != nil || n < 0 {
+			rv.Set(reflect.Zero(t))
+			return err
+		}
+		m := reflect.MakeMapWithSize(t, 0)
+		for i := 0; i < n; i++ {
+			k, v := reflect.New(t.Key()).Elem(), reflect.New(t.Elem()).Elem()
+			if err = r.read(k); err != nil {
+				return err
+			}
+			if err = r.read(v); err != nil {
+				return err
+			}
+			m.SetMapIndex(k, v)
+		}
+		rv.Set(m)
+	case reflect.Pointer:
+		b, err := r.fixed(1)
+		if err != nil {
+			return err
+		}
+		if b[0] == 0 {
+			rv.Set(reflect.Zero(t))
+			return nil
+		}
+		p := reflect.New(t.Elem())
+		if err = r.read(p.Elem()); err != nil {
+			return err
+		}
+		rv.Set(p)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				continue
+			}
+			if err := r.read(rv.Field(i)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%w, type: %s", ErrUnsupportedType, t)
+	}
+	return nil
+}
+
+// readElems decodes the elements of a slice or an array
+func (r *binaryReader) readElems(rv reflect.Value) error {
+	for i := 0; i < rv.Len(); i++ {
+		if err := r.read(rv.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uvarint reads an unsigned varint
+func (r *binaryReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.data[r.off:])
+	if n <= 0 {
+		return 0, errBinaryTruncated
+	}
+	r.off += n
+	return v, nil
+}
+
+// length reads the length of a slice or a map, -1 means nil
+func (r *binaryReader) length() (int, error) {
+	v, err := r.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if v > math.MaxInt32 {
+		return 0, fmt.Errorf("binary length %d is too large", v)
+	}
+	return int(v) - 1, nil
+}
+
+// minInt returns the smaller one of a and b
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// fixed reads n bytes
+func (r *binaryReader) fixed(n int) ([]byte, error) {
+	if n < 0 || n > len(r.data)-r.off {
+		return nil, errBinaryTruncated
+	}
+	b := r.data[r.off : r.off+n]
+	r.off += n
+	return b, nil
+}
+
+// bytes reads the bytes prefixed with their length
+func (r *binaryReader) bytes() ([]byte, error) {
+	n, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(r.data)-r.off) {
+		return nil, errBinaryTruncated
+	}
+	return r.fixed(int(n))
+}
@@ -0,0 +1,67 @@
+package dumper_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/khgame/memstore/dumper"
+	"github.com/stretchr/testify/assert"
+)
+
+type (
+	// binaryItem covers the kinds supported by BinaryCodec
+	binaryItem struct {
+		Flag     bool
+		Count    int32
+		Amount   uint64
+		Ratio    float64
+		Scale    float32
+		Wave     complex128
+		Name     string
+		Raw      []byte
+		Tags     []string
+		NilTags  []string
+		Slots    [3]int8
+		Attrs    map[string]int
+		Parent   *binaryItem
+		Created  time.Time
+		internal int
+	}
+)
+
+// Test_BinaryCodec tests the encoding of BinaryCodec with testify
+func Test_BinaryCodec(t *testing.T) {
+	c := dumper.BinaryCodec{}
+	in := binaryItem{
+		Flag:    true,
+		Count:   -42,
+		Amount:  1 << 40,
+		Ratio:   0.25,
+		Scale:   1.5,
+		Wave:    complex(1, -1),
+		Name:    "sword",
+		Raw:     []byte{0, 1, 2},
+		Tags:    []string{"a", ""},
+		Slots:   [3]int8{1, -1, 0},
+		Attrs:   map[string]int{"atk": 10, "def": -3},
+		Parent:  &binaryItem{Name: "parent", Tags: []string{}},
+		Created: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	payload, err := c.Marshal(in)
+	assert.NoError(t, err)
+	var out binaryItem
+	assert.NoError(t, c.Unmarshal(payload, &out))
+	assert.Equal(t, in, out)
+
+	// the unexported fields are not encoded
+	in.internal = 1
+	payload2, err := c.Marshal(in)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, payload2)
+
+	// the truncated payloads and the unsupported types are rejected
+	assert.Error(t, c.Unmarshal(payload[:len(payload)-1], &out))
+	assert.Error(t, c.Unmarshal(append(payload, 0), &out))
+	_, err = c.Marshal(map[string]any{"a": 1})
+	assert.ErrorIs(t, err, dumper.ErrUnsupportedType)
+}
@@ -0,0 +1,183 @@
+package dumper_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/khgame/memstore"
+	"github.com/khgame/memstore/dumper"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_Codecs tests the built-in codecs with testify
+func Test_Codecs(t *testing.T) {
+	data := memstore.DataMap[TestDataType]{
+		"res001": {Name: "res001", Quantity: 1},
+		"res002": {Name: "res002", Quantity: -200},
+	}
+	var jsonSize int
+	for _, c := range []dumper.Codec{dumper.JSONCodec{}, dumper.GobCodec{}, dumper.BinaryCodec{}} {
+		payload, err := c.Marshal(data)
+		assert.NoError(t, err)
+		var out memstore.DataMap[TestDataType]
+		assert.NoError(t, c.Unmarshal(payload, &out))
+		assert.Equal(t, data, out)
+		if c.Tag() == dumper.CodecTagJSON {
+			jsonSize = len(payload)
+		} else if c.Tag() == dumper.CodecTagBinary {
+			assert.Less(t, 2*len(payload), jsonSize)
+		}
+	}
+}
+
+// Test_CacheDumperCodec tests the migration between the codecs of CacheDumper with testify
+func Test_CacheDumperCodec(t *testing.T) {
+	ctx := context.Background()
+	dp := createCacheDumper().(*dumper.CacheDumper[TestDataType])
+	key := func(uid string) string { return dumper.SchemeMemStoreSaving.Make("test_storage", uid) }
+
+	// the legacy payloads are untagged JSON
+	assert.NoError(t, dp.Dump(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}},
+	}))
+	assert.Equal(t, `{"res001":{"Name":"res001","Quantity":1}}`, dp.Cache.Get(ctx, key("uid001")).Val())
+
+	// the payloads are tagged by the codec they are written by
+	dp.Codec = dumper.GobCodec{}
+	assert.NoError(t, dp.DumpChanged(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid002": {"res001": {Name: "res001", Quantity: 2}},
+	}))
+	assert.Equal(t, dumper.CodecTagGob, dp.Cache.Get(ctx, key("uid002")).Val()[0])
+	dp.Codec = dumper.BinaryCodec{}
+	assert.NoError(t, dp.DumpChanged(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid003": {"res001": {Name: "res001", Quantity: 3}},
+	}))
+	assert.Equal(t, dumper.CodecTagBinary, dp.Cache.Get(ctx, key("uid003")).Val()[0])
+
+	// all of them are loaded whatever the current codec is
+	for _, c := range []dumper.Codec{nil, dumper.JSONCodec{}, dumper.GobCodec{}, dumper.BinaryCodec{}} {
+		dp.Codec = c
+		data := map[memstore.UID]memstore.DataMap[TestDataType]{}
+		assert.NoError(t, dp.Load(ctx, "test_storage", &data))
+		assert.Equal(t, map[memstore.UID]memstore.DataMap[TestDataType]{
+			"uid001": {"res001": {Name: "res001", Quantity: 1}},
+			"uid002": {"res001": {Name: "res001", Quantity: 2}},
+			"uid003": {"res001": {Name: "res001", Quantity: 3}},
+		}, data)
+	}
+
+	// the payload of an unknown codec is rejected
+	assert.NoError(t, dp.Cache.Set(ctx, key("uid004"), "\x7f{}", 0).Err())
+	_, err := dp.LoadUser(ctx, "test_storage", "uid004")
+	assert.ErrorIs(t, err, dumper.ErrUnknownCodec)
+
+	// the legacy JSON with leading whitespaces is not read as a transform
+	assert.NoError(t, dp.Cache.Set(ctx, key("uid005"), ` {"res001":{"Name":"res001","Quantity":5}}`, 0).Err())
+	v, err := dp.LoadUser(ctx, "test_storage", "uid005")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), v["res001"].Quantity)
+
+	// the codecs can not use the tags of JSON or of the transforms
+	for _, tag := range []byte{'{', ' ', dumper.TransformTagGzip, dumper.TransformTagAESGCM, dumper.TransformTagCRC32} {
+		dp.Codec = tagCodec{tag: tag}
+		err = dp.DumpChanged(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+			"uid006": {"res001": {Name: "res001", Quantity: 6}},
+		})
+		assert.ErrorIs(t, err, dumper.ErrInvalidCodecTag)
+	}
+}
+
+// tagCodec is a JSON codec with a custom tag
+type tagCodec struct {
+	dumper.JSONCodec
+	tag byte
+}
+
+func (c tagCodec) Tag() byte { return c.tag }
+
+// Test_SQLDumperCodec tests the migration between the codecs of SQLDumper with testify
+func Test_SQLDumperCodec(t *testing.T) {
+	ctx := context.Background()
+	dp := createSQLDumper(t)
+	value := func(uid string) string {
+		var v string
+		assert.NoError(t, dp.DB.QueryRow(`SELECT value FROM `+dumper.DefaultSQLTable+` WHERE uid = ?`, uid).Scan(&v))
+		return v
+	}
+
+	// the legacy values are untagged JSON
+	assert.NoError(t, dp.DumpChanged(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}},
+	}))
+	assert.Equal(t, `{"Name":"res001","Quantity":1}`, value("uid001"))
+
+	// the values of a codec are tagged payloads in base64
+	dp.Codec = dumper.BinaryCodec{}
+	assert.NoError(t, dp.DumpChanged(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid002": {"res001": {Name: "res001", Quantity: 2}},
+	}))
+	assert.True(t, strings.HasPrefix(value("uid002"), "b64:"))
+
+	// all of them are loaded whatever the current codec is
+	for _, c := range []dumper.Codec{nil, dumper.GobCodec{}, dumper.BinaryCodec{}} {
+		dp.Codec = c
+		data := map[memstore.UID]memstore.DataMap[TestDataType]{}
+		assert.NoError(t, dp.Load(ctx, "test_storage", &data))
+		assert.Equal(t, map[memstore.UID]memstore.DataMap[TestDataType]{
+			"uid001": {"res001": {Name: "res001", Quantity: 1}},
+			"uid002": {"res001": {Name: "res001", Quantity: 2}},
+		}, data)
+	}
+}
+
+// Test_FileDumperCodec tests the migration between the codecs of FileDumper with testify
+func Test_FileDumperCodec(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dp := dumper.CreateFileDumper[TestDataType](dir)
+	dp.KeepGenerations = 2
+
+	// the legacy snapshot is untagged JSON, the next one is tagged
+	assert.NoError(t, dp.DumpChanged(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}},
+	}))
+	dp.Codec = dumper.GobCodec{}
+	assert.NoError(t, dp.DumpChanged(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid002": {"res001": {Name: "res001", Quantity: 2}},
+	}))
+	raw, err := os.ReadFile(filepath.Join(dir, "test_storage", "00000000000000000001.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, byte('{'), raw[0])
+	// the files are named after their codecs
+	raw, err = os.ReadFile(filepath.Join(dir, "test_storage", "00000000000000000002.gob"))
+	assert.NoError(t, err)
+	assert.Equal(t, dumper.CodecTagGob, raw[0])
+
+	// both of them are loaded whatever the current codec is
+	for _, c := range []dumper.Codec{nil, dumper.BinaryCodec{}} {
+		dp.Codec = c
+		data := map[memstore.UID]memstore.DataMap[TestDataType]{}
+		assert.NoError(t, dp.LoadGeneration(ctx, "test_storage", 1, &data))
+		assert.Equal(t, 1, len(data))
+		data = map[memstore.UID]memstore.DataMap[TestDataType]{}
+		assert.NoError(t, dp.Load(ctx, "test_storage", &data))
+		assert.Equal(t, map[memstore.UID]memstore.DataMap[TestDataType]{
+			"uid001": {"res001": {Name: "res001", Quantity: 1}},
+			"uid002": {"res001": {Name: "res001", Quantity: 2}},
+		}, data)
+	}
+
+	// the compressed file is named after its codec as well
+	dp.Codec, dp.Gzip = dumper.BinaryCodec{}, true
+	assert.NoError(t, dp.DumpChanged(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid003": {"res001": {Name: "res001", Quantity: 3}},
+	}))
+	_, err = os.Stat(filepath.Join(dir, "test_storage", "00000000000000000003.bin.gz"))
+	assert.NoError(t, err)
+	gens, err := dp.Generations(ctx, "test_storage")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(gens))
+}
@@ -0,0 +1,713 @@
+package dumper
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/khgame/memstore"
+)
+
+type (
+	// FileDumper - a memory store saving algorithm on the local file system,
+	// each dump writes a new snapshot generation of the whole storage to
+	// <Dir>/<permanentKey>/, by writing a temp file and renaming it. the
+	// files are named after the generation and the codec, such as
+	// 00000000000000000001.gob.gz. the latest snapshot is kept decoded in
+	// memory while its file is unchanged
+	// should implement the memstore.Dumper[T any] interface
+	FileDumper[T any] struct {
+		// Dir is the root directory of the snapshots
+		Dir string
+		// Gzip compresses the new snapshots, the existing snapshots are
+		// loaded whether they are compressed or not
+		Gzip bool
+		// KeepGenerations is the count of the snapshot generations kept for
+		// rolling back, the older ones are removed after each dump.
+		// only the latest generation is kept when it is not positive
+		KeepGenerations int
+		// Codec encodes the snapshots, the untagged JSON is written when it is
+		// nil. the snapshots written by any built-in codec, or by the versions
+		// without codecs, are always loaded
+		Codec Codec
+
+		// mu serializes the snapshot operations of the dumper
+		mu sync.Mutex
+		// latest caches the latest snapshot of each directory, it is read only
+		latest map[string]*cachedSnapshot[T]
+	}
+
+	// cachedSnapshot is a decoded snapshot with the stat of its file
+	cachedSnapshot[T any] struct {
+		name    string
+		size    int64
+		modTime time.Time
+		snap    *fileSnapshot[T]
+	}
+
+	// fileSnapshot is the content of a snapshot file
+	fileSnapshot[T any] struct {
+		Data map[memstore.UID]memstore.DataMap[T] `json:"data"`
+		Meta map[memstore.UID]memstore.MetaMap    `json:"meta,omitempty"`
+		// WriteSeq is the largest write sequence dumped, see memstore.WriteSeqDumper
+		WriteSeq uint64 `json:"write_seq,omitempty"`
+	}
+)
+
+const (
+	// fileSnapshotGzipExt is appended to the name of a compressed snapshot file
+	fileSnapshotGzipExt = ".gz"
+	// fileTempPattern is the name pattern of the temp files before renaming
+	fileTempPattern = ".tmp-*"
+)
+
+// fileCodecExts are the extensions of the snapshot files by the tags of the
+// built-in codecs, the files of the custom codecs have no extension
+var fileCodecExts = map[byte]string{
+	CodecTagJSON:   ".json",
+	CodecTagGob:    ".gob",
+	CodecTagBinary: ".bin",
+}
+
+var (
+	_ memstore.Dumper[any]           = (*FileDumper[any])(nil)
+	_ memstore.MetaDumper            = (*FileDumper[any])(nil)
+	_ memstore.ChangeDumper[any]     = (*FileDumper[any])(nil)
+	_ memstore.GenerationDumper[any] = (*FileDumper[any])(nil)
+	_ memstore.WriteSeqDumper        = (*FileDumper[any])(nil)
+)
+
+// CreateFileDumper - create a FileDumper algorithm instance of given type T
+func CreateFileDumper[T any](dir string) *FileDumper[T] {
+	return &FileDumper[T]{
+		Dir: dir,
+	}
+}
+
+// Dump - write the data as a new snapshot generation
+func (m *FileDumper[T]) Dump(ctx context.Context, permanentKey string, data map[memstore.UID]memstore.DataMap[T]) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, err := m.storageDir(permanentKey)
+	if err != nil {
+		return err
+	}
+	prev, gen, err := m.loadLatest(dir)
+	if err != nil {
+		return err
+	}
+
+	// the metadata of the remaining users and the write sequence are kept
+	snap := &fileSnapshot[T]{
+		Data:     make(map[memstore.UID]memstore.DataMap[T], len(data)),
+		Meta:     make(map[memstore.UID]memstore.MetaMap),
+		WriteSeq: prev.WriteSeq,
+	}
+	for uid, v := range data {
+		snap.Data[uid] = cloneDataMap(v)
+	}
+	for uid, mm := range prev.Meta {
+		if _, ok := data[uid]; ok {
+			snap.Meta[uid] = mm
+		}
+	}
+	return m.writeGeneration(ctx, dir, gen+1, snap)
+}
+
+// DumpChanged - merge the changed users into the latest snapshot, and write
+// it as a new generation, the users with nil data are removed, also from the
+// kept snapshots of the previous generations
+func (m *FileDumper[T]) DumpChanged(ctx context.Context, permanentKey string, changed map[memstore.UID]memstore.DataMap[T]) error {
+	return m.dumpChanged(ctx, permanentKey, changed, nil, memstore.DumpOptions{})
+}
+
+// DumpChangedWithMeta - merge the changed users with their metadata into the
+// latest snapshot, and write it once. a write-back rewrites the latest
+// generation in place instead of making a new one
+func (m *FileDumper[T]) DumpChangedWithMeta(ctx context.Context, permanentKey string, changed map[memstore.UID]memstore.DataMap[T], meta map[memstore.UID]memstore.MetaMap, opt memstore.DumpOptions) error {
+	return m.dumpChanged(ctx, permanentKey, changed, meta, opt)
+}
+
+// dumpChanged - merge the changed users and the metadata of the users in
+// meta into the latest snapshot, and write it
+func (m *FileDumper[T]) dumpChanged(ctx context.Context, permanentKey string, changed map[memstore.UID]memstore.DataMap[T], meta map[memstore.UID]memstore.MetaMap, opt memstore.DumpOptions) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, err := m.storageDir(permanentKey)
+	if err != nil {
+		return err
+	}
+	latest, gen, err := m.loadLatest(dir)
+	if err != nil {
+		return err
+	}
+	snap := latest.clone()
+	purged := make([]memstore.UID, 0)
+	for uid, v := range changed {
+		if v == nil {
+			delete(snap.Data, uid)
+			delete(snap.Meta, uid)
+			purged = append(purged, uid)
+			continue
+		}
+		snap.Data[uid] = cloneDataMap(v)
+	}
+	for uid, mm := range meta {
+		if v, ok := changed[uid]; ok && v == nil {
+			continue
+		}
+		if len(mm) == 0 {
+			delete(snap.Meta, uid)
+			continue
+		}
+		snap.Meta[uid] = cloneMetaMap(mm)
+	}
+	if opt.WriteSeq > snap.WriteSeq {
+		snap.WriteSeq = opt.WriteSeq
+	}
+
+	next := gen + 1
+	if opt.WriteBack && gen > 0 {
+		next = gen
+	}
+	if err = m.writeGeneration(ctx, dir, next, snap); err != nil {
+		return err
+	}
+	return m.erase(ctx, dir, next, purged)
+}
+
+// erase - rewrite the kept snapshots before the given generation without the
+// given users, so that a purged user is never restored by a rollback
+func (m *FileDumper[T]) erase(ctx context.Context, dir string, gen uint64, users []memstore.UID) error {
+	if len(users) == 0 {
+		return nil
+	}
+	files, err := m.listGenerations(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.gen >= gen {
+			continue
+		}
+		snap, err := m.readSnapshot(filepath.Join(dir, f.name))
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, uid := range users {
+			_, inData := snap.Data[uid]
+			_, inMeta := snap.Meta[uid]
+			if inData || inMeta {
+				delete(snap.Data, uid)
+				delete(snap.Meta, uid)
+				found = true
+			}
+		}
+		if !found {
+			continue
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		// the snapshot is written by the current codec, so it is renamed after it
+		gz := strings.HasSuffix(f.name, fileSnapshotGzipExt)
+		raw, err := m.marshalSnapshot(snap, gz)
+		if err != nil {
+			return err
+		}
+		name := m.snapshotName(f.gen, gz)
+		if err = writeFileAtomic(dir, name, raw); err != nil {
+			return err
+		}
+		if name == f.name {
+			continue
+		}
+		if err = os.Remove(filepath.Join(dir, f.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove snapshot %s error: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+// Load - load the data from the latest snapshot, nothing is loaded if there is no snapshot yet
+func (m *FileDumper[T]) Load(ctx context.Context, permanentKey string, data *map[memstore.UID]memstore.DataMap[T]) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, err := m.storageDir(permanentKey)
+	if err != nil {
+		return err
+	}
+	snap, _, err := m.loadLatest(dir)
+	if err != nil {
+		return err
+	}
+	for uid, v := range snap.Data {
+		(*data)[uid] = cloneDataMap(v)
+	}
+	return nil
+}
+
+// LoadUser - load the data of a single user from the latest snapshot
+func (m *FileDumper[T]) LoadUser(ctx context.Context, permanentKey string, uid memstore.UID) (memstore.DataMap[T], error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, err := m.storageDir(permanentKey)
+	if err != nil {
+		return nil, err
+	}
+	snap, _, err := m.loadLatest(dir)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := snap.Data[uid]
+	if !ok {
+		return nil, fmt.Errorf("%w, user: %s", memstore.ErrUserNotFound, uid)
+	}
+	return cloneDataMap(v), nil
+}
+
+// DumpMeta - replace the metadata of the given users in the latest snapshot,
+// the latest generation is rewritten in place since the metadata belongs to
+// the data dumped right before it
+func (m *FileDumper[T]) DumpMeta(ctx context.Context, permanentKey string, changed map[memstore.UID]memstore.MetaMap) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, err := m.storageDir(permanentKey)
+	if err != nil {
+		return err
+	}
+	latest, gen, err := m.loadLatest(dir)
+	if err != nil {
+		return err
+	}
+	snap := latest.clone()
+	for uid, mm := range changed {
+		if len(mm) == 0 {
+			delete(snap.Meta, uid)
+			continue
+		}
+		snap.Meta[uid] = cloneMetaMap(mm)
+	}
+	if gen == 0 {
+		gen = 1
+	}
+	return m.writeGeneration(ctx, dir, gen, snap)
+}
+
+// LoadMeta - load the metadata of the given users from the latest snapshot
+func (m *FileDumper[T]) LoadMeta(ctx context.Context, permanentKey string, users []memstore.UID) (map[memstore.UID]memstore.MetaMap, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, err := m.storageDir(permanentKey)
+	if err != nil {
+		return nil, err
+	}
+	snap, _, err := m.loadLatest(dir)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[memstore.UID]memstore.MetaMap)
+	for _, uid := range users {
+		if mm, ok := snap.Meta[uid]; ok {
+			ret[uid] = cloneMetaMap(mm)
+		}
+	}
+	return ret, nil
+}
+
+// LoadWriteSeq - load the largest write sequence dumped from the latest
+// snapshot, zero if there is none
+func (m *FileDumper[T]) LoadWriteSeq(ctx context.Context, permanentKey string) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, err := m.storageDir(permanentKey)
+	if err != nil {
+		return 0, err
+	}
+	snap, _, err := m.loadLatest(dir)
+	if err != nil {
+		return 0, err
+	}
+	return snap.WriteSeq, nil
+}
+
+// Generations - list the kept snapshot generations of a storage, in ascending order
+func (m *FileDumper[T]) Generations(ctx context.Context, permanentKey string) ([]memstore.Generation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, err := m.storageDir(permanentKey)
+	if err != nil {
+		return nil, err
+	}
+	files, err := m.listGenerations(dir)
+	if err != nil {
+		return nil, err
+	}
+	gens := make([]memstore.Generation, 0, len(files))
+	for _, f := range files {
+		info, err := os.Stat(filepath.Join(dir, f.name))
+		if err != nil {
+			return nil, fmt.Errorf("stat snapshot %s error: %w", f.name, err)
+		}
+		gens = append(gens, memstore.Generation{ID: f.gen, CreatedAt: info.ModTime()})
+	}
+	return gens, nil
+}
+
+// LoadGeneration - load the data from the given snapshot generation, it is used to roll back
+func (m *FileDumper[T]) LoadGeneration(ctx context.Context, permanentKey string, gen uint64, data *map[memstore.UID]memstore.DataMap[T]) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snap, err := m.loadGeneration(permanentKey, gen)
+	if err != nil {
+		return err
+	}
+	for uid, v := range snap.Data {
+		(*data)[uid] = v
+	}
+	return nil
+}
+
+// LoadGenerationMeta - load the metadata of all the users from the given snapshot generation
+func (m *FileDumper[T]) LoadGenerationMeta(ctx context.Context, permanentKey string, gen uint64) (map[memstore.UID]memstore.MetaMap, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snap, err := m.loadGeneration(permanentKey, gen)
+	if err != nil {
+		return nil, err
+	}
+	return snap.Meta, nil
+}
+
+// PruneGenerations - remove the snapshot generations except the latest keep ones
+func (m *FileDumper[T]) PruneGenerations(ctx context.Context, permanentKey string, keep int) error {
+	if keep < 1 {
+		return fmt.Errorf("%w, at least 1 generation must be kept", memstore.ErrInvalidInput)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, err := m.storageDir(permanentKey)
+	if err != nil {
+		return err
+	}
+	files, err := m.listGenerations(dir)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(files)-keep; i++ {
+		if err = os.Remove(filepath.Join(dir, files[i].name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove snapshot %s error: %w", files[i].name, err)
+		}
+	}
+	return nil
+}
+
+// loadGeneration - read the snapshot of the given generation
+func (m *FileDumper[T]) loadGeneration(permanentKey string, gen uint64) (*fileSnapshot[T], error) {
+	dir, err := m.storageDir(permanentKey)
+	if err != nil {
+		return nil, err
+	}
+	files, err := m.listGenerations(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.gen == gen {
+			return m.readSnapshot(filepath.Join(dir, f.name))
+		}
+	}
+	return nil, fmt.Errorf("%w, storage: %s, generation: %d", memstore.ErrGenerationNotFound, permanentKey, gen)
+}
+
+// storageDir - the snapshot directory of a storage
+func (m *FileDumper[T]) storageDir(permanentKey string) (string, error) {
+	if permanentKey == "" || permanentKey == "." || permanentKey == ".." || strings.ContainsAny(permanentKey, `/\`) {
+		return "", fmt.Errorf("%w, invalid permanent key %q for a directory name", memstore.ErrInvalidInput, permanentKey)
+	}
+	return filepath.Join(m.Dir, permanentKey), nil
+}
+
+// generationFile is a snapshot file of a generation
+type generationFile struct {
+	gen  uint64
+	name string
+}
+
+// listGenerations - list the snapshot files in a directory, in ascending order of generation
+func (m *FileDumper[T]) listGenerations(dir string) ([]generationFile, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read snapshot directory %s error: %w", dir, err)
+	}
+	files := make([]generationFile, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() {
+			continue
+		}
+		base := strings.TrimSuffix(name, fileSnapshotGzipExt)
+		if i := strings.IndexByte(base, '.'); i >= 0 {
+			if !isCodecExt(base[i:]) {
+				continue
+			}
+			base = base[:i]
+		}
+		gen, err := strconv.ParseUint(base, 10, 64)
+		if err != nil {
+			continue
+		}
+		files = append(files, generationFile{gen: gen, name: name})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].gen < files[j].gen })
+	return files, nil
+}
+
+// loadLatest - load the latest snapshot and its generation, an empty
+// snapshot of generation 0 is returned if there is none. the snapshot is
+// cached until its file is changed, so it must not be modified
+func (m *FileDumper[T]) loadLatest(dir string) (*fileSnapshot[T], uint64, error) {
+	files, err := m.listGenerations(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(files) == 0 {
+		return &fileSnapshot[T]{
+			Data: make(map[memstore.UID]memstore.DataMap[T]),
+			Meta: make(map[memstore.UID]memstore.MetaMap),
+		}, 0, nil
+	}
+	latest := files[len(files)-1]
+	path := filepath.Join(dir, latest.name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("stat snapshot %s error: %w", path, err)
+	}
+	if c := m.latest[dir]; c != nil && c.name == latest.name && c.size == info.Size() && c.modTime.Equal(info.ModTime()) {
+		return c.snap, latest.gen, nil
+	}
+	snap, err := m.readSnapshot(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	m.remember(dir, latest.name, info, snap)
+	return snap, latest.gen, nil
+}
+
+// remember - cache the snapshot as the latest one of the directory
+func (m *FileDumper[T]) remember(dir, name string, info os.FileInfo, snap *fileSnapshot[T]) {
+	if m.latest == nil {
+		m.latest = make(map[string]*cachedSnapshot[T])
+	}
+	m.latest[dir] = &cachedSnapshot[T]{name: name, size: info.Size(), modTime: info.ModTime(), snap: snap}
+}
+
+// clone - copy the user maps of the snapshot, so that the users can be
+// replaced without modifying it
+func (snap *fileSnapshot[T]) clone() *fileSnapshot[T] {
+	ret := &fileSnapshot[T]{
+		Data:     make(map[memstore.UID]memstore.DataMap[T], len(snap.Data)),
+		Meta:     make(map[memstore.UID]memstore.MetaMap, len(snap.Meta)),
+		WriteSeq: snap.WriteSeq,
+	}
+	for uid, v := range snap.Data {
+		ret.Data[uid] = v
+	}
+	for uid, mm := range snap.Meta {
+		ret.Meta[uid] = mm
+	}
+	return ret
+}
+
+// cloneDataMap - copy the resources of a user
+func cloneDataMap[T any](v memstore.DataMap[T]) memstore.DataMap[T] {
+	ret := make(memstore.DataMap[T], len(v))
+	for k, item := range v {
+		ret[k] = item
+	}
+	return ret
+}
+
+// cloneMetaMap - copy the metadata of a user
+func cloneMetaMap(mm memstore.MetaMap) memstore.MetaMap {
+	ret := make(memstore.MetaMap, len(mm))
+	for k, meta := range mm {
+		ret[k] = meta
+	}
+	return ret
+}
+
+// readSnapshot - read a snapshot file, decompress it if it is gzipped, and
+// decode it by the codec of its tag
+func (m *FileDumper[T]) readSnapshot(path string) (*fileSnapshot[T], error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read snapshot %s error: %w", path, err)
+	}
+	if strings.HasSuffix(path, fileSnapshotGzipExt) {
+		zr, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, fmt.Errorf("decompress snapshot %s error: %w", path, err)
+		}
+		if raw, err = io.ReadAll(zr); err != nil {
+			return nil, fmt.Errorf("decompress snapshot %s error: %w", path, err)
+		}
+	}
+	snap := &fileSnapshot[T]{}
+	if err = decodePayload(m.Codec, raw, snap); err != nil {
+		return nil, fmt.Errorf("unmarshal snapshot %s error: %w", path, err)
+	}
+	if snap.Data == nil {
+		snap.Data = make(map[memstore.UID]memstore.DataMap[T])
+	}
+	if snap.Meta == nil {
+		snap.Meta = make(map[memstore.UID]memstore.MetaMap)
+	}
+	return snap, nil
+}
+
+// writeGeneration - write the snapshot as the given generation atomically,
+// then remove the generations that are no longer kept
+func (m *FileDumper[T]) writeGeneration(ctx context.Context, dir string, gen uint64, snap *fileSnapshot[T]) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	raw, err := m.marshalSnapshot(snap, m.Gzip)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("create snapshot directory %s error: %w", dir, err)
+	}
+	name := m.snapshotName(gen, m.Gzip)
+	if err = writeFileAtomic(dir, name, raw); err != nil {
+		return err
+	}
+	// the written snapshot is the latest one, it is read again if the stat fails
+	delete(m.latest, dir)
+	if info, err := os.Stat(filepath.Join(dir, name)); err == nil {
+		m.remember(dir, name, info, snap)
+	}
+	return m.prune(dir, gen, name)
+}
+
+// snapshotName - the file name of a generation written by the codec
+func (m *FileDumper[T]) snapshotName(gen uint64, gz bool) string {
+	ext := fileCodecExts[CodecTagJSON]
+	if m.Codec != nil {
+		ext = fileCodecExts[m.Codec.Tag()]
+	}
+	name := fmt.Sprintf("%020d%s", gen, ext)
+	if gz {
+		name += fileSnapshotGzipExt
+	}
+	return name
+}
+
+// isCodecExt - whether ext is the extension of a snapshot file
+func isCodecExt(ext string) bool {
+	for _, e := range fileCodecExts {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// marshalSnapshot - encode the snapshot by Codec, and compress it if gz is true
+func (m *FileDumper[T]) marshalSnapshot(snap *fileSnapshot[T], gz bool) ([]byte, error) {
+	raw, err := encodePayload(m.Codec, snap)
+	if err != nil || !gz {
+		return raw, err
+	}
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	if _, err = zw.Write(raw); err != nil {
+		return nil, err
+	}
+	if err = zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// prune - remove the generations older than the kept ones, and the other
+// file of the current generation if the compression is switched
+func (m *FileDumper[T]) prune(dir string, gen uint64, current string) error {
+	keep := uint64(m.KeepGenerations)
+	if m.KeepGenerations <= 0 {
+		keep = 1
+	}
+	files, err := m.listGenerations(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.name == current || (f.gen != gen && f.gen+keep > gen) {
+			continue
+		}
+		if err = os.Remove(filepath.Join(dir, f.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove snapshot %s error: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic - write a temp file in dir, fsync it and rename it to
+// name, so that the file is either the old one or the new one after a crash
+func writeFileAtomic(dir, name string, raw []byte) (err error) {
+	tmp, err := os.CreateTemp(dir, fileTempPattern)
+	if err != nil {
+		return fmt.Errorf("create temp file in %s error: %w", dir, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(raw); err != nil {
+		return fmt.Errorf("write temp file %s error: %w", tmp.Name(), err)
+	}
+	if err = tmp.Sync(); err != nil {
+		return fmt.Errorf("sync temp file %s error: %w", tmp.Name(), err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("close temp file %s error: %w", tmp.Name(), err)
+	}
+	if err = os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		return fmt.Errorf("rename temp file %s error: %w", tmp.Name(), err)
+	}
+	// sync the directory to persist the rename, not all platforms support it
+	if d, errOpen := os.Open(dir); errOpen == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package dumper_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/khgame/memstore"
+	"github.com/khgame/memstore/dumper"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_FileDumpAndLoad tests the Dump & Load method of FileDumper with testify
+func Test_FileDumpAndLoad(t *testing.T) {
+	for _, gz := range []bool{false, true} {
+		dp := dumper.CreateFileDumper[TestDataType](t.TempDir())
+		dp.Gzip = gz
+		ctx := context.Background()
+
+		// nothing to load before the first dump
+		data := map[memstore.UID]memstore.DataMap[TestDataType]{}
+		assert.NoError(t, dp.Load(ctx, "test_storage", &data))
+		assert.Equal(t, 0, len(data))
+
+		err := dp.Dump(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+			"uid001": {
+				"res001": {Name: "res001", Quantity: 1},
+				"res002": {Name: "res002", Quantity: 200},
+			},
+			"uid002": {"res001": {Name: "res001", Quantity: 2}},
+		})
+		assert.NoError(t, err)
+
+		// a single snapshot file without temp files
+		entries, err := os.ReadDir(filepath.Join(dp.Dir, "test_storage"))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(entries))
+		assert.Equal(t, gz, strings.HasSuffix(entries[0].Name(), ".gz"))
+
+		err = dp.Load(ctx, "test_storage", &data)
+		assert.NoError(t, err)
+		assert.Equal(t, map[memstore.UID]memstore.DataMap[TestDataType]{
+			"uid001": {
+				"res001": {Name: "res001", Quantity: 1},
+				"res002": {Name: "res002", Quantity: 200},
+			},
+			"uid002": {"res001": {Name: "res001", Quantity: 2}},
+		}, data)
+
+		v, err := dp.LoadUser(ctx, "test_storage", "uid002")
+		assert.NoError(t, err)
+		assert.Equal(t, memstore.DataMap[TestDataType]{"res001": {Name: "res001", Quantity: 2}}, v)
+		_, err = dp.LoadUser(ctx, "test_storage", "uid003")
+		assert.ErrorIs(t, err, memstore.ErrUserNotFound)
+	}
+
+	// the permanent key must be a valid directory name
+	dp := dumper.CreateFileDumper[TestDataType](t.TempDir())
+	assert.ErrorIs(t, dp.Dump(context.Background(), "../test_storage", nil), memstore.ErrInvalidInput)
+}
+
+// Test_FileDumpChanged tests the DumpChanged method of FileDumper with testify
+func Test_FileDumpChanged(t *testing.T) {
+	dp := dumper.CreateFileDumper[TestDataType](t.TempDir())
+	ctx := context.Background()
+	err := dp.Dump(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}},
+		"uid002": {"res001": {Name: "res001", Quantity: 2}},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, dp.DumpMeta(ctx, "test_storage", map[memstore.UID]memstore.MetaMap{
+		"uid002": {"res001": {ExpireAt: 200}},
+	}))
+
+	// uid001 is changed, uid002 is purged and uid003 is added
+	err = dp.DumpChanged(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 10}},
+		"uid002": nil,
+		"uid003": {"res002": {Name: "res002", Quantity: 3}},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, dp.DumpMeta(ctx, "test_storage", map[memstore.UID]memstore.MetaMap{
+		"uid003": {"res002": {ExpireAt: 300}},
+	}))
+
+	data := map[memstore.UID]memstore.DataMap[TestDataType]{}
+	assert.NoError(t, dp.Load(ctx, "test_storage", &data))
+	assert.Equal(t, map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 10}},
+		"uid003": {"res002": {Name: "res002", Quantity: 3}},
+	}, data)
+	meta, err := dp.LoadMeta(ctx, "test_storage", []memstore.UID{"uid001", "uid002", "uid003"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[memstore.UID]memstore.MetaMap{
+		"uid003": {"res002": {ExpireAt: 300}},
+	}, meta)
+
+	// the metadata does not create a new generation
+	gens, err := dp.Generations(ctx, "test_storage")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(gens))
+	assert.Equal(t, uint64(2), gens[0].ID)
+}
+
+// Test_FileDumpChangedWithMeta tests that FileDumper writes the changed users with their metadata at once
+func Test_FileDumpChangedWithMeta(t *testing.T) {
+	dir := t.TempDir()
+	dp := dumper.CreateFileDumper[TestDataType](dir)
+	dp.KeepGenerations = 3
+	ctx := context.Background()
+	assert.NoError(t, dp.DumpChangedWithMeta(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}},
+		"uid002": {"res001": {Name: "res001", Quantity: 2}},
+	}, map[memstore.UID]memstore.MetaMap{
+		"uid002": {"res001": {ExpireAt: 200}},
+	}, memstore.DumpOptions{}))
+
+	// a write-back rewrites the latest generation
+	assert.NoError(t, dp.DumpChangedWithMeta(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 10}},
+	}, map[memstore.UID]memstore.MetaMap{
+		"uid001": {"res001": {Version: 1}},
+	}, memstore.DumpOptions{WriteBack: true}))
+	gens, err := dp.Generations(ctx, "test_storage")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(gens))
+	meta, err := dp.LoadMeta(ctx, "test_storage", []memstore.UID{"uid001", "uid002"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[memstore.UID]memstore.MetaMap{
+		"uid001": {"res001": {Version: 1}},
+		"uid002": {"res001": {ExpireAt: 200}},
+	}, meta)
+
+	// the loaded users are copies of the cached snapshot
+	v, err := dp.LoadUser(ctx, "test_storage", "uid001")
+	assert.NoError(t, err)
+	v["res002"] = TestDataType{Name: "res002", Quantity: 1}
+	v, err = dp.LoadUser(ctx, "test_storage", "uid001")
+	assert.NoError(t, err)
+	assert.Equal(t, memstore.DataMap[TestDataType]{"res001": {Name: "res001", Quantity: 10}}, v)
+
+	// the snapshot written by another dumper is read again
+	other := dumper.CreateFileDumper[TestDataType](dir)
+	assert.NoError(t, other.DumpChanged(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid003": {"res001": {Name: "res001", Quantity: 3}},
+	}))
+	data := map[memstore.UID]memstore.DataMap[TestDataType]{}
+	assert.NoError(t, dp.Load(ctx, "test_storage", &data))
+	assert.Equal(t, 3, len(data))
+}
+
+// Test_FileGenerations tests that FileDumper keeps the last generations for rolling back
+func Test_FileGenerations(t *testing.T) {
+	dp := dumper.CreateFileDumper[TestDataType](t.TempDir())
+	dp.KeepGenerations = 3
+	ctx := context.Background()
+	for i := int64(1); i <= 5; i++ {
+		// switching the compression does not break the generations
+		dp.Gzip = i%2 == 0
+		err := dp.DumpChanged(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+			"uid001": {"res001": {Name: "res001", Quantity: i}},
+		})
+		assert.NoError(t, err)
+	}
+
+	gens, err := dp.Generations(ctx, "test_storage")
+	assert.NoError(t, err)
+	ids := make([]uint64, 0, len(gens))
+	for _, g := range gens {
+		ids = append(ids, g.ID)
+		assert.False(t, g.CreatedAt.IsZero())
+	}
+	assert.Equal(t, []uint64{3, 4, 5}, ids)
+
+	// roll back to a previous generation
+	data := map[memstore.UID]memstore.DataMap[TestDataType]{}
+	assert.NoError(t, dp.LoadGeneration(ctx, "test_storage", 4, &data))
+	assert.Equal(t, int64(4), data["uid001"]["res001"].Quantity)
+	assert.ErrorIs(t, dp.LoadGeneration(ctx, "test_storage", 1, &data), memstore.ErrGenerationNotFound)
+
+	data = map[memstore.UID]memstore.DataMap[TestDataType]{}
+	assert.NoError(t, dp.Load(ctx, "test_storage", &data))
+	assert.Equal(t, int64(5), data["uid001"]["res001"].Quantity)
+
+	// a purged user is erased from all the kept generations
+	assert.NoError(t, dp.DumpChanged(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": nil,
+	}))
+	for _, gen := range []uint64{4, 5, 6} {
+		data = map[memstore.UID]memstore.DataMap[TestDataType]{}
+		assert.NoError(t, dp.LoadGeneration(ctx, "test_storage", gen, &data))
+		assert.Equal(t, 0, len(data))
+	}
+}
+
+// Test_FileDumperStorage tests InMemoryStorage saving to and loading from FileDumper
+func Test_FileDumperStorage(t *testing.T) {
+	ctx := context.Background()
+	dp := dumper.CreateFileDumper[TestDataType](t.TempDir())
+	dp.Gzip = true
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = dp
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: 1}))
+	assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "res001", Quantity: 2}))
+	assert.NoError(t, storage.Save(ctx))
+	assert.NoError(t, storage.Purge("uid002"))
+	assert.NoError(t, storage.Save(ctx))
+
+	storage2 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage2.Dumper = dp
+	assert.NoError(t, storage2.Load(ctx))
+	data := TestDataType{Name: "res001"}
+	assert.NoError(t, storage2.Get("uid001", &data))
+	assert.Equal(t, int64(1), data.Quantity)
+	_, err := storage2.List("uid002")
+	assert.ErrorIs(t, err, memstore.ErrUserNotFound)
+}
@@ -0,0 +1,247 @@
+package dumper
+
+import (
+	"context"
+	"crypto/aes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/khgame/memstore"
+	"github.com/khgame/memstore/cache"
+	"github.com/khgame/memstore/cachekey"
+)
+
+const (
+	// LoadFailFast aborts Load on the first user that can not be loaded,
+	// nothing is loaded into the output then
+	LoadFailFast LoadPolicy = iota
+	// LoadSkip loads the other users, and reports the ones that can not be loaded
+	LoadSkip
+	// LoadQuarantine loads the other users, and moves the payloads that can
+	// not be decoded to SchemeMemStoreQuarantine. the reported users are
+	// removed from the index, so that the next Load does not meet them again
+	LoadQuarantine
+)
+
+const (
+	// SchemeMemStoreQuarantine is the key of a quarantined payload of a user
+	SchemeMemStoreQuarantine cachekey.KeyFormat = "store_quarantine:%s:%s"
+	// SchemeMemStoreQuarantineMeta is the key of the metadata of a quarantined user
+	SchemeMemStoreQuarantineMeta cachekey.KeyFormat = "store_quarantine_meta:%s:%s"
+)
+
+var (
+	// ErrChecksumMismatch is returned when a payload does not match its checksum
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+
+	crc32Table = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type (
+	// LoadPolicy defines what CacheDumper.Load does with the users that can not be loaded
+	LoadPolicy int
+
+	// LoadFailure is a user that can not be loaded, Err matches
+	// ErrChecksumMismatch if the payload is corrupted
+	LoadFailure = memstore.LoadFailure
+
+	// LoadReport is the result of a CacheDumper.Load
+	LoadReport struct {
+		// PersistentKey is the permanent key of the loaded storage
+		PersistentKey string
+		// Policy is the policy of the Load
+		Policy LoadPolicy
+		// Loaded is the count of the loaded users
+		Loaded int
+		// Failures are the users that can not be loaded, in the order of the index
+		Failures []LoadFailure
+	}
+)
+
+// String returns the name of the load policy
+func (p LoadPolicy) String() string {
+	switch p {
+	case LoadFailFast:
+		return "fail-fast"
+	case LoadSkip:
+		return "skip"
+	case LoadQuarantine:
+		return "quarantine"
+	default:
+		return fmt.Sprintf("LoadPolicy(%d)", int(p))
+	}
+}
+
+// appendChecksum prefixes the payload with its checksum
+func appendChecksum(payload []byte) []byte {
+	out := make([]byte, 5, 5+len(payload))
+	out[0] = TransformTagCRC32
+	binary.BigEndian.PutUint32(out[1:], crc32.Checksum(payload, crc32Table))
+	return append(out, payload...)
+}
+
+// verifyChecksum verifies the body of a payload with a checksum, and returns the rest of it
+func verifyChecksum(body []byte) ([]byte, error) {
+	if len(body) < 4 {
+		return nil, fmt.Errorf("%w, the payload is truncated", ErrChecksumMismatch)
+	}
+	expected, rest := binary.BigEndian.Uint32(body), body[4:]
+	if actual := crc32.Checksum(rest, crc32Table); actual != expected {
+		return nil, fmt.Errorf("%w, expected: %08x, actual: %08x", ErrChecksumMismatch, expected, actual)
+	}
+	return rest, nil
+}
+
+// LoadWithReport - load the data from the cache by LoadPolicy, and report the
+// users that can not be loaded. *data is only modified when the error is nil.
+// the errors of the configuration, such as an unknown key or codec, abort the
+// load whatever the policy is, since every payload would fail alike
+func (m *CacheDumper[T]) LoadWithReport(ctx context.Context, permanentKey string, data *map[memstore.UID]memstore.DataMap[T]) (*LoadReport, error) {
+	return m.loadWithReport(ctx, permanentKey, data, nil)
+}
+
+// loadWithReport is LoadWithReport, the payloads are quarantined only if the
+// lease is still held by the fence when it is set
+func (m *CacheDumper[T]) loadWithReport(ctx context.Context, permanentKey string, data *map[memstore.UID]memstore.DataMap[T], fence *memstore.Fence) (*LoadReport, error) {
+	makeKey := SchemeMemStoreSaving.Partial(permanentKey)
+	report := &LoadReport{PersistentKey: permanentKey, Policy: m.LoadPolicy}
+
+	// load index
+	keys, err := m.loadIndex(ctx, permanentKey)
+	if err != nil {
+		return report, fmt.Errorf("load index of storage %s error: %w", permanentKey, err)
+	}
+
+	// load the payloads in one round trip
+	cmds := make([]*redis.StringCmd, 0, len(keys))
+	_, err = m.Cache.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, uid := range keys {
+			cmds = append(cmds, p.Get(ctx, makeKey(uid)))
+		}
+		return nil
+	})
+	if err != nil && !cache.IsRedisNil(err) {
+		return report, fmt.Errorf("load storage %s error: %w", permanentKey, err)
+	}
+
+	// decode the payloads aside, so that nothing is loaded if it fails
+	loaded := make(map[memstore.UID]memstore.DataMap[T], len(keys))
+	quarantined := make(map[memstore.UID][]byte)
+	for i, uid := range keys {
+		// a failed read is not a corrupted user, it aborts the load whatever the policy is
+		if err = cmds[i].Err(); err != nil && !cache.IsRedisNil(err) {
+			return report, fmt.Errorf("load user %s of storage %s error: %w", uid, permanentKey, err)
+		}
+		v, raw, err := m.decodeCmd(makeKey(uid), uid, cmds[i])
+		if err == nil {
+			loaded[uid] = v
+			continue
+		}
+		report.Failures = append(report.Failures, LoadFailure{User: uid, Err: err})
+		if isConfigError(err) {
+			return report, fmt.Errorf("load user %s of storage %s error: %w", uid, permanentKey, err)
+		}
+		switch m.LoadPolicy {
+		case LoadSkip:
+		case LoadQuarantine:
+			quarantined[uid] = raw
+		default:
+			return report, fmt.Errorf("load user %s of storage %s error: %w", uid, permanentKey, err)
+		}
+	}
+
+	if len(quarantined) > 0 {
+		if err = m.quarantine(ctx, permanentKey, quarantined, fence); err != nil {
+			return report, err
+		}
+		for i := range report.Failures {
+			if raw := quarantined[report.Failures[i].User]; raw != nil {
+				report.Failures[i].QuarantineKey = SchemeMemStoreQuarantine.Make(permanentKey, report.Failures[i].User)
+			}
+		}
+	}
+	for uid, v := range loaded {
+		(*data)[uid] = v
+	}
+	report.Loaded = len(loaded)
+	return report, nil
+}
+
+// decodeCmd decodes the payload of a user read by a pipeline, the raw
+// payload is returned with the error, nil if it is missing. the read must
+// have succeeded or found nothing
+func (m *CacheDumper[T]) decodeCmd(key string, uid memstore.UID, cmd *redis.StringCmd) (memstore.DataMap[T], []byte, error) {
+	str, err := cmd.Result()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w, user: %s", memstore.ErrUserNotFound, uid)
+	}
+	v, err := m.decodeUser(key, []byte(str))
+	if err != nil {
+		return nil, []byte(str), fmt.Errorf("decode user %s error: %w", uid, err)
+	}
+	return v, nil, nil
+}
+
+// isConfigError returns true if the payload can not be decoded because of the
+// configuration of the dumper rather than the payload itself
+func isConfigError(err error) bool {
+	var ke aes.KeySizeError
+	return errors.Is(err, ErrUnknownKey) || errors.Is(err, ErrUnknownCodec) ||
+		errors.Is(err, ErrUnsupportedType) || errors.As(err, &ke)
+}
+
+// quarantine moves the payloads and the metadata aside, and removes the
+// quarantined and the missing users from the index, the metadata of the
+// missing users is deleted
+func (m *CacheDumper[T]) quarantine(ctx context.Context, permanentKey string, payloads map[memstore.UID][]byte, fence *memstore.Fence) error {
+	if err := m.migrateIndex(ctx, permanentKey); err != nil {
+		return err
+	}
+	makeKey := SchemeMemStoreSaving.Partial(permanentKey)
+	makeMetaKey := SchemeMemStoreMeta.Partial(permanentKey)
+
+	// read the metadata to be moved
+	users := make([]memstore.UID, 0, len(payloads))
+	metas := make([]*redis.StringCmd, 0, len(payloads))
+	_, err := m.Cache.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for uid := range payloads {
+			users = append(users, uid)
+			metas = append(metas, p.Get(ctx, makeMetaKey(uid)))
+		}
+		return nil
+	})
+	if err != nil && !cache.IsRedisNil(err) {
+		return fmt.Errorf("quarantine users of storage %s error: %w", permanentKey, err)
+	}
+
+	err = m.writeFenced(ctx, fence, func(p redis.Pipeliner) error {
+		for i, uid := range users {
+			if raw := payloads[uid]; raw != nil {
+				p.Set(ctx, SchemeMemStoreQuarantine.Make(permanentKey, uid), raw, 0)
+				p.Del(ctx, makeKey(uid))
+				if metas[i].Err() == nil {
+					p.Set(ctx, SchemeMemStoreQuarantineMeta.Make(permanentKey, uid), metas[i].Val(), 0)
+				}
+			}
+			p.Del(ctx, makeMetaKey(uid))
+		}
+		p.SRem(ctx, SchemeMemStoreIndex.Make(permanentKey), uidsToAny(users)...)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("quarantine users of storage %s error: %w", permanentKey, err)
+	}
+	return nil
+}
+
+// LastLoadReport - the report of the last Load, nil if it has not been called
+func (m *CacheDumper[T]) LastLoadReport() *LoadReport {
+	m.reportMu.Lock()
+	defer m.reportMu.Unlock()
+
+	return m.lastReport
+}
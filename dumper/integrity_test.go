@@ -0,0 +1,130 @@
+package dumper_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/khgame/memstore"
+	"github.com/khgame/memstore/dumper"
+	"github.com/stretchr/testify/assert"
+)
+
+// createCorruptedDumper returns a CacheDumper with a valid user uid001, a
+// corrupted uid002, a malformed uid003 and a missing uid004
+func createCorruptedDumper(t *testing.T) *dumper.CacheDumper[TestDataType] {
+	ctx := context.Background()
+	dp := createCacheDumper().(*dumper.CacheDumper[TestDataType])
+	dp.Checksum = true
+	key := func(uid string) string { return dumper.SchemeMemStoreSaving.Make("test_storage", uid) }
+	assert.NoError(t, dp.Dump(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}},
+		"uid002": {"res001": {Name: "res001", Quantity: 2}},
+		"uid003": {"res001": {Name: "res001", Quantity: 3}},
+		"uid004": {"res001": {Name: "res001", Quantity: 4}},
+	}))
+	raw := []byte(dp.Cache.Get(ctx, key("uid002")).Val())
+	assert.Equal(t, dumper.TransformTagCRC32, raw[0])
+	raw[len(raw)-2] ^= 0xff
+	assert.NoError(t, dp.Cache.Set(ctx, key("uid002"), raw, 0).Err())
+	assert.NoError(t, dp.Cache.Set(ctx, key("uid003"), `{"res001":`, 0).Err())
+	assert.NoError(t, dp.Cache.Del(ctx, key("uid004")).Err())
+	return dp
+}
+
+// Test_CacheDumperLoadPolicy tests the checksums and the load policies of CacheDumper with testify
+func Test_CacheDumperLoadPolicy(t *testing.T) {
+	ctx := context.Background()
+	valid := map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}},
+	}
+
+	// fail-fast loads nothing
+	dp := createCorruptedDumper(t)
+	data := map[memstore.UID]memstore.DataMap[TestDataType]{}
+	err := dp.Load(ctx, "test_storage", &data)
+	assert.Error(t, err)
+	assert.Empty(t, data)
+	report := dp.LastLoadReport()
+	assert.Equal(t, dumper.LoadFailFast, report.Policy)
+	assert.Equal(t, 1, len(report.Failures))
+	assert.ErrorIs(t, err, report.Failures[0].Err)
+	assert.Contains(t, []memstore.UID{"uid002", "uid003", "uid004"}, report.Failures[0].User)
+
+	// skip loads the others, and reports every failure
+	dp.LoadPolicy = dumper.LoadSkip
+	assert.NoError(t, dp.Load(ctx, "test_storage", &data))
+	assert.Equal(t, valid, data)
+	report = dp.LastLoadReport()
+	assert.Equal(t, dumper.LoadSkip, report.Policy)
+	assert.Equal(t, 1, report.Loaded)
+	failures := failuresByUser(report)
+	assert.Equal(t, 3, len(failures))
+	assert.ErrorIs(t, failures["uid002"].Err, dumper.ErrChecksumMismatch)
+	assert.Error(t, failures["uid003"].Err)
+	assert.ErrorIs(t, failures["uid004"].Err, memstore.ErrUserNotFound)
+
+	// quarantine moves the corrupted payloads aside with their metadata, and drops them from the index
+	dp.LoadPolicy = dumper.LoadQuarantine
+	corrupted := dp.Cache.Get(ctx, dumper.SchemeMemStoreSaving.Make("test_storage", "uid002")).Val()
+	assert.NoError(t, dp.DumpMeta(ctx, "test_storage", map[memstore.UID]memstore.MetaMap{
+		"uid002": {"res001": {Version: 2}},
+		"uid004": {"res001": {Version: 4}},
+	}))
+	meta := dp.Cache.Get(ctx, dumper.SchemeMemStoreMeta.Make("test_storage", "uid002")).Val()
+	data = map[memstore.UID]memstore.DataMap[TestDataType]{}
+	assert.NoError(t, dp.Load(ctx, "test_storage", &data))
+	assert.Equal(t, valid, data)
+	failures = failuresByUser(dp.LastLoadReport())
+	assert.Equal(t, 3, len(failures))
+	assert.Equal(t, dumper.SchemeMemStoreQuarantine.Make("test_storage", "uid002"), failures["uid002"].QuarantineKey)
+	assert.Equal(t, dumper.SchemeMemStoreQuarantine.Make("test_storage", "uid003"), failures["uid003"].QuarantineKey)
+	assert.Equal(t, "", failures["uid004"].QuarantineKey)
+	assert.Equal(t, corrupted, dp.Cache.Get(ctx, failures["uid002"].QuarantineKey).Val())
+	assert.Equal(t, int64(0), dp.Cache.Exists(ctx, dumper.SchemeMemStoreSaving.Make("test_storage", "uid002")).Val())
+	assert.Equal(t, meta, dp.Cache.Get(ctx, dumper.SchemeMemStoreQuarantineMeta.Make("test_storage", "uid002")).Val())
+	assert.Equal(t, int64(0), dp.Cache.Exists(ctx,
+		dumper.SchemeMemStoreMeta.Make("test_storage", "uid002"), dumper.SchemeMemStoreMeta.Make("test_storage", "uid004")).Val())
+
+	// the next load meets no failures even if it fails fast
+	dp.LoadPolicy = dumper.LoadFailFast
+	data = map[memstore.UID]memstore.DataMap[TestDataType]{}
+	assert.NoError(t, dp.Load(ctx, "test_storage", &data))
+	assert.Equal(t, valid, data)
+	assert.Empty(t, dp.LastLoadReport().Failures)
+}
+
+// Test_CacheDumperLoadPolicyConfigError tests that the errors of the configuration abort the load whatever the policy is
+func Test_CacheDumperLoadPolicyConfigError(t *testing.T) {
+	ctx := context.Background()
+	dp := createCacheDumper().(*dumper.CacheDumper[TestDataType])
+	dp.Encryption = &dumper.Encryption{KeyID: "k1", Keys: map[string][]byte{"k1": make([]byte, 16)}}
+	assert.NoError(t, dp.Dump(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}},
+		"uid002": {"res001": {Name: "res001", Quantity: 2}},
+	}))
+
+	for _, policy := range []dumper.LoadPolicy{dumper.LoadSkip, dumper.LoadQuarantine} {
+		for _, enc := range []*dumper.Encryption{nil, {KeyID: "k2", Keys: map[string][]byte{"k2": make([]byte, 16)}}} {
+			dp.LoadPolicy, dp.Encryption = policy, enc
+			data := map[memstore.UID]memstore.DataMap[TestDataType]{}
+			assert.ErrorIs(t, dp.Load(ctx, "test_storage", &data), dumper.ErrUnknownKey)
+			assert.Empty(t, data)
+		}
+	}
+
+	// nothing is quarantined
+	keys, err := dp.Cache.Keys(ctx, "store_quarantine*").Result()
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+	assert.Equal(t, int64(2), dp.Cache.Exists(ctx,
+		dumper.SchemeMemStoreSaving.Make("test_storage", "uid001"), dumper.SchemeMemStoreSaving.Make("test_storage", "uid002")).Val())
+}
+
+// failuresByUser maps the failures of a report by their users
+func failuresByUser(report *dumper.LoadReport) map[memstore.UID]dumper.LoadFailure {
+	ret := make(map[memstore.UID]dumper.LoadFailure, len(report.Failures))
+	for _, f := range report.Failures {
+		ret[f.User] = f
+	}
+	return ret
+}
@@ -0,0 +1,542 @@
+package dumper
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/khgame/memstore"
+)
+
+const (
+	// SQLDialectSQLite builds the statements for SQLite, it is the default dialect
+	SQLDialectSQLite SQLDialect = iota
+	// SQLDialectPostgres builds the statements for PostgreSQL
+	SQLDialectPostgres
+	// SQLDialectMySQL builds the statements for MySQL
+	SQLDialectMySQL
+)
+
+// DefaultSQLTable is the table name of a SQLDumper if it is not specified
+const DefaultSQLTable = "memstore_resources"
+
+// sqlMetaBatch is the max count of the users queried by a statement of
+// LoadMeta, it keeps the statement under the limit of the bound arguments
+const sqlMetaBatch = 500
+
+// sqlPayloadPrefix prefixes the base64 of a payload tagged by a codec in the
+// value column, it never starts a JSON value
+const sqlPayloadPrefix = "b64:"
+
+type (
+	// SQLDialect is the SQL dialect of the database
+	SQLDialect int
+
+	// SQLDumper - a memory store saving algorithm on a database/sql database,
+	// each resource is a row keyed by (persistent_key, uid, store_name),
+	// holding the encoded value and the expiry time of the resource. the
+	// write sequence of each storage is kept in the table {table}_seq
+	// should implement the memstore.Dumper[T any] interface
+	SQLDumper[T any] struct {
+		DB *sql.DB
+		// Table is the table name, DefaultSQLTable is used when it is empty
+		Table string
+		// Dialect is the SQL dialect of DB
+		Dialect SQLDialect
+		// Codec encodes the value of each resource, the untagged JSON is
+		// written when it is nil. the tagged payloads are stored in base64
+		// with sqlPayloadPrefix, the untagged JSON values are always loaded
+		Codec Codec
+	}
+
+	// sqlRow is a stored resource
+	sqlRow struct {
+		uid       memstore.UID
+		storeName string
+		value     string
+		meta      memstore.ResourceMeta
+	}
+)
+
+var (
+	_ memstore.Dumper[any]       = (*SQLDumper[any])(nil)
+	_ memstore.MetaDumper        = (*SQLDumper[any])(nil)
+	_ memstore.ChangeDumper[any] = (*SQLDumper[any])(nil)
+	_ memstore.WriteSeqDumper    = (*SQLDumper[any])(nil)
+
+	sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// CreateSQLDumper - create a SQLDumper algorithm instance of given type T
+func CreateSQLDumper[T any](db *sql.DB, dialect SQLDialect) *SQLDumper[T] {
+	return &SQLDumper[T]{
+		DB:      db,
+		Dialect: dialect,
+	}
+}
+
+// placeholder - the placeholder of the n-th (1-based) argument
+func (d SQLDialect) placeholder(n int) string {
+	if d == SQLDialectPostgres {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+// upsert - the clause that replaces the value and the metadata of an existing row
+func (d SQLDialect) upsert() string {
+	if d == SQLDialectMySQL {
+		return "ON DUPLICATE KEY UPDATE value = VALUES(value), expire_at = VALUES(expire_at), version = VALUES(version)"
+	}
+	return "ON CONFLICT (persistent_key, uid, store_name) DO UPDATE SET value = excluded.value, expire_at = excluded.expire_at, version = excluded.version"
+}
+
+// upsertSeq - the clause that keeps the larger write sequence of an existing row
+func (d SQLDialect) upsertSeq() string {
+	switch d {
+	case SQLDialectMySQL:
+		return "ON DUPLICATE KEY UPDATE write_seq = GREATEST(write_seq, VALUES(write_seq))"
+	case SQLDialectPostgres:
+		return "ON CONFLICT (persistent_key) DO UPDATE SET write_seq = GREATEST({table}_seq.write_seq, excluded.write_seq)"
+	}
+	return "ON CONFLICT (persistent_key) DO UPDATE SET write_seq = MAX(write_seq, excluded.write_seq)"
+}
+
+// table - the validated table name
+func (m *SQLDumper[T]) table() (string, error) {
+	if m.Table == "" {
+		return DefaultSQLTable, nil
+	}
+	if !sqlIdentifier.MatchString(m.Table) {
+		return "", fmt.Errorf("%w, invalid table name %q", memstore.ErrInvalidInput, m.Table)
+	}
+	return m.Table, nil
+}
+
+// query - replace the ? placeholders of the statement by the ones of the dialect
+func (m *SQLDumper[T]) query(format string) (string, error) {
+	table, err := m.table()
+	if err != nil {
+		return "", err
+	}
+	q := strings.ReplaceAll(format, "{table}", table)
+	if m.Dialect != SQLDialectPostgres {
+		return q, nil
+	}
+	b, n := strings.Builder{}, 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			b.WriteString(m.Dialect.placeholder(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String(), nil
+}
+
+// CreateTable - create the tables if they do not exist
+func (m *SQLDumper[T]) CreateTable(ctx context.Context) error {
+	for _, format := range []string{`CREATE TABLE IF NOT EXISTS {table} (
+	persistent_key VARCHAR(255) NOT NULL,
+	uid VARCHAR(255) NOT NULL,
+	store_name VARCHAR(255) NOT NULL,
+	value TEXT NOT NULL,
+	expire_at BIGINT NOT NULL DEFAULT 0,
+	version BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (persistent_key, uid, store_name)
+)`, `CREATE TABLE IF NOT EXISTS {table}_seq (
+	persistent_key VARCHAR(255) NOT NULL,
+	write_seq BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (persistent_key)
+)`} {
+		q, err := m.query(format)
+		if err != nil {
+			return err
+		}
+		if _, err = m.DB.ExecContext(ctx, q); err != nil {
+			return fmt.Errorf("create table error: %w", err)
+		}
+	}
+	return nil
+}
+
+// Dump - dump the data to the table, and delete the rows that are no longer in data
+func (m *SQLDumper[T]) Dump(ctx context.Context, permanentKey string, data map[memstore.UID]memstore.DataMap[T]) error {
+	return m.inTx(ctx, func(tx *sql.Tx) error {
+		rows, err := m.selectRows(ctx, tx, `SELECT uid, store_name, value, expire_at, version FROM {table} WHERE persistent_key = ?`, permanentKey)
+		if err != nil {
+			return err
+		}
+		// the users that are no longer in data are dropped
+		stale := make(map[memstore.UID][]sqlRow)
+		for uid, r := range rows {
+			if _, ok := data[uid]; !ok {
+				stale[uid] = r
+			}
+		}
+		for uid, r := range stale {
+			if err = m.deleteRows(ctx, tx, permanentKey, uid, r); err != nil {
+				return err
+			}
+		}
+		for uid, v := range data {
+			if err = m.saveUser(ctx, tx, permanentKey, uid, v, rows[uid], prevMeta(rows[uid])); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DumpChanged - dump the changed users to the table, the rows of the users
+// with nil data are deleted
+func (m *SQLDumper[T]) DumpChanged(ctx context.Context, permanentKey string, changed map[memstore.UID]memstore.DataMap[T]) error {
+	return m.dumpChanged(ctx, permanentKey, changed, nil, 0)
+}
+
+// DumpChangedWithMeta - dump the changed users with the metadata of their
+// resources in one transaction. the lease is not fenced, it relies on the
+// verification of the lease before the write
+func (m *SQLDumper[T]) DumpChangedWithMeta(ctx context.Context, permanentKey string, changed map[memstore.UID]memstore.DataMap[T], meta map[memstore.UID]memstore.MetaMap, opt memstore.DumpOptions) error {
+	if meta == nil {
+		meta = make(map[memstore.UID]memstore.MetaMap)
+	}
+	return m.dumpChanged(ctx, permanentKey, changed, meta, opt.WriteSeq)
+}
+
+// dumpChanged - dump the changed users, and replace their metadata if meta
+// is not nil, the metadata of the stored rows is kept otherwise. the write
+// sequence is raised to seq if it is positive
+func (m *SQLDumper[T]) dumpChanged(ctx context.Context, permanentKey string, changed map[memstore.UID]memstore.DataMap[T], meta map[memstore.UID]memstore.MetaMap, seq uint64) error {
+	return m.inTx(ctx, func(tx *sql.Tx) error {
+		if err := m.raiseWriteSeq(ctx, tx, permanentKey, seq); err != nil {
+			return err
+		}
+		for uid, v := range changed {
+			rows, err := m.selectRows(ctx, tx, `SELECT uid, store_name, value, expire_at, version FROM {table} WHERE persistent_key = ? AND uid = ?`, permanentKey, uid)
+			if err != nil {
+				return err
+			}
+			mm := prevMeta(rows[uid])
+			if meta != nil {
+				mm = meta[uid]
+			}
+			if err = m.saveUser(ctx, tx, permanentKey, uid, v, rows[uid], mm); err != nil {
+				return err
+			}
+		}
+		// the metadata of the users not changed
+		rest := make(map[memstore.UID]memstore.MetaMap)
+		for uid, mm := range meta {
+			if _, ok := changed[uid]; !ok {
+				rest[uid] = mm
+			}
+		}
+		return m.dumpMeta(ctx, tx, permanentKey, rest)
+	})
+}
+
+// raiseWriteSeq - raise the write sequence of the storage to seq in the transaction
+func (m *SQLDumper[T]) raiseWriteSeq(ctx context.Context, tx *sql.Tx, permanentKey string, seq uint64) error {
+	if seq == 0 {
+		return nil
+	}
+	q, err := m.query(`INSERT INTO {table}_seq (persistent_key, write_seq) VALUES (?, ?) ` + m.Dialect.upsertSeq())
+	if err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, q, permanentKey, int64(seq)); err != nil {
+		return fmt.Errorf("upsert write sequence error: %w", err)
+	}
+	return nil
+}
+
+// LoadWriteSeq - load the largest write sequence dumped, zero if there is none
+func (m *SQLDumper[T]) LoadWriteSeq(ctx context.Context, permanentKey string) (uint64, error) {
+	q, err := m.query(`SELECT write_seq FROM {table}_seq WHERE persistent_key = ?`)
+	if err != nil {
+		return 0, err
+	}
+	var seq int64
+	if err = m.DB.QueryRowContext(ctx, q, permanentKey).Scan(&seq); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("query write sequence error: %w", err)
+	}
+	return uint64(seq), nil
+}
+
+// prevMeta - the metadata of the stored rows of a user
+func prevMeta(rows []sqlRow) memstore.MetaMap {
+	mm := make(memstore.MetaMap, len(rows))
+	for _, row := range rows {
+		mm[row.storeName] = row.meta
+	}
+	return mm
+}
+
+// saveUser - upsert the changed resources of a user with their metadata in
+// mm, and delete the removed ones
+func (m *SQLDumper[T]) saveUser(ctx context.Context, tx *sql.Tx, permanentKey string, uid memstore.UID, v memstore.DataMap[T], prev []sqlRow, mm memstore.MetaMap) error {
+	prevRows := make(map[string]sqlRow, len(prev))
+	removed := make([]sqlRow, 0)
+	for _, row := range prev {
+		prevRows[row.storeName] = row
+		if _, ok := v[row.storeName]; !ok {
+			removed = append(removed, row)
+		}
+	}
+	if err := m.deleteRows(ctx, tx, permanentKey, uid, removed); err != nil {
+		return err
+	}
+
+	q, err := m.query(`INSERT INTO {table} (persistent_key, uid, store_name, value, expire_at, version) VALUES (?, ?, ?, ?, ?, ?) ` + m.Dialect.upsert())
+	if err != nil {
+		return err
+	}
+	for storeName, item := range v {
+		str, err := m.encodeValue(item)
+		if err != nil {
+			return err
+		}
+		// the unchanged rows are skipped
+		meta := mm[storeName]
+		if p, ok := prevRows[storeName]; ok && p.value == str && p.meta == meta {
+			continue
+		}
+		if _, err = tx.ExecContext(ctx, q, permanentKey, uid, storeName, str, meta.ExpireAt, int64(meta.Version)); err != nil {
+			return fmt.Errorf("upsert resource %s of user %s error: %w", storeName, uid, err)
+		}
+	}
+	return nil
+}
+
+// deleteRows - delete the given rows of a user
+func (m *SQLDumper[T]) deleteRows(ctx context.Context, tx *sql.Tx, permanentKey string, uid memstore.UID, rows []sqlRow) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	q, err := m.query(`DELETE FROM {table} WHERE persistent_key = ? AND uid = ? AND store_name = ?`)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if _, err = tx.ExecContext(ctx, q, permanentKey, uid, row.storeName); err != nil {
+			return fmt.Errorf("delete resource %s of user %s error: %w", row.storeName, uid, err)
+		}
+	}
+	return nil
+}
+
+// selectRows - query the rows of (uid, store_name, value, expire_at, version), grouped by uid
+func (m *SQLDumper[T]) selectRows(ctx context.Context, tx *sql.Tx, format string, args ...any) (map[memstore.UID][]sqlRow, error) {
+	q, err := m.query(format)
+	if err != nil {
+		return nil, err
+	}
+	var rows *sql.Rows
+	if tx != nil {
+		rows, err = tx.QueryContext(ctx, q, args...)
+	} else {
+		rows, err = m.DB.QueryContext(ctx, q, args...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query resources error: %w", err)
+	}
+	defer rows.Close()
+
+	ret := make(map[memstore.UID][]sqlRow)
+	for rows.Next() {
+		var (
+			row     sqlRow
+			version int64
+		)
+		if err = rows.Scan(&row.uid, &row.storeName, &row.value, &row.meta.ExpireAt, &version); err != nil {
+			return nil, fmt.Errorf("scan resource error: %w", err)
+		}
+		row.meta.Version = uint64(version)
+		ret[row.uid] = append(ret[row.uid], row)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("query resources error: %w", err)
+	}
+	return ret, nil
+}
+
+// encodeValue - encode the value of a resource for the value column
+func (m *SQLDumper[T]) encodeValue(item T) (string, error) {
+	payload, err := encodePayload(m.Codec, item)
+	if err != nil || m.Codec == nil {
+		return string(payload), err
+	}
+	return sqlPayloadPrefix + base64.StdEncoding.EncodeToString(payload), nil
+}
+
+// decodeValue - decode the value column of a resource, which is either the
+// base64 of a tagged payload or the untagged JSON
+func (m *SQLDumper[T]) decodeValue(value string, item *T) error {
+	payload := []byte(value)
+	if strings.HasPrefix(value, sqlPayloadPrefix) {
+		raw, err := base64.StdEncoding.DecodeString(value[len(sqlPayloadPrefix):])
+		if err != nil {
+			return err
+		}
+		payload = raw
+	}
+	return decodePayload(m.Codec, payload, item)
+}
+
+// decodeUser - decode the rows of a user
+func (m *SQLDumper[T]) decodeUser(uid memstore.UID, rows []sqlRow) (memstore.DataMap[T], error) {
+	v := make(memstore.DataMap[T], len(rows))
+	for _, row := range rows {
+		var item T
+		if err := m.decodeValue(row.value, &item); err != nil {
+			return nil, fmt.Errorf("unmarshal resource %s of user %s error: %w", row.storeName, uid, err)
+		}
+		v[row.storeName] = item
+	}
+	return v, nil
+}
+
+// inTx - run fn in a transaction, it is committed if fn succeeds
+func (m *SQLDumper[T]) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction error: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err = fn(tx); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction error: %w", err)
+	}
+	return nil
+}
+
+// Load - load the data from the table
+func (m *SQLDumper[T]) Load(ctx context.Context, permanentKey string, data *map[memstore.UID]memstore.DataMap[T]) error {
+	rows, err := m.selectRows(ctx, nil, `SELECT uid, store_name, value, expire_at, version FROM {table} WHERE persistent_key = ?`, permanentKey)
+	if err != nil {
+		return err
+	}
+	for uid, r := range rows {
+		v, err := m.decodeUser(uid, r)
+		if err != nil {
+			return err
+		}
+		(*data)[uid] = v
+	}
+	return nil
+}
+
+// LoadUser - load the data of a single user from the table, a user without
+// any resource is not stored, so memstore.ErrUserNotFound is returned for it
+func (m *SQLDumper[T]) LoadUser(ctx context.Context, permanentKey string, uid memstore.UID) (memstore.DataMap[T], error) {
+	rows, err := m.selectRows(ctx, nil, `SELECT uid, store_name, value, expire_at, version FROM {table} WHERE persistent_key = ? AND uid = ?`, permanentKey, uid)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows[uid]) == 0 {
+		return nil, fmt.Errorf("%w, user: %s", memstore.ErrUserNotFound, uid)
+	}
+	return m.decodeUser(uid, rows[uid])
+}
+
+// DumpMeta - dump the metadata of the given users to the rows of their
+// resources, the metadata of the resources not in the table is dropped
+func (m *SQLDumper[T]) DumpMeta(ctx context.Context, permanentKey string, changed map[memstore.UID]memstore.MetaMap) error {
+	return m.inTx(ctx, func(tx *sql.Tx) error {
+		return m.dumpMeta(ctx, tx, permanentKey, changed)
+	})
+}
+
+// dumpMeta - replace the metadata of the given users in the transaction
+func (m *SQLDumper[T]) dumpMeta(ctx context.Context, tx *sql.Tx, permanentKey string, changed map[memstore.UID]memstore.MetaMap) error {
+	if len(changed) == 0 {
+		return nil
+	}
+	reset, err := m.query(`UPDATE {table} SET expire_at = 0, version = 0 WHERE persistent_key = ? AND uid = ? AND (expire_at <> 0 OR version <> 0)`)
+	if err != nil {
+		return err
+	}
+	update, err := m.query(`UPDATE {table} SET expire_at = ?, version = ? WHERE persistent_key = ? AND uid = ? AND store_name = ?`)
+	if err != nil {
+		return err
+	}
+	for uid, mm := range changed {
+		if _, err := tx.ExecContext(ctx, reset, permanentKey, uid); err != nil {
+			return fmt.Errorf("reset metadata of user %s error: %w", uid, err)
+		}
+		for storeName, meta := range mm {
+			if _, err := tx.ExecContext(ctx, update, meta.ExpireAt, int64(meta.Version), permanentKey, uid, storeName); err != nil {
+				return fmt.Errorf("update metadata of resource %s of user %s error: %w", storeName, uid, err)
+			}
+		}
+	}
+	return nil
+}
+
+// LoadMeta - load the metadata of the given users from the table, the users
+// are queried in batches of sqlMetaBatch
+func (m *SQLDumper[T]) LoadMeta(ctx context.Context, permanentKey string, users []memstore.UID) (map[memstore.UID]memstore.MetaMap, error) {
+	ret := make(map[memstore.UID]memstore.MetaMap)
+	for start := 0; start < len(users); start += sqlMetaBatch {
+		end := start + sqlMetaBatch
+		if end > len(users) {
+			end = len(users)
+		}
+		if err := m.loadMetaBatch(ctx, permanentKey, users[start:end], ret); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// loadMetaBatch - load the metadata of a batch of users into ret
+func (m *SQLDumper[T]) loadMetaBatch(ctx context.Context, permanentKey string, users []memstore.UID, ret map[memstore.UID]memstore.MetaMap) error {
+	q, err := m.query(`SELECT uid, store_name, expire_at, version FROM {table} WHERE persistent_key = ? AND uid IN (?` +
+		strings.Repeat(", ?", len(users)-1) + `) AND (expire_at <> 0 OR version <> 0)`)
+	if err != nil {
+		return err
+	}
+	args := make([]any, 0, len(users)+1)
+	args = append(args, permanentKey)
+	for _, uid := range users {
+		args = append(args, uid)
+	}
+
+	rows, err := m.DB.QueryContext(ctx, q, args...)
+	if err != nil {
+		return fmt.Errorf("query metadata error: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			uid, storeName string
+			meta           memstore.ResourceMeta
+			version        int64
+		)
+		if err = rows.Scan(&uid, &storeName, &meta.ExpireAt, &version); err != nil {
+			return fmt.Errorf("scan metadata error: %w", err)
+		}
+		if ret[uid] == nil {
+			ret[uid] = make(memstore.MetaMap)
+		}
+		meta.Version = uint64(version)
+		ret[uid][storeName] = meta
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("query metadata error: %w", err)
+	}
+	return nil
+}
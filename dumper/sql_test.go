@@ -0,0 +1,255 @@
+package dumper_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/khgame/memstore"
+	"github.com/khgame/memstore/dumper"
+	"github.com/stretchr/testify/assert"
+	_ "modernc.org/sqlite"
+)
+
+func createSQLDumper(t *testing.T) *dumper.SQLDumper[TestDataType] {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "memstore.db"))
+	if err != nil {
+		panic(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	dp := dumper.CreateSQLDumper[TestDataType](db, dumper.SQLDialectSQLite)
+	if err = dp.CreateTable(context.Background()); err != nil {
+		panic(err)
+	}
+	return dp
+}
+
+// countRows returns the row count of a storage in the table
+func countRows(t *testing.T, dp *dumper.SQLDumper[TestDataType], permanentKey string) int {
+	var n int
+	err := dp.DB.QueryRow(`SELECT COUNT(*) FROM `+dumper.DefaultSQLTable+` WHERE persistent_key = ?`, permanentKey).Scan(&n)
+	assert.NoError(t, err)
+	return n
+}
+
+// Test_SQLDumpAndLoad tests the Dump & Load method of SQLDumper with testify
+func Test_SQLDumpAndLoad(t *testing.T) {
+	dp := createSQLDumper(t)
+	ctx := context.Background()
+	err := dp.Dump(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {
+			"res001": {Name: "res001", Quantity: 1},
+			"res002": {Name: "res002", Quantity: 200},
+		},
+		"uid002": {"res001": {Name: "res001", Quantity: 2}},
+		"uid003": {"res001": {Name: "res001", Quantity: 3}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, countRows(t, dp, "test_storage"))
+
+	var value string
+	err = dp.DB.QueryRow(`SELECT value FROM `+dumper.DefaultSQLTable+` WHERE persistent_key = ? AND uid = ? AND store_name = ?`,
+		"test_storage", "uid001", "res002").Scan(&value)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"Name":"res002","Quantity":200}`, value)
+
+	// res002 of uid001 and uid003 are removed
+	err = dp.Dump(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 10}},
+		"uid002": {"res001": {Name: "res001", Quantity: 2}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, countRows(t, dp, "test_storage"))
+
+	data := map[memstore.UID]memstore.DataMap[TestDataType]{}
+	assert.NoError(t, dp.Load(ctx, "test_storage", &data))
+	assert.Equal(t, map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 10}},
+		"uid002": {"res001": {Name: "res001", Quantity: 2}},
+	}, data)
+
+	// the other storages are not affected
+	data = map[memstore.UID]memstore.DataMap[TestDataType]{}
+	assert.NoError(t, dp.Load(ctx, "test_storage_other", &data))
+	assert.Equal(t, 0, len(data))
+
+	v, err := dp.LoadUser(ctx, "test_storage", "uid002")
+	assert.NoError(t, err)
+	assert.Equal(t, memstore.DataMap[TestDataType]{"res001": {Name: "res001", Quantity: 2}}, v)
+	_, err = dp.LoadUser(ctx, "test_storage", "uid003")
+	assert.ErrorIs(t, err, memstore.ErrUserNotFound)
+}
+
+// Test_SQLDumpChanged tests the DumpChanged, DumpMeta & LoadMeta method of SQLDumper with testify
+func Test_SQLDumpChanged(t *testing.T) {
+	dp := createSQLDumper(t)
+	ctx := context.Background()
+	err := dp.Dump(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}},
+		"uid002": {"res001": {Name: "res001", Quantity: 2}},
+	})
+	assert.NoError(t, err)
+
+	// uid001 is changed, uid002 is purged and uid003 is added
+	err = dp.DumpChanged(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}, "res002": {Name: "res002", Quantity: 10}},
+		"uid002": nil,
+		"uid003": {"res001": {Name: "res001", Quantity: 3}},
+	})
+	assert.NoError(t, err)
+	data := map[memstore.UID]memstore.DataMap[TestDataType]{}
+	assert.NoError(t, dp.Load(ctx, "test_storage", &data))
+	assert.Equal(t, map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}, "res002": {Name: "res002", Quantity: 10}},
+		"uid003": {"res001": {Name: "res001", Quantity: 3}},
+	}, data)
+
+	err = dp.DumpMeta(ctx, "test_storage", map[memstore.UID]memstore.MetaMap{
+		"uid001": {"res001": {Version: 7}, "res002": {ExpireAt: 100, Version: 8}},
+		"uid003": {"res001": {ExpireAt: 300}},
+	})
+	assert.NoError(t, err)
+	meta, err := dp.LoadMeta(ctx, "test_storage", []memstore.UID{"uid001", "uid002"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[memstore.UID]memstore.MetaMap{
+		"uid001": {"res001": {Version: 7}, "res002": {ExpireAt: 100, Version: 8}},
+	}, meta)
+
+	// the metadata of a user is replaced
+	assert.NoError(t, dp.DumpMeta(ctx, "test_storage", map[memstore.UID]memstore.MetaMap{"uid001": nil}))
+	meta, err = dp.LoadMeta(ctx, "test_storage", []memstore.UID{"uid001", "uid003"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[memstore.UID]memstore.MetaMap{
+		"uid003": {"res001": {ExpireAt: 300}},
+	}, meta)
+	meta, err = dp.LoadMeta(ctx, "test_storage", nil)
+	assert.NoError(t, err)
+	assert.Empty(t, meta)
+}
+
+// Test_SQLDumpChangedWithMeta tests that SQLDumper writes the changed users with their metadata at once with testify
+func Test_SQLDumpChangedWithMeta(t *testing.T) {
+	dp := createSQLDumper(t)
+	ctx := context.Background()
+	assert.NoError(t, dp.DumpChangedWithMeta(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}, "res002": {Name: "res002", Quantity: 2}},
+		"uid002": {"res001": {Name: "res001", Quantity: 2}},
+	}, map[memstore.UID]memstore.MetaMap{
+		"uid001": {"res001": {Version: 1}, "res002": {ExpireAt: 100, Version: 2}},
+	}, memstore.DumpOptions{}))
+	meta, err := dp.LoadMeta(ctx, "test_storage", []memstore.UID{"uid001", "uid002"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[memstore.UID]memstore.MetaMap{
+		"uid001": {"res001": {Version: 1}, "res002": {ExpireAt: 100, Version: 2}},
+	}, meta)
+
+	// the metadata of an unchanged value is updated, the one of a removed resource is dropped
+	assert.NoError(t, dp.DumpChangedWithMeta(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}},
+		"uid002": nil,
+	}, map[memstore.UID]memstore.MetaMap{
+		"uid001": {"res001": {ExpireAt: 200, Version: 3}},
+	}, memstore.DumpOptions{}))
+	meta, err = dp.LoadMeta(ctx, "test_storage", []memstore.UID{"uid001", "uid002"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[memstore.UID]memstore.MetaMap{
+		"uid001": {"res001": {ExpireAt: 200, Version: 3}},
+	}, meta)
+
+	// DumpChanged keeps the metadata of the stored resources
+	assert.NoError(t, dp.DumpChanged(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 10}},
+	}))
+	meta, err = dp.LoadMeta(ctx, "test_storage", []memstore.UID{"uid001"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[memstore.UID]memstore.MetaMap{
+		"uid001": {"res001": {ExpireAt: 200, Version: 3}},
+	}, meta)
+	data := map[memstore.UID]memstore.DataMap[TestDataType]{}
+	assert.NoError(t, dp.Load(ctx, "test_storage", &data))
+	assert.Equal(t, map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 10}},
+	}, data)
+}
+
+// Test_SQLWriteSeq tests that the largest write sequence dumped is kept
+func Test_SQLWriteSeq(t *testing.T) {
+	dp := createSQLDumper(t)
+	ctx := context.Background()
+	seq, err := dp.LoadWriteSeq(ctx, "test_storage")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), seq)
+
+	changed := map[memstore.UID]memstore.DataMap[TestDataType]{"uid001": {"res001": {Name: "res001", Quantity: 1}}}
+	assert.NoError(t, dp.DumpChangedWithMeta(ctx, "test_storage", changed, nil, memstore.DumpOptions{WriteSeq: 10}))
+	assert.NoError(t, dp.DumpChangedWithMeta(ctx, "test_storage", changed, nil, memstore.DumpOptions{WriteSeq: 5}))
+	seq, err = dp.LoadWriteSeq(ctx, "test_storage")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(10), seq)
+}
+
+// Test_SQLLoadMetaBatches tests that LoadMeta of SQLDumper queries the given users in batches
+func Test_SQLLoadMetaBatches(t *testing.T) {
+	dp := createSQLDumper(t)
+	ctx := context.Background()
+	data := make(map[memstore.UID]memstore.DataMap[TestDataType])
+	metas := make(map[memstore.UID]memstore.MetaMap)
+	users := make([]memstore.UID, 0)
+	for i := 0; i < 1200; i++ {
+		uid := fmt.Sprintf("uid%04d", i)
+		data[uid] = memstore.DataMap[TestDataType]{"res001": {Name: "res001", Quantity: int64(i)}}
+		metas[uid] = memstore.MetaMap{"res001": {Version: uint64(i + 1)}}
+		if i%2 == 0 {
+			users = append(users, uid)
+		}
+	}
+	assert.NoError(t, dp.DumpChanged(ctx, "test_storage", data))
+	assert.NoError(t, dp.DumpMeta(ctx, "test_storage", metas))
+
+	meta, err := dp.LoadMeta(ctx, "test_storage", users)
+	assert.NoError(t, err)
+	assert.Equal(t, len(users), len(meta))
+	for _, uid := range users {
+		assert.Equal(t, metas[uid], meta[uid])
+	}
+}
+
+// Test_SQLDumperStorage tests InMemoryStorage saving to and loading from SQLDumper
+func Test_SQLDumperStorage(t *testing.T) {
+	ctx := context.Background()
+	dp := createSQLDumper(t)
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = dp
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: 1}))
+	assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "res001", Quantity: 2}))
+	assert.NoError(t, storage.Save(ctx))
+	assert.NoError(t, storage.Delete("uid001", "res001"))
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res002", Quantity: 20}))
+	assert.NoError(t, storage.Purge("uid002"))
+	assert.NoError(t, storage.Save(ctx))
+
+	storage2 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage2.Dumper = dp
+	storage2.LazyLoad = true
+	assert.NoError(t, storage2.Load(ctx))
+	resources, err := storage2.List("uid001")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"res002"}, resources)
+	_, err = storage2.List("uid002")
+	assert.ErrorIs(t, err, memstore.ErrUserNotFound)
+}
+
+// Test_SQLDumperTable tests the table name validation of SQLDumper
+func Test_SQLDumperTable(t *testing.T) {
+	dp := createSQLDumper(t)
+	dp.Table = "resources; DROP TABLE users"
+	assert.ErrorIs(t, dp.CreateTable(context.Background()), memstore.ErrInvalidInput)
+	dp.Table = "my_resources"
+	assert.NoError(t, dp.CreateTable(context.Background()))
+	assert.NoError(t, dp.Dump(context.Background(), "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}},
+	}))
+	assert.Equal(t, 0, countRows(t, dp, "test_storage"))
+}
@@ -0,0 +1,281 @@
+package dumper
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/khgame/memstore"
+)
+
+// the first byte of a payload tells how the payload is written:
+//   - a byte that starts a JSON value, including the whitespaces, is the
+//     legacy untagged JSON
+//   - a byte from transformTagFirst to transformTagLast is a transform, which
+//     is reversed before the rest of the payload is read again
+//   - any other byte is the tag of a codec, CodecTagJSON, CodecTagGob,
+//     CodecTagBinary or the tag of a custom Codec
+const (
+	// TransformTagGzip is the tag of a payload compressed by gzip
+	TransformTagGzip byte = 0x10
+	// TransformTagFlate is the tag of a payload compressed by flate
+	TransformTagFlate byte = 0x11
+	// TransformTagAESGCM is the tag of a payload encrypted by AES-GCM, it is
+	// followed by the length of the key id, the key id, and the nonce
+	TransformTagAESGCM byte = 0x12
+	// TransformTagCRC32 is the tag of a payload followed by the CRC-32
+	// (Castagnoli) of the rest of it, in big endian
+	TransformTagCRC32 byte = 0x13
+
+	// transformTagFirst and transformTagLast are the range of the tags
+	// reserved for the transforms, the codecs can not use them
+	transformTagFirst byte = 0x10
+	transformTagLast  byte = 0x1f
+)
+
+const (
+	// CompressGzip compresses the payloads by gzip
+	CompressGzip CompressionAlgorithm = iota
+	// CompressFlate compresses the payloads by flate, which has no header
+	CompressFlate
+)
+
+// DefaultCompressionThreshold is the size above which the payloads are
+// compressed if the threshold is not specified
+const DefaultCompressionThreshold = 1024
+
+// DefaultMaxDecompressedSize is the max size of a decompressed payload if the
+// max size is not specified
+const DefaultMaxDecompressedSize = 64 << 20
+
+var (
+	// ErrUnknownKey is returned when a payload is encrypted by a key that is not in Encryption.Keys
+	ErrUnknownKey = errors.New("unknown encryption key")
+	// ErrDecryptFailed is returned when a payload can not be decrypted, it
+	// has been tampered with, or it is not written for the key it is read from
+	ErrDecryptFailed = errors.New("decrypt failed")
+	// ErrPayloadTooLarge is returned when a payload is larger than the max
+	// size after it is decompressed
+	ErrPayloadTooLarge = errors.New("payload too large")
+)
+
+type (
+	// CompressionAlgorithm is the algorithm of Compression
+	CompressionAlgorithm int
+
+	// Compression compresses the payloads larger than the threshold
+	Compression struct {
+		// Algorithm is the algorithm of the new payloads, the payloads of any
+		// algorithm are decompressed
+		Algorithm CompressionAlgorithm
+		// Threshold is the size above which the payloads are compressed,
+		// DefaultCompressionThreshold is used when it is not positive
+		Threshold int
+		// Level is the compression level of compress/flate, zero means the
+		// default level
+		Level int
+		// MaxSize is the max size of a payload after it is decompressed, the
+		// larger ones are not loaded. DefaultMaxDecompressedSize is used when
+		// it is not positive, or Compression is not set
+		MaxSize int
+	}
+
+	// Encryption encrypts the payloads by AES-GCM. the payloads carry the id of
+	// their key, so that the keys can be rotated by adding a new key, setting
+	// it as KeyID, and removing the old key after all the payloads are rewritten
+	Encryption struct {
+		// KeyID is the id of the key that encrypts the new payloads
+		KeyID string
+		// Keys are the AES keys of 16, 24 or 32 bytes by their ids
+		Keys map[string][]byte
+	}
+)
+
+// compress compresses the payload if it is larger than the threshold
+func (c *Compression) compress(payload []byte) ([]byte, error) {
+	threshold := c.Threshold
+	if threshold <= 0 {
+		threshold = DefaultCompressionThreshold
+	}
+	if len(payload) <= threshold {
+		return payload, nil
+	}
+	level := c.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch c.Algorithm {
+	case CompressGzip:
+		buf.WriteByte(TransformTagGzip)
+		w, err = gzip.NewWriterLevel(&buf, level)
+	case CompressFlate:
+		buf.WriteByte(TransformTagFlate)
+		w, err = flate.NewWriter(&buf, level)
+	default:
+		return nil, fmt.Errorf("%w, unknown compression algorithm %d", memstore.ErrInvalidInput, c.Algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(payload); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// maxSize returns the max size of a decompressed payload, c can be nil
+func (c *Compression) maxSize() int {
+	if c == nil || c.MaxSize <= 0 {
+		return DefaultMaxDecompressedSize
+	}
+	return c.MaxSize
+}
+
+// decompress decompresses the body of a compressed payload, ErrPayloadTooLarge
+// is returned if it is larger than maxSize after decompressed
+func decompress(tag byte, body []byte, maxSize int) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	if tag == TransformTagGzip {
+		if r, err = gzip.NewReader(bytes.NewReader(body)); err != nil {
+			return nil, err
+		}
+	} else {
+		r = flate.NewReader(bytes.NewReader(body))
+	}
+	defer r.Close()
+	// read one more byte to tell whether the limit is exceeded
+	out, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxSize {
+		return nil, fmt.Errorf("%w, the max size is %d", ErrPayloadTooLarge, maxSize)
+	}
+	return out, nil
+}
+
+// aead returns the AES-GCM of the key
+func (e *Encryption) aead(keyID string) (cipher.AEAD, error) {
+	key, ok := e.Keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w, key id: %q", ErrUnknownKey, keyID)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key %q: %w", keyID, err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt encrypts the payload by the current key, aad binds the payload to
+// where it is written
+func (e *Encryption) encrypt(payload, aad []byte) ([]byte, error) {
+	if len(e.KeyID) > 255 {
+		return nil, fmt.Errorf("%w, key id is longer than 255 bytes", memstore.ErrInvalidInput)
+	}
+	gcm, err := e.aead(e.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, 2+len(e.KeyID)+gcm.NonceSize()+len(payload)+gcm.Overhead())
+	out = append(append(out, TransformTagAESGCM, byte(len(e.KeyID))), e.KeyID...)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, payload, aad), nil
+}
+
+// decrypt decrypts the body of an encrypted payload by the key it is written with
+func (e *Encryption) decrypt(body, aad []byte) ([]byte, error) {
+	if len(body) < 1 || len(body) < 1+int(body[0]) {
+		return nil, fmt.Errorf("%w, the payload is truncated", ErrDecryptFailed)
+	}
+	keyID, body := string(body[1:1+int(body[0])]), body[1+int(body[0]):]
+	gcm, err := e.aead(keyID)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < gcm.NonceSize() {
+		return nil, fmt.Errorf("%w, the payload is truncated", ErrDecryptFailed)
+	}
+	plain, err := gcm.Open(nil, body[:gcm.NonceSize()], body[gcm.NonceSize():], aad)
+	if err != nil {
+		return nil, fmt.Errorf("%w, key id: %q, err: %v", ErrDecryptFailed, keyID, err)
+	}
+	return plain, nil
+}
+
+// encodeUser encodes the data of a user into the payload of the given key,
+// which is compressed, encrypted, and then checksummed if they are enabled
+func (m *CacheDumper[T]) encodeUser(key string, v memstore.DataMap[T]) ([]byte, error) {
+	payload, err := encodePayload(m.Codec, v)
+	if err != nil {
+		return nil, err
+	}
+	if m.Compression != nil {
+		if payload, err = m.Compression.compress(payload); err != nil {
+			return nil, err
+		}
+	}
+	if m.Encryption != nil {
+		if payload, err = m.Encryption.encrypt(payload, []byte(key)); err != nil {
+			return nil, err
+		}
+	}
+	if m.Checksum {
+		payload = appendChecksum(payload)
+	}
+	return payload, nil
+}
+
+// decodeUser decodes the payload of the given key, the transforms are
+// detected by their tags and reversed whatever the current settings are
+func (m *CacheDumper[T]) decodeUser(key string, payload []byte) (memstore.DataMap[T], error) {
+	var err error
+	for len(payload) > 0 {
+		tag := payload[0]
+		if tag == TransformTagCRC32 {
+			if payload, err = verifyChecksum(payload[1:]); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if tag == TransformTagGzip || tag == TransformTagFlate {
+			if payload, err = decompress(tag, payload[1:], m.Compression.maxSize()); err != nil {
+				return nil, fmt.Errorf("decompress error: %w", err)
+			}
+			continue
+		}
+		if tag == TransformTagAESGCM {
+			if m.Encryption == nil {
+				return nil, fmt.Errorf("%w, encryption is not configured", ErrUnknownKey)
+			}
+			if payload, err = m.Encryption.decrypt(payload[1:], []byte(key)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		break
+	}
+	var v memstore.DataMap[T]
+	if err = decodePayload(m.Codec, payload, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
@@ -0,0 +1,118 @@
+package dumper_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/khgame/memstore"
+	"github.com/khgame/memstore/dumper"
+	"github.com/stretchr/testify/assert"
+)
+
+// largeUser returns the data of a user whose payload is large enough to be compressed
+func largeUser(n int) memstore.DataMap[TestDataType] {
+	v := make(memstore.DataMap[TestDataType], n)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("res%03d", i)
+		v[name] = TestDataType{Name: name, Quantity: int64(i)}
+	}
+	return v
+}
+
+// Test_CacheDumperCompression tests the compression of CacheDumper with testify
+func Test_CacheDumperCompression(t *testing.T) {
+	ctx := context.Background()
+	dp := createCacheDumper().(*dumper.CacheDumper[TestDataType])
+	key := func(uid string) string { return dumper.SchemeMemStoreSaving.Make("test_storage", uid) }
+	data := map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": largeUser(100),
+		"uid002": {"res001": {Name: "res001", Quantity: 2}},
+	}
+
+	// only the payloads above the threshold are compressed
+	dp.Compression = &dumper.Compression{Threshold: 256}
+	assert.NoError(t, dp.Dump(ctx, "test_storage", data))
+	raw := dp.Cache.Get(ctx, key("uid001")).Val()
+	assert.Equal(t, dumper.TransformTagGzip, raw[0])
+	assert.Equal(t, byte('{'), dp.Cache.Get(ctx, key("uid002")).Val()[0])
+
+	// the payloads of any algorithm are loaded, even if compression is disabled
+	dp.Compression = &dumper.Compression{Algorithm: dumper.CompressFlate, Threshold: 256, Level: 9}
+	assert.NoError(t, dp.DumpChanged(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid003": largeUser(100),
+	}))
+	assert.Equal(t, dumper.TransformTagFlate, dp.Cache.Get(ctx, key("uid003")).Val()[0])
+	assert.Less(t, len(dp.Cache.Get(ctx, key("uid003")).Val()), len(raw))
+	dp.Compression = nil
+	out := map[memstore.UID]memstore.DataMap[TestDataType]{}
+	assert.NoError(t, dp.Load(ctx, "test_storage", &out))
+	data["uid003"] = largeUser(100)
+	assert.Equal(t, data, out)
+
+	// the payloads larger than the max size after decompressed are not loaded
+	dp.Compression = &dumper.Compression{Threshold: 256, MaxSize: 256}
+	_, err := dp.LoadUser(ctx, "test_storage", "uid001")
+	assert.ErrorIs(t, err, dumper.ErrPayloadTooLarge)
+	_, err = dp.LoadUser(ctx, "test_storage", "uid002")
+	assert.NoError(t, err)
+}
+
+// Test_CacheDumperEncryption tests the encryption and the key rotation of CacheDumper with testify
+func Test_CacheDumperEncryption(t *testing.T) {
+	ctx := context.Background()
+	dp := createCacheDumper().(*dumper.CacheDumper[TestDataType])
+	dp.KeepGenerations = 2
+	key := func(uid string) string { return dumper.SchemeMemStoreSaving.Make("test_storage", uid) }
+	key1, key2 := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 16)
+
+	// the plaintext payloads are still loaded after the encryption is enabled
+	assert.NoError(t, dp.Dump(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}},
+	}))
+	dp.Encryption = &dumper.Encryption{KeyID: "k1", Keys: map[string][]byte{"k1": key1}}
+	dp.Compression = &dumper.Compression{Threshold: 256}
+	dp.Codec = dumper.BinaryCodec{}
+	assert.NoError(t, dp.DumpChanged(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid002": {"res001": {Name: "res001", Quantity: 2}},
+		"uid003": largeUser(100),
+	}))
+	raw := dp.Cache.Get(ctx, key("uid002")).Val()
+	assert.Equal(t, dumper.TransformTagAESGCM, raw[0])
+	assert.NotContains(t, raw, "res001")
+
+	// the keys are rotated, the payloads of the old key are loaded as long as it is kept
+	dp.Encryption = &dumper.Encryption{KeyID: "k2", Keys: map[string][]byte{"k1": key1, "k2": key2}}
+	assert.NoError(t, dp.DumpChanged(ctx, "test_storage", map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid004": {"res001": {Name: "res001", Quantity: 4}},
+	}))
+	expected := map[memstore.UID]memstore.DataMap[TestDataType]{
+		"uid001": {"res001": {Name: "res001", Quantity: 1}},
+		"uid002": {"res001": {Name: "res001", Quantity: 2}},
+		"uid003": largeUser(100),
+		"uid004": {"res001": {Name: "res001", Quantity: 4}},
+	}
+	out := map[memstore.UID]memstore.DataMap[TestDataType]{}
+	assert.NoError(t, dp.Load(ctx, "test_storage", &out))
+	assert.Equal(t, expected, out)
+	gens, err := dp.Generations(ctx, "test_storage")
+	assert.NoError(t, err)
+	out = map[memstore.UID]memstore.DataMap[TestDataType]{}
+	assert.NoError(t, dp.LoadGeneration(ctx, "test_storage", gens[len(gens)-1].ID, &out))
+	assert.Equal(t, expected, out)
+
+	// the payloads can not be loaded without their key
+	dp.Encryption = &dumper.Encryption{KeyID: "k2", Keys: map[string][]byte{"k2": key2}}
+	_, err = dp.LoadUser(ctx, "test_storage", "uid002")
+	assert.ErrorIs(t, err, dumper.ErrUnknownKey)
+	dp.Encryption = nil
+	_, err = dp.LoadUser(ctx, "test_storage", "uid004")
+	assert.ErrorIs(t, err, dumper.ErrUnknownKey)
+
+	// the payloads are bound to their users
+	dp.Encryption = &dumper.Encryption{KeyID: "k2", Keys: map[string][]byte{"k1": key1, "k2": key2}}
+	assert.NoError(t, dp.Cache.Set(ctx, key("uid002"), dp.Cache.Get(ctx, key("uid004")).Val(), 0).Err())
+	_, err = dp.LoadUser(ctx, "test_storage", "uid002")
+	assert.ErrorIs(t, err, dumper.ErrDecryptFailed)
+}
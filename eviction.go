@@ -0,0 +1,351 @@
+package memstore
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"unsafe"
+)
+
+type (
+	// Capacity bounds the users kept in memory of InMemoryStorage, the least
+	// recently accessed users are evicted when one of the limits is exceeded.
+	// a dirty user is written back through the Dumper before it is evicted,
+	// it is kept in memory until the save finishes if a save is running.
+	// an evicted user is loaded back from the Dumper on its next access
+	Capacity[T any] struct {
+		// MaxUsers is the max count of users in memory, zero means no limit
+		MaxUsers int
+		// MaxBytes is the approximate byte budget of the users in memory,
+		// zero means no limit
+		MaxBytes int64
+		// SizeOf returns the approximate size of a user, it is only used with
+		// MaxBytes. when it is nil, the size is estimated by the count of
+		// resources and the size of T, which ignores the referenced memory
+		SizeOf func(user UID, data DataMap[T]) int64
+	}
+
+	// CapacityStats is the statistics of the capacity policy of InMemoryStorage
+	CapacityStats struct {
+		// Users is the count of users in memory
+		Users int
+		// Bytes is the approximate size of the users in memory
+		Bytes int64
+		// Evictions is the count of evicted users
+		Evictions uint64
+		// WriteBacks is the count of dirty users written back before eviction
+		WriteBacks uint64
+		// WriteBackErrors is the count of failed write-backs
+		WriteBackErrors uint64
+	}
+
+	// lruTracker records the access order and the sizes of the users in memory
+	lruTracker struct {
+		mu sync.Mutex
+		// order holds the users, the most recently accessed one is at front
+		order *list.List
+		elems map[UID]*list.Element
+		sizes map[UID]int64
+		bytes int64
+		// pins counts the callers that are accessing the users
+		pins map[UID]int
+
+		evictions       uint64
+		writeBacks      uint64
+		writeBackErrors uint64
+	}
+
+	// evictResult is the result of evicting a user
+	evictResult int
+)
+
+const (
+	// evicted means the user is removed from memory
+	evicted evictResult = iota
+	// evictSkipped means the user is kept in memory this time, such as it is
+	// pinned, or it is dirty while a save is running
+	evictSkipped
+	// evictFailed means the user failed to be written back, the eviction stops
+	evictFailed
+)
+
+// enabled returns true if any limit is set
+func (c Capacity[T]) enabled() bool {
+	return c.MaxUsers > 0 || c.MaxBytes > 0
+}
+
+// sizeOf returns the approximate size of a user
+func (c Capacity[T]) sizeOf(user UID, data DataMap[T]) int64 {
+	if c.SizeOf != nil {
+		return c.SizeOf(user, data)
+	}
+	var zero T
+	size := int64(len(user))
+	for storeName := range data {
+		size += int64(len(storeName)) + int64(unsafe.Sizeof(zero))
+	}
+	return size
+}
+
+// exceeded returns true if the users or bytes are over the limits
+func (c Capacity[T]) exceeded(users int, bytes int64) bool {
+	return (c.MaxUsers > 0 && users > c.MaxUsers) || (c.MaxBytes > 0 && bytes > c.MaxBytes)
+}
+
+// init creates the containers on first use
+func (t *lruTracker) init() {
+	if t.order == nil {
+		t.order = list.New()
+		t.elems = make(map[UID]*list.Element)
+		t.sizes = make(map[UID]int64)
+		t.pins = make(map[UID]int)
+	}
+}
+
+// pin keeps the user from eviction until unpin is called
+func (t *lruTracker) pin(user UID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.init()
+	t.pins[user]++
+}
+
+// unpin releases a pin of the user
+func (t *lruTracker) unpin(user UID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.pins[user]--; t.pins[user] <= 0 {
+		delete(t.pins, user)
+	}
+}
+
+// pinned returns true if the user is pinned
+func (t *lruTracker) pinned(user UID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.pins[user] > 0
+}
+
+// touch moves the user to the front, and records its size if size is not negative
+func (t *lruTracker) touch(user UID, size int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.init()
+	if e, ok := t.elems[user]; ok {
+		t.order.MoveToFront(e)
+	} else {
+		t.elems[user] = t.order.PushFront(user)
+	}
+	if size >= 0 {
+		t.bytes += size - t.sizes[user]
+		t.sizes[user] = size
+	}
+}
+
+// forget removes the user from the tracker
+func (t *lruTracker) forget(user UID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.elems[user]
+	if !ok {
+		return
+	}
+	t.order.Remove(e)
+	delete(t.elems, user)
+	t.bytes -= t.sizes[user]
+	delete(t.sizes, user)
+}
+
+// victim returns the least recently accessed user that is neither pinned nor
+// skipped, if the limits are exceeded
+func (t *lruTracker) victim(users int, exceeded func(users int, bytes int64) bool, skipped map[UID]struct{}) (UID, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.order == nil || !exceeded(users, t.bytes) {
+		return "", false
+	}
+	for e := t.order.Back(); e != nil; e = e.Prev() {
+		user := e.Value.(UID)
+		if _, skip := skipped[user]; !skip && t.pins[user] <= 0 {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+// pin keeps the user from eviction until the returned function is called
+func (s *InMemoryStorage[TData]) pin(user UID) (unpin func()) {
+	if !s.Capacity.enabled() {
+		return func() {}
+	}
+	s.lru.pin(user)
+	return func() { s.lru.unpin(user) }
+}
+
+// touch records an access of the user, the caller must hold the lock
+func (s *InMemoryStorage[TData]) touch(user UID) {
+	if s.Capacity.enabled() {
+		s.lru.touch(user, -1)
+	}
+}
+
+// resize records an access of the user and updates its size, the caller must hold the write lock
+func (s *InMemoryStorage[TData]) resize(user UID) {
+	if !s.Capacity.enabled() {
+		return
+	}
+	r, ok := s.shardOf(user).data[user]
+	if !ok {
+		s.lru.forget(user)
+		return
+	}
+	size := int64(-1)
+	if s.Capacity.MaxBytes > 0 {
+		size = s.Capacity.sizeOf(user, r)
+	}
+	s.lru.touch(user, size)
+}
+
+// CapacityStats returns the statistics of the capacity policy
+func (s *InMemoryStorage[TData]) CapacityStats() CapacityStats {
+	users := s.countUsers()
+
+	s.lru.mu.Lock()
+	defer s.lru.mu.Unlock()
+	return CapacityStats{
+		Users:           users,
+		Bytes:           s.lru.bytes,
+		Evictions:       s.lru.evictions,
+		WriteBacks:      s.lru.writeBacks,
+		WriteBackErrors: s.lru.writeBackErrors,
+	}
+}
+
+// evictIfNeeded evicts the least recently accessed users until the limits
+// are respected, the caller must not hold the lock
+func (s *InMemoryStorage[TData]) evictIfNeeded() {
+	if !s.Capacity.enabled() {
+		return
+	}
+	// another pass is running, it will evict until the limits are respected
+	if !s.evictMu.TryLock() {
+		return
+	}
+	defer s.evictMu.Unlock()
+
+	skipped := make(map[UID]struct{})
+	for {
+		users := s.countUsers()
+		user, ok := s.lru.victim(users, s.Capacity.exceeded, skipped)
+		if !ok {
+			return
+		}
+		switch s.evictUser(user) {
+		case evictSkipped:
+			skipped[user] = struct{}{}
+		case evictFailed:
+			return
+		}
+	}
+}
+
+// evictUser removes the user from memory, a dirty user is written back first.
+// a dirty user is skipped while a save is running, instead of waiting for it
+func (s *InMemoryStorage[TData]) evictUser(user UID) evictResult {
+	sh := s.shardOf(user)
+	unlock := s.lockUser(user)
+	// the user is pinned after it is chosen, skip it this time
+	if s.lru.pinned(user) {
+		unlock()
+		return evictSkipped
+	}
+	if _, dirty := sh.dirty[user]; !dirty {
+		s.removeLocked(user)
+		unlock()
+		return evicted
+	}
+	unlock()
+
+	// a dirty user can only be evicted after it is written back
+	if s.Dumper == nil {
+		return evictSkipped
+	}
+	// serialize with Save, so that the write-back never overrides a newer save
+	if !s.saveMu.TryLock() {
+		return evictSkipped
+	}
+	defer s.saveMu.Unlock()
+
+	// check the user again, it may be changed while the lock is released
+	unlock = s.lockUser(user)
+	r, ok := sh.data[user]
+	seq, dirty := sh.dirty[user]
+	if s.lru.pinned(user) {
+		unlock()
+		return evictSkipped
+	}
+	if !ok || !dirty {
+		s.removeLocked(user)
+		unlock()
+		return evicted
+	}
+	// copy the data, so that it can be dumped without the lock
+	snapshot := make(DataMap[TData], len(r))
+	for k, v := range r {
+		snapshot[k] = v
+	}
+	changed := map[UID]DataMap[TData]{user: snapshot}
+	meta := s.collectMetaLocked(changed)
+	unlock()
+
+	err := s.dumpChanged(context.Background(), changed, meta, true)
+
+	unlock = s.lockUser(user)
+	s.lru.mu.Lock()
+	if err != nil {
+		s.lru.writeBackErrors++
+	} else {
+		s.lru.writeBacks++
+	}
+	s.lru.mu.Unlock()
+	if err != nil {
+		unlock()
+		return evictFailed
+	}
+
+	// the user is modified or pinned during the write-back, keep it in memory
+	if cur, dirty := sh.dirty[user]; !dirty || cur != seq || s.lru.pinned(user) {
+		unlock()
+		return evictSkipped
+	}
+	s.markClean(user)
+	s.removeLocked(user)
+	unlock()
+
+	// the journal is checkpointed by Save only if some user is dirty, do it
+	// here once the write-backs make every user clean. a journal failed to be
+	// checkpointed is harmless, since replaying the saved mutations changes nothing
+	_ = s.checkpointCleanJournal()
+	return evicted
+}
+
+// removeLocked removes a clean user from memory, the caller must hold the write lock of the user
+func (s *InMemoryStorage[TData]) removeLocked(user UID) {
+	sh := s.shardOf(user)
+	delete(sh.meta, user)
+	delete(sh.written, user)
+	if _, ok := sh.data[user]; ok {
+		delete(sh.data, user)
+		s.indexUserLocked(user)
+		s.lru.mu.Lock()
+		s.lru.evictions++
+		s.lru.mu.Unlock()
+	}
+	s.lru.forget(user)
+}
@@ -0,0 +1,133 @@
+package memstore_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/khgame/memstore"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_InMemStorage_EvictMaxUsers tests that the least recently accessed users are evicted and loaded back
+func Test_InMemStorage_EvictMaxUsers(t *testing.T) {
+	ctx := context.Background()
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = createCacheDumper[TestDataType]()
+	storage.Capacity = memstore.Capacity[TestDataType]{MaxUsers: 2}
+
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: 1}))
+	assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "res001", Quantity: 2}))
+	assert.NoError(t, storage.Save(ctx))
+
+	// uid001 is the least recently accessed one, it is clean and evicted without write-back
+	assert.NoError(t, storage.Set("uid003", &TestDataType{Name: "res001", Quantity: 3}))
+	stats := storage.CapacityStats()
+	assert.Equal(t, 2, stats.Users)
+	assert.Equal(t, uint64(1), stats.Evictions)
+	assert.Equal(t, uint64(0), stats.WriteBacks)
+
+	// uid001 is loaded back, uid002 is evicted now
+	data := TestDataType{Name: "res001"}
+	assert.NoError(t, storage.Get("uid001", &data))
+	assert.Equal(t, int64(1), data.Quantity)
+	stats = storage.CapacityStats()
+	assert.Equal(t, 2, stats.Users)
+	assert.Equal(t, uint64(2), stats.Evictions)
+
+	// uid003 is dirty, it is written back before it is evicted
+	assert.NoError(t, storage.Get("uid002", &data))
+	assert.Equal(t, int64(2), data.Quantity)
+	stats = storage.CapacityStats()
+	assert.Equal(t, uint64(3), stats.Evictions)
+	assert.Equal(t, uint64(1), stats.WriteBacks)
+	assert.False(t, storage.IsDirty())
+
+	// the written back user is loaded back with its modification
+	assert.NoError(t, storage.Get("uid003", &data))
+	assert.Equal(t, int64(3), data.Quantity)
+
+	// unknown users are not found
+	_, err := storage.List("uid004")
+	assert.ErrorIs(t, err, memstore.ErrUserNotFound)
+
+	// all the data is persisted
+	storage2 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage2.Dumper = storage.Dumper
+	assert.NoError(t, storage2.Load(ctx))
+	for uid, quantity := range map[string]int64{"uid001": 1, "uid002": 2, "uid003": 3} {
+		assert.NoError(t, storage2.Get(uid, &data))
+		assert.Equal(t, quantity, data.Quantity)
+	}
+}
+
+// Test_InMemStorage_EvictMaxBytes tests that users are evicted when the byte budget is exceeded
+func Test_InMemStorage_EvictMaxBytes(t *testing.T) {
+	ctx := context.Background()
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = createCacheDumper[TestDataType]()
+	storage.Capacity = memstore.Capacity[TestDataType]{
+		MaxBytes: 30,
+		SizeOf: func(user memstore.UID, data memstore.DataMap[TestDataType]) int64 {
+			return int64(len(data)) * 10
+		},
+	}
+
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: 1}))
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res002", Quantity: 1}))
+	assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "res001", Quantity: 2}))
+	assert.Equal(t, int64(30), storage.CapacityStats().Bytes)
+
+	// uid001 is evicted when uid002 grows
+	assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "res002", Quantity: 2}))
+	stats := storage.CapacityStats()
+	assert.Equal(t, 1, stats.Users)
+	assert.Equal(t, int64(20), stats.Bytes)
+	assert.Equal(t, uint64(1), stats.WriteBacks)
+
+	// the evicted user is reloadable
+	resources, err := storage.List("uid001")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"res001", "res002"}, resources)
+	assert.NoError(t, storage.Save(ctx))
+}
+
+// Test_InMemStorage_EvictDuringSave tests that the writers are not blocked by a save when a dirty user has to be evicted
+func Test_InMemStorage_EvictDuringSave(t *testing.T) {
+	ctx := context.Background()
+	dp := &blockingDumper[TestDataType]{
+		Dumper:  createCacheDumper[TestDataType](),
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = dp
+	storage.Capacity = memstore.Capacity[TestDataType]{MaxUsers: 2}
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: 1}))
+	assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "res001", Quantity: 2}))
+
+	saved := make(chan error)
+	go func() { saved <- storage.Save(ctx) }()
+	<-dp.started
+
+	// the dirty users are skipped instead of waiting for the save
+	written := make(chan error)
+	go func() { written <- storage.Set("uid003", &TestDataType{Name: "res001", Quantity: 3}) }()
+	select {
+	case err := <-written:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Set is blocked by Save")
+	}
+	stats := storage.CapacityStats()
+	assert.Equal(t, 3, stats.Users)
+	assert.Equal(t, uint64(0), stats.WriteBacks)
+
+	// the saved users are evicted after the save
+	close(dp.release)
+	assert.NoError(t, <-saved)
+	stats = storage.CapacityStats()
+	assert.Equal(t, 2, stats.Users)
+	assert.Equal(t, uint64(1), stats.Evictions)
+	assert.Equal(t, uint64(0), stats.WriteBacks)
+}
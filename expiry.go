@@ -0,0 +1,160 @@
+package memstore
+
+import (
+	"fmt"
+	"time"
+)
+
+type (
+	// expiryReaper is a running background loop that removes the expired resources
+	expiryReaper struct {
+		stop chan struct{}
+		done chan struct{}
+	}
+
+	// expiredResource is a resource removed by the reaper
+	expiredResource[TData any] struct {
+		user  UID
+		value TData
+	}
+)
+
+// SetWithExpiry stores a resource for a given user, the resource expires at expireAt
+func (s *InMemoryStorage[TData]) SetWithExpiry(user string, in *TData, expireAt time.Time) error {
+	if expireAt.IsZero() {
+		return fmt.Errorf("%w, expireAt cannot be zero", ErrInvalidInput)
+	}
+	return s.set(user, in, ResourceMeta{ExpireAt: expireAt.UnixMilli()})
+}
+
+// SetWithTTL stores a resource for a given user, the resource expires after ttl
+func (s *InMemoryStorage[TData]) SetWithTTL(user string, in *TData, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("%w, ttl must be positive", ErrInvalidInput)
+	}
+	return s.SetWithExpiry(user, in, time.Now().Add(ttl))
+}
+
+// GetExpiry returns the expiry time of a resource for a given user,
+// the zero time is returned if the resource never expires or does not exist
+func (s *InMemoryStorage[TData]) GetExpiry(user string, storeName string) (time.Time, error) {
+	// validate input
+	if user == "" {
+		return time.Time{}, fmt.Errorf("%w, user cannot be empty", ErrInvalidUser)
+	}
+	if storeName == "" {
+		return time.Time{}, fmt.Errorf("%w, storeName cannot be empty", ErrInvalidInput)
+	}
+	// load the user if it is not in memory
+	release, err := s.loadUser(user)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer release()
+	// lock the user
+	unlock := s.rlockUser(user)
+	defer unlock()
+
+	if _, ok := s.shardOf(user).data[user]; !ok {
+		return time.Time{}, fmt.Errorf("%w, user: %s", ErrUserNotFound, user)
+	}
+	meta := s.metaLocked(user, storeName)
+	if meta.ExpireAt == 0 || meta.expired(time.Now()) {
+		return time.Time{}, nil
+	}
+	return time.UnixMilli(meta.ExpireAt), nil
+}
+
+// ReapExpired removes the expired resources of the users in memory, marks
+// their users dirty and calls OnExpire for each of them. it returns the
+// count of removed resources
+func (s *InMemoryStorage[TData]) ReapExpired() int {
+	expired := s.reapExpired(time.Now())
+	if s.OnExpire != nil {
+		for _, e := range expired {
+			s.OnExpire(e.user, e.value)
+		}
+	}
+	return len(expired)
+}
+
+// reapExpired removes the resources expired at now, the shards are
+// locked one by one, so that the other shards are not blocked
+func (s *InMemoryStorage[TData]) reapExpired(now time.Time) []expiredResource[TData] {
+	// lock the mutex
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var expired []expiredResource[TData]
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		expired = s.reapShardLocked(sh, now, expired)
+		sh.mu.Unlock()
+	}
+	return expired
+}
+
+// reapShardLocked removes the resources of a shard expired at now, the
+// caller must hold the write lock of the shard
+func (s *InMemoryStorage[TData]) reapShardLocked(sh *shard[TData], now time.Time, expired []expiredResource[TData]) []expiredResource[TData] {
+	for user, mm := range sh.meta {
+		r := sh.data[user]
+		for storeName, meta := range mm {
+			if !meta.expired(now) {
+				continue
+			}
+			// the journal is best-effort here, since a replayed resource is expired anyway
+			_ = s.journalLocked(journalRecord[TData]{Op: journalOpDel, User: user, StoreName: storeName})
+			if v, ok := r[storeName]; ok {
+				expired = append(expired, expiredResource[TData]{user: user, value: v})
+				r, _ = s.writableLocked(user)
+				delete(r, storeName)
+				s.indexResourceLocked(user, storeName, nil)
+				s.emitLocked(ChangeExpire, user, storeName, &v, nil)
+			}
+			s.setMetaLocked(user, storeName, ResourceMeta{})
+			s.markDirty(user)
+		}
+		s.resize(user)
+	}
+	return expired
+}
+
+// StartExpiryReaper starts a background loop that calls ReapExpired every
+// interval, the loop is stopped by Close
+func (s *InMemoryStorage[TData]) StartExpiryReaper(interval time.Duration) error {
+	// validate input
+	if interval <= 0 {
+		return fmt.Errorf("%w, interval must be positive", ErrInvalidInput)
+	}
+	// lock the mutex
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.reaper != nil {
+		return fmt.Errorf("%w, expiry reaper is already started", ErrStatusError)
+	}
+	s.reaper = &expiryReaper{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go s.runExpiryReaper(s.reaper, interval)
+	return nil
+}
+
+// runExpiryReaper is the background reaper loop
+func (s *InMemoryStorage[TData]) runExpiryReaper(r *expiryReaper, interval time.Duration) {
+	defer close(r.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			s.ReapExpired()
+		}
+	}
+}
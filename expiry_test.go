@@ -0,0 +1,119 @@
+package memstore_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/khgame/memstore"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_InMemStorage_Expiry tests that the expired resources are hidden and reaped
+func Test_InMemStorage_Expiry(t *testing.T) {
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	var (
+		mu      sync.Mutex
+		expired []string
+	)
+	storage.OnExpire = func(user memstore.UID, v TestDataType) {
+		mu.Lock()
+		defer mu.Unlock()
+		expired = append(expired, user+"/"+v.Name)
+	}
+
+	assert.ErrorIs(t, storage.SetWithTTL("uid001", &TestDataType{Name: "buff"}, 0), memstore.ErrInvalidInput)
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: 1}))
+	assert.NoError(t, storage.SetWithExpiry("uid001", &TestDataType{Name: "ticket", Quantity: 1}, time.Now().Add(-time.Second)))
+	assert.NoError(t, storage.SetWithTTL("uid001", &TestDataType{Name: "buff", Quantity: 1}, time.Hour))
+
+	// the expired resource is hidden
+	resources, err := storage.List("uid001")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"buff", "res001"}, resources)
+	data := TestDataType{Name: "ticket"}
+	assert.ErrorIs(t, storage.Get("uid001", &data), memstore.ErrResourceNotFound)
+	assert.Equal(t, int64(0), data.Quantity)
+
+	// the expiry can be read
+	expireAt, err := storage.GetExpiry("uid001", "buff")
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expireAt, time.Second)
+	expireAt, err = storage.GetExpiry("uid001", "res001")
+	assert.NoError(t, err)
+	assert.True(t, expireAt.IsZero())
+
+	// update keeps the expiry, set clears it
+	assert.NoError(t, storage.Update("uid001", "buff", func(org *TestDataType) (*TestDataType, error) {
+		org.Quantity++
+		return org, nil
+	}))
+	expireAt, err = storage.GetExpiry("uid001", "buff")
+	assert.NoError(t, err)
+	assert.False(t, expireAt.IsZero())
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "buff", Quantity: 5}))
+	expireAt, err = storage.GetExpiry("uid001", "buff")
+	assert.NoError(t, err)
+	assert.True(t, expireAt.IsZero())
+
+	// update on an expired resource starts from nil
+	assert.NoError(t, storage.SetWithExpiry("uid002", &TestDataType{Name: "ticket", Quantity: 1}, time.Now().Add(-time.Second)))
+	assert.NoError(t, storage.Update("uid002", "ticket", func(org *TestDataType) (*TestDataType, error) {
+		assert.Nil(t, org)
+		return &TestDataType{Name: "ticket", Quantity: 10}, nil
+	}))
+	data = TestDataType{Name: "ticket"}
+	assert.NoError(t, storage.Get("uid002", &data))
+	assert.Equal(t, int64(10), data.Quantity)
+
+	// the reaper removes the expired resources
+	assert.NoError(t, storage.SetWithTTL("uid002", &TestDataType{Name: "buff", Quantity: 1}, 30*time.Millisecond))
+	assert.NoError(t, storage.StartExpiryReaper(10*time.Millisecond))
+	assert.ErrorIs(t, storage.StartExpiryReaper(10*time.Millisecond), memstore.ErrStatusError)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(expired) == 2
+	}, time.Second, 5*time.Millisecond)
+	assert.ElementsMatch(t, []string{"uid001/ticket", "uid002/buff"}, expired)
+	assert.Equal(t, []memstore.UID{"uid001", "uid002"}, storage.DirtyUsers())
+	assert.Equal(t, 0, storage.ReapExpired())
+	// the reaper is stopped, and the dirty storage can not be saved without dumper
+	assert.ErrorIs(t, storage.Close(context.Background()), memstore.ErrStatusError)
+}
+
+// Test_InMemStorage_ExpirySaveLoad tests that the expiry survives the Save/Load round-trip
+func Test_InMemStorage_ExpirySaveLoad(t *testing.T) {
+	ctx := context.Background()
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = createCacheDumper[TestDataType]()
+	assert.NoError(t, storage.SetWithTTL("uid001", &TestDataType{Name: "buff", Quantity: 1}, time.Hour))
+	assert.NoError(t, storage.SetWithExpiry("uid001", &TestDataType{Name: "ticket", Quantity: 1}, time.Now().Add(-time.Second)))
+	assert.NoError(t, storage.Save(ctx))
+	expected, err := storage.GetExpiry("uid001", "buff")
+	assert.NoError(t, err)
+
+	for _, lazy := range []bool{false, true} {
+		storage2 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+		storage2.Dumper = storage.Dumper
+		storage2.LazyLoad = lazy
+		assert.NoError(t, storage2.Load(ctx))
+		expireAt, err := storage2.GetExpiry("uid001", "buff")
+		assert.NoError(t, err)
+		assert.Equal(t, expected, expireAt)
+		resources, err := storage2.List("uid001")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"buff"}, resources)
+	}
+
+	// the expiry is cleared in the permanent storage as well
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "buff", Quantity: 2}))
+	assert.NoError(t, storage.Save(ctx))
+	storage3 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage3.Dumper = storage.Dumper
+	assert.NoError(t, storage3.Load(ctx))
+	expireAt, err := storage3.GetExpiry("uid001", "buff")
+	assert.NoError(t, err)
+	assert.True(t, expireAt.IsZero())
+}
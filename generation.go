@@ -0,0 +1,132 @@
+package memstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrGenerationNotFound is returned when a snapshot generation does not exist
+	ErrGenerationNotFound = fmt.Errorf("generation not found")
+)
+
+type (
+	// Generation is a kept snapshot of a storage, produced by a save
+	Generation struct {
+		// ID is the generation id, it increases with each save
+		ID uint64
+		// CreatedAt is the time the generation was written
+		CreatedAt time.Time
+	}
+
+	// GenerationDumper is implemented by the dumpers that keep the prior
+	// snapshots of a storage, so that a storage can be rolled back
+	GenerationDumper[T any] interface {
+		// Generations lists the kept generations of a storage, in ascending order of ID
+		Generations(ctx context.Context, permanentKey string) ([]Generation, error)
+		// LoadGeneration loads the data of the given generation,
+		// ErrGenerationNotFound is returned if it is not kept
+		LoadGeneration(ctx context.Context, permanentKey string, gen uint64, out *map[UID]DataMap[T]) error
+		// LoadGenerationMeta loads the metadata of all the users in the given generation
+		LoadGenerationMeta(ctx context.Context, permanentKey string, gen uint64) (map[UID]MetaMap, error)
+		// PruneGenerations removes the generations except the latest keep ones
+		PruneGenerations(ctx context.Context, permanentKey string, keep int) error
+	}
+)
+
+// LoadGeneration replaces the data in memory with the given generation of
+// the Dumper, which must implement GenerationDumper. the restored users, and
+// the users that are in the permanent storage but not in the generation,
+// including the ones that can not be loaded, are marked dirty, so the next Save persists the rollback as the latest data.
+// the journal is not replayed, since it records the changes of the latest data.
+// the Lease is acquired like Load, so that only the owner restores and saves
+func (s *InMemoryStorage[TData]) LoadGeneration(ctx context.Context, gen uint64) error {
+	// lock the mutex
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// check if the storage is dirty
+	if s.IsDirty() {
+		return fmt.Errorf("%w, cannot load data when storage is dirty", ErrStatusError)
+	}
+	gd, ok := s.Dumper.(GenerationDumper[TData])
+	if !ok {
+		return fmt.Errorf("%w, dumper does not keep generations", ErrStatusError)
+	}
+	// all the users must stay in memory, to find the users to remove on the next save
+	if s.LazyLoad || s.Capacity.enabled() {
+		return fmt.Errorf("%w, cannot load a generation when the users are loaded on demand or evicted", ErrStatusError)
+	}
+
+	// take the ownership before reading, the lease acquired here is released
+	// if the generation fails to be restored
+	if s.Lease == nil {
+		return s.loadGenerationLocked(ctx, gd, gen)
+	}
+	held := s.Lease.Held()
+	if err := s.Lease.acquire(ctx, s.PersistentKey); err != nil {
+		return err
+	}
+	err := s.loadGenerationLocked(ctx, gd, gen)
+	if err != nil && !held {
+		if errRelease := s.Lease.release(ctx); errRelease != nil {
+			err = fmt.Errorf("%w, and %v", err, errRelease)
+		}
+	}
+	return err
+}
+
+// loadGenerationLocked restores the given generation, the caller must hold
+// the storage lock for writing
+func (s *InMemoryStorage[TData]) loadGenerationLocked(ctx context.Context, gd GenerationDumper[TData], gen uint64) error {
+	data := make(map[UID]DataMap[TData])
+	if err := gd.LoadGeneration(ctx, s.PersistentKey, gen, &data); err != nil {
+		return fmt.Errorf("failed to load generation %d from permanent storage, err: %w", gen, err)
+	}
+	meta, err := gd.LoadGenerationMeta(ctx, s.PersistentKey, gen)
+	if err != nil {
+		return fmt.Errorf("failed to load metadata of generation %d from permanent storage, err: %w", gen, err)
+	}
+	// the users failed to be loaded are in the latest data as well
+	latest := make(map[UID]DataMap[TData])
+	failures, err := s.loadWithFailuresLocked(ctx, &latest)
+	if err != nil {
+		return fmt.Errorf("failed to load data from permanent storage, err: %w", err)
+	}
+	for _, f := range failures {
+		latest[f.User] = nil
+	}
+	if err = s.raiseWriteSeqByDumper(ctx); err != nil {
+		return err
+	}
+
+	// nothing of the replaced users is kept, including the references of
+	// the snapshots and the failures of the last Load
+	for _, sh := range s.shards {
+		sh.data, sh.meta = make(map[UID]DataMap[TData]), make(map[UID]MetaMap)
+		sh.written, sh.shared = make(map[UID]uint64), make(map[UID]struct{})
+	}
+	s.setFailuresLocked(nil)
+	for user, r := range data {
+		s.shardOf(user).data[user] = r
+	}
+	for user, mm := range meta {
+		if _, ok := data[user]; ok && len(mm) > 0 {
+			s.shardOf(user).meta[user] = mm
+		}
+	}
+	s.raiseWriteSeqByMeta(meta)
+	for user := range data {
+		s.markDirty(user)
+	}
+	// the users that are not in the generation are removed by the next save
+	for user := range latest {
+		if _, ok := data[user]; !ok {
+			s.markDirty(user)
+		}
+	}
+	s.purgeEpoch.Add(1)
+	s.rebuildIndexesLocked()
+	return nil
+}
@@ -0,0 +1,125 @@
+package memstore_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/khgame/memstore"
+	"github.com/khgame/memstore/cache"
+	"github.com/khgame/memstore/dumper"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_InMemStorage_LoadGeneration tests rolling back a storage to a previous generation
+func Test_InMemStorage_LoadGeneration(t *testing.T) {
+	ctx := context.Background()
+	dp := createCacheDumper[TestDataType]().(*dumper.CacheDumper[TestDataType])
+	dp.KeepGenerations = 3
+
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = dp
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: 1}))
+	assert.NoError(t, storage.SetWithTTL("uid002", &TestDataType{Name: "buff", Quantity: 2}, time.Hour))
+	assert.NoError(t, storage.Save(ctx))
+
+	// a bad save
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: -100}))
+	assert.NoError(t, storage.Delete("uid002", "buff"))
+	assert.NoError(t, storage.Set("uid003", &TestDataType{Name: "res001", Quantity: 3}))
+	assert.NoError(t, storage.Save(ctx))
+
+	gens, err := dp.Generations(ctx, "test_storage")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(gens))
+
+	// roll back to the first generation
+	storage2 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage2.Dumper = dp
+	assert.NoError(t, storage2.LoadGeneration(ctx, gens[0].ID))
+	assert.Equal(t, []memstore.UID{"uid001", "uid002", "uid003"}, storage2.DirtyUsers())
+	assert.ErrorIs(t, storage2.LoadGeneration(ctx, gens[0].ID), memstore.ErrStatusError)
+	assert.NoError(t, storage2.Save(ctx))
+
+	storage3 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage3.Dumper = dp
+	assert.NoError(t, storage3.Load(ctx))
+	data := TestDataType{Name: "res001"}
+	assert.NoError(t, storage3.Get("uid001", &data))
+	assert.Equal(t, int64(1), data.Quantity)
+	expireAt, err := storage3.GetExpiry("uid002", "buff")
+	assert.NoError(t, err)
+	assert.False(t, expireAt.IsZero())
+	_, err = storage3.List("uid003")
+	assert.ErrorIs(t, err, memstore.ErrUserNotFound)
+
+	// the rollback is saved as a new generation
+	gens, err = dp.Generations(ctx, "test_storage")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(gens))
+	assert.ErrorIs(t, storage3.LoadGeneration(ctx, 100), memstore.ErrGenerationNotFound)
+
+	// a purged user is erased from all the generations
+	assert.NoError(t, storage3.Set("uid002", &TestDataType{Name: "buff", Quantity: 4}))
+	assert.NoError(t, storage3.Save(ctx))
+	assert.NoError(t, storage3.Purge("uid002"))
+	assert.NoError(t, storage3.Save(ctx))
+	storage5 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage5.Dumper = dp
+	assert.NoError(t, storage5.LoadGeneration(ctx, gens[2].ID))
+	_, err = storage5.List("uid002")
+	assert.ErrorIs(t, err, memstore.ErrUserNotFound)
+
+	// all the users must stay in memory
+	storage4 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage4.Dumper = createCacheDumper[TestDataType]()
+	storage4.LazyLoad = true
+	assert.ErrorIs(t, storage4.LoadGeneration(ctx, 1), memstore.ErrStatusError)
+}
+
+// Test_InMemStorage_LoadGenerationLease tests that LoadGeneration takes the lease and replaces the state of the last Load
+func Test_InMemStorage_LoadGenerationLease(t *testing.T) {
+	ctx := context.Background()
+	mini, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer mini.Close()
+	c := cache.NewClient(mini.Addr())
+	defer c.Close()
+	dp := dumper.CreateCacheDumperByCacheInstance[TestDataType](c)
+	dp.KeepGenerations = 3
+	dp.Checksum = true
+	dp.LoadPolicy = dumper.LoadSkip
+
+	owner := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	owner.Dumper = dp
+	owner.Lease = memstore.NewLease(c, "node1", time.Minute)
+	assert.NoError(t, owner.Load(ctx))
+	assert.NoError(t, owner.Set("uid001", &TestDataType{Name: "res001", Quantity: 1}))
+	assert.NoError(t, owner.Save(ctx))
+	gens, err := dp.Generations(ctx, "test_storage")
+	assert.NoError(t, err)
+
+	// a non-owner can not restore a generation
+	other := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	other.Dumper = dp
+	other.Lease = memstore.NewLease(c, "node2", time.Minute)
+	assert.ErrorIs(t, other.LoadGeneration(ctx, gens[0].ID), memstore.ErrLeaseHeld)
+	assert.False(t, other.Lease.Held())
+
+	// the failures of the last Load are dropped by the restore
+	assert.NoError(t, owner.Set("uid002", &TestDataType{Name: "res001", Quantity: 2}))
+	assert.NoError(t, owner.Save(ctx))
+	key := dumper.SchemeMemStoreSaving.Make("test_storage", "uid002")
+	raw := []byte(c.Get(ctx, key).Val())
+	raw[len(raw)-2] ^= 0xff
+	assert.NoError(t, c.Set(ctx, key, raw, 0).Err())
+	assert.NoError(t, owner.Load(ctx))
+	assert.Equal(t, 1, len(owner.LoadFailures()))
+	assert.NoError(t, owner.LoadGeneration(ctx, gens[0].ID))
+	assert.Empty(t, owner.LoadFailures())
+	assert.True(t, owner.Lease.Held())
+	assert.Equal(t, []memstore.UID{"uid001", "uid002"}, owner.DirtyUsers())
+	assert.NoError(t, owner.Save(ctx))
+	assert.NoError(t, owner.Close(ctx))
+}
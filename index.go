@@ -0,0 +1,203 @@
+package memstore
+
+import (
+	"fmt"
+	"sort"
+)
+
+var (
+	// ErrIndexNotFound is returned when looking up an index that is not added
+	ErrIndexNotFound = fmt.Errorf("index not found")
+)
+
+type (
+	// IndexFunc extracts the index key of a resource, the resource is not
+	// indexed if ok is false
+	IndexFunc[TData any] func(value TData) (key string, ok bool)
+
+	// indexes holds the secondary indexes of a storage
+	indexes[TData any] struct {
+		// items are the indexes by name, they are protected by the storage
+		// lock, which is held for writing to add an index
+		items map[string]*index[TData]
+	}
+
+	// index maps the keys extracted from the resources to their users
+	index[TData any] struct {
+		extract IndexFunc[TData]
+		// shards are the entries of the users of each shard of the storage,
+		// they are protected by the lock of the shard, so that the writers
+		// of different shards update an index concurrently
+		shards [shardCount]indexShard
+	}
+
+	// indexShard is the part of an index for the users of a shard
+	indexShard struct {
+		// users is the count of the resources of each user by key
+		users map[string]map[UID]int
+		// keys is the key of each indexed resource by user and store name
+		keys map[UID]map[string]string
+	}
+)
+
+// AddIndex adds a secondary index that maps the key extracted by fn from each
+// resource to the users holding it. the index is built from the users in
+// memory, maintained by the writes, and rebuilt by Load. an index needs all
+// the users in memory, so it can not be added with LazyLoad or Capacity
+func (s *InMemoryStorage[TData]) AddIndex(name string, fn IndexFunc[TData]) error {
+	// validate input
+	if name == "" {
+		return fmt.Errorf("%w, name cannot be empty", ErrInvalidInput)
+	}
+	if fn == nil {
+		return fmt.Errorf("%w, fn cannot be nil", ErrInvalidInput)
+	}
+	// lock the mutex
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkIndexable(); err != nil {
+		return err
+	}
+	if _, ok := s.indexes.items[name]; ok {
+		return fmt.Errorf("%w, index %s already exists", ErrInvalidInput, name)
+	}
+	if s.indexes.items == nil {
+		s.indexes.items = make(map[string]*index[TData])
+	}
+	idx := &index[TData]{extract: fn}
+	s.buildIndexLocked(idx)
+	s.indexes.items[name] = idx
+	return nil
+}
+
+// Lookup returns the users holding a resource with the given key in the
+// index, in ascending order. an expired resource stays in the index until
+// it is removed by ReapExpired or a write. ErrStatusError is returned if
+// LazyLoad or Capacity is enabled, since the answer would be incomplete
+func (s *InMemoryStorage[TData]) Lookup(name string, key string) ([]UID, error) {
+	// lock the mutex
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkIndexable(); err != nil {
+		return nil, err
+	}
+	idx, ok := s.indexes.items[name]
+	if !ok {
+		return nil, fmt.Errorf("%w, index: %s", ErrIndexNotFound, name)
+	}
+	users := make([]UID, 0)
+	for i, sh := range s.shards {
+		sh.mu.RLock()
+		for user := range idx.shards[i].users[key] {
+			users = append(users, user)
+		}
+		sh.mu.RUnlock()
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+// checkIndexable returns ErrStatusError if the users may not be in memory
+func (s *InMemoryStorage[TData]) checkIndexable() error {
+	if s.LazyLoad || s.Capacity.enabled() {
+		return fmt.Errorf("%w, indexes need all the users in memory, which LazyLoad and Capacity do not keep", ErrStatusError)
+	}
+	return nil
+}
+
+// indexResourceLocked updates the indexes with a resource, a nil value
+// removes it. the caller must hold the write lock of the user
+func (s *InMemoryStorage[TData]) indexResourceLocked(user UID, storeName string, v *TData) {
+	for _, idx := range s.indexes.items {
+		ish := idx.shardOf(user)
+		ish.remove(user, storeName)
+		if v != nil {
+			idx.add(ish, user, storeName, *v)
+		}
+	}
+}
+
+// indexUserLocked updates the indexes with all the resources of a user, the
+// user is removed from them if it is not in memory. the caller must hold the
+// write lock of the user
+func (s *InMemoryStorage[TData]) indexUserLocked(user UID) {
+	r := s.shardOf(user).data[user]
+	for _, idx := range s.indexes.items {
+		ish := idx.shardOf(user)
+		for storeName := range ish.keys[user] {
+			ish.remove(user, storeName)
+		}
+		for storeName, v := range r {
+			idx.add(ish, user, storeName, v)
+		}
+	}
+}
+
+// rebuildIndexesLocked rebuilds all the indexes from the users in memory,
+// the caller must hold the storage lock for writing
+func (s *InMemoryStorage[TData]) rebuildIndexesLocked() {
+	for _, idx := range s.indexes.items {
+		s.buildIndexLocked(idx)
+	}
+}
+
+// buildIndexLocked builds an index from the users in memory, the caller
+// must hold the storage lock for writing
+func (s *InMemoryStorage[TData]) buildIndexLocked(idx *index[TData]) {
+	for i, sh := range s.shards {
+		ish := &idx.shards[i]
+		ish.users = make(map[string]map[UID]int)
+		ish.keys = make(map[UID]map[string]string)
+		for user, r := range sh.data {
+			for storeName, v := range r {
+				idx.add(ish, user, storeName, v)
+			}
+		}
+	}
+}
+
+// shardOf returns the part of the index for the shard of a user
+func (idx *index[TData]) shardOf(user UID) *indexShard {
+	return &idx.shards[shardIndex(user)]
+}
+
+// add indexes a resource of a user in the part of the index for its shard
+func (idx *index[TData]) add(ish *indexShard, user UID, storeName string, v TData) {
+	key, ok := idx.extract(v)
+	if !ok {
+		return
+	}
+	users, ok := ish.users[key]
+	if !ok {
+		users = make(map[UID]int)
+		ish.users[key] = users
+	}
+	users[user]++
+	keys, ok := ish.keys[user]
+	if !ok {
+		keys = make(map[string]string)
+		ish.keys[user] = keys
+	}
+	keys[storeName] = key
+}
+
+// remove removes a resource of a user from the index
+func (ish *indexShard) remove(user UID, storeName string) {
+	key, ok := ish.keys[user][storeName]
+	if !ok {
+		return
+	}
+	delete(ish.keys[user], storeName)
+	if len(ish.keys[user]) == 0 {
+		delete(ish.keys, user)
+	}
+	users := ish.users[key]
+	if users[user]--; users[user] <= 0 {
+		delete(users, user)
+	}
+	if len(users) == 0 {
+		delete(ish.users, key)
+	}
+}
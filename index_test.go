@@ -0,0 +1,96 @@
+package memstore_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/khgame/memstore"
+	"github.com/stretchr/testify/assert"
+)
+
+// holders indexes the users by the resources they hold
+func holders(v TestDataType) (string, bool) {
+	return v.Name, v.Quantity > 0
+}
+
+// Test_InMemStorage_Index tests the secondary indexes of InMemStorage with testify
+func Test_InMemStorage_Index(t *testing.T) {
+	ctx := context.Background()
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = createCacheDumper[TestDataType]()
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "sword", Quantity: 1}))
+	assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "sword", Quantity: 0}))
+
+	// the index is built from the users in memory
+	assert.NoError(t, storage.AddIndex("holders", holders))
+	assert.ErrorIs(t, storage.AddIndex("holders", holders), memstore.ErrInvalidInput)
+	_, err := storage.Lookup("nickname", "alice")
+	assert.ErrorIs(t, err, memstore.ErrIndexNotFound)
+	users, err := storage.Lookup("holders", "sword")
+	assert.NoError(t, err)
+	assert.Equal(t, []memstore.UID{"uid001"}, users)
+
+	// the index is maintained by the writes
+	assert.NoError(t, storage.Update("uid002", "sword", func(org *TestDataType) (*TestDataType, error) {
+		org.Quantity++
+		return org, nil
+	}))
+	assert.NoError(t, storage.Set("uid003", &TestDataType{Name: "sword", Quantity: 1}))
+	assert.NoError(t, storage.SetMany("uid003", []*TestDataType{{Name: "shield", Quantity: 1}}))
+	users, err = storage.Lookup("holders", "sword")
+	assert.NoError(t, err)
+	assert.Equal(t, []memstore.UID{"uid001", "uid002", "uid003"}, users)
+	assert.NoError(t, storage.Delete("uid001", "sword"))
+	assert.NoError(t, storage.Purge("uid002"))
+	users, err = storage.Lookup("holders", "sword")
+	assert.NoError(t, err)
+	assert.Equal(t, []memstore.UID{"uid003"}, users)
+	users, err = storage.Lookup("holders", "shield")
+	assert.NoError(t, err)
+	assert.Equal(t, []memstore.UID{"uid003"}, users)
+	assert.NoError(t, storage.Save(ctx))
+
+	// the index is rebuilt after Load
+	storage2 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage2.Dumper = storage.Dumper
+	assert.NoError(t, storage2.AddIndex("holders", holders))
+	assert.NoError(t, storage2.Load(ctx))
+	users, err = storage2.Lookup("holders", "sword")
+	assert.NoError(t, err)
+	assert.Equal(t, []memstore.UID{"uid003"}, users)
+
+	// the indexes are rejected when the users may not be in memory
+	storage3 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage3.Dumper = storage.Dumper
+	storage3.LazyLoad = true
+	assert.ErrorIs(t, storage3.AddIndex("holders", holders), memstore.ErrStatusError)
+	storage2.Capacity = memstore.Capacity[TestDataType]{MaxUsers: 10}
+	_, err = storage2.Lookup("holders", "sword")
+	assert.ErrorIs(t, err, memstore.ErrStatusError)
+}
+
+// Test_InMemStorage_IndexConcurrent tests the indexes updated by the writers of different shards concurrently with testify
+func Test_InMemStorage_IndexConcurrent(t *testing.T) {
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	assert.NoError(t, storage.AddIndex("holders", holders))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				assert.NoError(t, storage.Set(fmt.Sprintf("uid%d_%03d", i, j), &TestDataType{Name: "sword", Quantity: 1}))
+				_, err := storage.Lookup("holders", "sword")
+				assert.NoError(t, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	users, err := storage.Lookup("holders", "sword")
+	assert.NoError(t, err)
+	assert.Equal(t, 800, len(users))
+}
@@ -0,0 +1,204 @@
+package memstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	// ErrUserUnavailable is returned when accessing a user that failed to be
+	// loaded by Load, until it is repaired by RepairUser or purged
+	ErrUserUnavailable = errors.New("user unavailable")
+)
+
+type (
+	// LoadFailure is a user that can not be loaded
+	LoadFailure struct {
+		// User is the user that can not be loaded
+		User UID
+		// Err is why the user can not be loaded, it matches ErrUserNotFound
+		// if the payload is missing, or the error of the decoding otherwise
+		Err error
+		// QuarantineKey is where the payload is moved to, empty if it is not moved
+		QuarantineKey string
+	}
+
+	// LoadOptions are the options of TolerantDumper.LoadWithFailures
+	LoadOptions struct {
+		// Fence is the holder of the Lease of the storage, nil if there is no
+		// lease. the dumpers moving the failed payloads aside make the moves
+		// only if the lease is still held by it, like DumpOptions.Fence
+		Fence *Fence
+	}
+
+	// TolerantDumper is implemented by the dumpers that can load the other
+	// users when some users can not be loaded
+	TolerantDumper[T any] interface {
+		// LoadWithFailures loads the data like Dumper.Load, and returns the
+		// users that can not be loaded
+		LoadWithFailures(ctx context.Context, permanentKey string, out *map[UID]DataMap[T], opt LoadOptions) ([]LoadFailure, error)
+	}
+)
+
+// blocks returns true if the stored payload of the user is still there, so
+// the user must not be accessed, or its payload would be overwritten
+func (f LoadFailure) blocks() bool {
+	return f.QuarantineKey == "" && !errors.Is(f.Err, ErrUserNotFound)
+}
+
+// LoadFailures returns the users that failed to be loaded by the last Load,
+// and are neither repaired nor purged yet, in ascending order of uid. the
+// users whose payloads are still stored are unavailable, ErrUserUnavailable
+// is returned when accessing them
+func (s *InMemoryStorage[TData]) LoadFailures() []LoadFailure {
+	// lock the mutex
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ret := make([]LoadFailure, 0)
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for _, f := range sh.failed {
+			ret = append(ret, f)
+		}
+		sh.mu.RUnlock()
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].User < ret[j].User })
+	return ret
+}
+
+// RepairUser loads a user that failed to be loaded by Load from the Dumper
+// again, the user is available once it is loaded, or its payload is gone
+func (s *InMemoryStorage[TData]) RepairUser(ctx context.Context, user UID) error {
+	// validate input
+	if user == "" {
+		return fmt.Errorf("%w, user cannot be empty", ErrInvalidUser)
+	}
+	// if the dumper is not set, return an error
+	if s.Dumper == nil {
+		return fmt.Errorf("%w, dumper is not set", ErrStatusError)
+	}
+	sh := s.shardOf(user)
+	unlock := s.rlockUser(user)
+	_, failed := sh.failed[user]
+	unlock()
+	if !failed {
+		return nil
+	}
+
+	r, err := s.Dumper.LoadUser(ctx, s.PersistentKey, user)
+	removed := errors.Is(err, ErrUserNotFound)
+	if err != nil && !removed {
+		return fmt.Errorf("failed to repair user %s from permanent storage, err: %w", user, err)
+	}
+	var meta map[UID]MetaMap
+	if !removed {
+		if meta, err = s.loadMeta(ctx, []UID{user}); err != nil {
+			return fmt.Errorf("failed to repair metadata of user %s from permanent storage, err: %w", user, err)
+		}
+	}
+
+	// the repaired user may exceed the capacity, check it after unlocking
+	defer s.evictIfNeeded()
+	// lock the user
+	unlock = s.lockUser(user)
+	defer unlock()
+
+	// the user is purged during the fetch
+	if _, failed = sh.failed[user]; !failed {
+		return nil
+	}
+	if !removed {
+		if r == nil {
+			r = make(DataMap[TData])
+		}
+		sh.data[user] = r
+		if m, ok := meta[user]; ok {
+			sh.meta[user] = m
+		}
+		s.raiseWriteSeqByMeta(meta)
+		s.indexUserLocked(user)
+		s.resize(user)
+	}
+	s.clearFailureLocked(user)
+	return nil
+}
+
+// checkAvailable returns ErrUserUnavailable if the user failed to be loaded
+// and its payload is still stored
+func (s *InMemoryStorage[TData]) checkAvailable(user UID) error {
+	if s.failedCount.Load() == 0 {
+		return nil
+	}
+	unlock := s.rlockUser(user)
+	defer unlock()
+
+	return s.checkAvailableLocked(user)
+}
+
+// checkAvailableLocked is checkAvailable, the caller must hold the lock of the user
+func (s *InMemoryStorage[TData]) checkAvailableLocked(user UID) error {
+	if f, ok := s.shardOf(user).failed[user]; ok && f.blocks() {
+		return fmt.Errorf("%w, user: %s, repair or purge it first, err: %v", ErrUserUnavailable, user, f.Err)
+	}
+	return nil
+}
+
+// setFailuresLocked replaces the failures of the users by the ones of a Load,
+// the caller must hold the storage lock for writing
+func (s *InMemoryStorage[TData]) setFailuresLocked(failures []LoadFailure) {
+	for _, sh := range s.shards {
+		sh.failed = make(map[UID]LoadFailure)
+	}
+	for _, f := range failures {
+		s.shardOf(f.User).failed[f.User] = f
+	}
+	s.failedCount.Store(int64(len(failures)))
+}
+
+// clearFailureLocked forgets the failure of the user, the caller must hold
+// the write lock of the user
+func (s *InMemoryStorage[TData]) clearFailureLocked(user UID) {
+	sh := s.shardOf(user)
+	if _, ok := sh.failed[user]; ok {
+		delete(sh.failed, user)
+		s.failedCount.Add(-1)
+	}
+}
+
+// loadDataLocked loads the data from the Dumper, and records the users that
+// can not be loaded if the Dumper is a TolerantDumper. the caller must hold
+// the storage lock for writing
+func (s *InMemoryStorage[TData]) loadDataLocked(ctx context.Context, data *map[UID]DataMap[TData]) error {
+	failures, err := s.loadWithFailuresLocked(ctx, data)
+	if err != nil {
+		return err
+	}
+	s.setFailuresLocked(failures)
+	return nil
+}
+
+// loadWithFailuresLocked loads the data from the Dumper, and returns the
+// users that can not be loaded if the Dumper is a TolerantDumper. the caller
+// must hold the storage lock for writing
+func (s *InMemoryStorage[TData]) loadWithFailuresLocked(ctx context.Context, data *map[UID]DataMap[TData]) ([]LoadFailure, error) {
+	td, ok := s.Dumper.(TolerantDumper[TData])
+	if !ok {
+		return nil, s.Dumper.Load(ctx, s.PersistentKey, data)
+	}
+	var opt LoadOptions
+	if s.Lease != nil {
+		fence, err := s.Lease.verify(ctx)
+		if err != nil {
+			return nil, err
+		}
+		opt.Fence = fence
+	}
+	failures, err := td.LoadWithFailures(ctx, s.PersistentKey, data, opt)
+	if opt.Fence != nil && errors.Is(err, ErrLeaseLost) {
+		s.Lease.markLost(opt.Fence)
+	}
+	return failures, err
+}
@@ -0,0 +1,95 @@
+package memstore_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/khgame/memstore"
+	"github.com/khgame/memstore/dumper"
+	"github.com/stretchr/testify/assert"
+)
+
+// createSkippingStorage returns a storage saved with uid001 and uid002, whose
+// dumper skips the users that can not be loaded, and the stored payload of
+// uid002 corrupted
+func createSkippingStorage(t *testing.T, policy dumper.LoadPolicy) (*memstore.InMemoryStorage[TestDataType], string) {
+	ctx := context.Background()
+	dp := createCacheDumper[TestDataType]().(*dumper.CacheDumper[TestDataType])
+	dp.Checksum = true
+	dp.LoadPolicy = policy
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = dp
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: 1}))
+	assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "res001", Quantity: 2}))
+	assert.NoError(t, storage.Save(ctx))
+
+	key := dumper.SchemeMemStoreSaving.Make("test_storage", "uid002")
+	raw := []byte(dp.Cache.Get(ctx, key).Val())
+	raw[len(raw)-2] ^= 0xff
+	assert.NoError(t, dp.Cache.Set(ctx, key, raw, 0).Err())
+
+	loaded := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	loaded.Dumper = dp
+	assert.NoError(t, loaded.Load(ctx))
+	return loaded, string(raw)
+}
+
+// Test_InMemStorage_LoadFailures tests that the users skipped by Load are reported, and kept from being overwritten
+func Test_InMemStorage_LoadFailures(t *testing.T) {
+	ctx := context.Background()
+	storage, corrupted := createSkippingStorage(t, dumper.LoadSkip)
+	dp := storage.Dumper.(*dumper.CacheDumper[TestDataType])
+	key := dumper.SchemeMemStoreSaving.Make("test_storage", "uid002")
+
+	// the skipped user is reported
+	failures := storage.LoadFailures()
+	assert.Equal(t, 1, len(failures))
+	assert.Equal(t, memstore.UID("uid002"), failures[0].User)
+	assert.ErrorIs(t, failures[0].Err, dumper.ErrChecksumMismatch)
+
+	// the other users are available
+	out := TestDataType{Name: "res001"}
+	assert.NoError(t, storage.Get("uid001", &out))
+	assert.Equal(t, int64(1), out.Quantity)
+
+	// the skipped user is unavailable, and its payload is kept
+	assert.ErrorIs(t, storage.Get("uid002", &out), memstore.ErrUserUnavailable)
+	assert.ErrorIs(t, storage.Set("uid002", &TestDataType{Name: "res001", Quantity: 3}), memstore.ErrUserUnavailable)
+	assert.ErrorIs(t, storage.Delete("uid002", "res001"), memstore.ErrUserUnavailable)
+	assert.NoError(t, storage.Save(ctx))
+	assert.Equal(t, corrupted, dp.Cache.Get(ctx, key).Val())
+
+	// the repair fails until the payload is fixed
+	assert.Error(t, storage.RepairUser(ctx, "uid002"))
+	assert.Equal(t, 1, len(storage.LoadFailures()))
+	raw := []byte(corrupted)
+	raw[len(raw)-2] ^= 0xff
+	assert.NoError(t, dp.Cache.Set(ctx, key, raw, 0).Err())
+	assert.NoError(t, storage.RepairUser(ctx, "uid002"))
+	assert.Empty(t, storage.LoadFailures())
+	assert.NoError(t, storage.Get("uid002", &out))
+	assert.Equal(t, int64(2), out.Quantity)
+
+	// the purged user is available again
+	storage, _ = createSkippingStorage(t, dumper.LoadSkip)
+	assert.Equal(t, 1, len(storage.LoadFailures()))
+	assert.NoError(t, storage.Purge("uid002"))
+	assert.Empty(t, storage.LoadFailures())
+	assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "res001", Quantity: 3}))
+	assert.NoError(t, storage.Get("uid002", &out))
+	assert.Equal(t, int64(3), out.Quantity)
+}
+
+// Test_InMemStorage_LoadFailuresQuarantined tests that the quarantined users are reported, but available
+func Test_InMemStorage_LoadFailuresQuarantined(t *testing.T) {
+	storage, _ := createSkippingStorage(t, dumper.LoadQuarantine)
+
+	failures := storage.LoadFailures()
+	assert.Equal(t, 1, len(failures))
+	assert.Equal(t, dumper.SchemeMemStoreQuarantine.Make("test_storage", "uid002"), failures[0].QuarantineKey)
+
+	out := TestDataType{Name: "res001"}
+	assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "res001", Quantity: 3}))
+	assert.NoError(t, storage.Get("uid002", &out))
+	assert.Equal(t, int64(3), out.Quantity)
+}
@@ -0,0 +1,471 @@
+package memstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bagaking/goulp/jsonex"
+)
+
+const (
+	// JournalSyncEveryWrite flushes and fsyncs the journal on every mutation
+	JournalSyncEveryWrite JournalSyncPolicy = iota
+	// JournalSyncGroup buffers the mutations, and flushes and fsyncs them
+	// together every GroupCommitInterval
+	JournalSyncGroup
+	// JournalSyncNone buffers the mutations and flushes them to the OS every
+	// GroupCommitInterval without fsync, it survives a process crash but
+	// not a machine crash
+	JournalSyncNone
+)
+
+// DefaultGroupCommitInterval is the group commit interval of a journal if it is not specified
+const DefaultGroupCommitInterval = 10 * time.Millisecond
+
+const (
+	journalOpSet   = "set"
+	journalOpDel   = "del"
+	journalOpPurge = "purge"
+	journalOpTxn   = "txn"
+)
+
+var (
+	// ErrJournalClosed is returned when writing to a closed journal
+	ErrJournalClosed = fmt.Errorf("journal closed")
+	// ErrJournalCorrupted is returned when a record in the middle of the journal can not be decoded
+	ErrJournalCorrupted = fmt.Errorf("journal corrupted")
+)
+
+type (
+	// JournalSyncPolicy defines when the journal is flushed and fsynced
+	JournalSyncPolicy int
+
+	// JournalOptions configures a journal
+	JournalOptions struct {
+		// Sync is the flush and fsync policy
+		Sync JournalSyncPolicy
+		// GroupCommitInterval is the flush period of JournalSyncGroup and JournalSyncNone,
+		// DefaultGroupCommitInterval is used when it is not positive
+		GroupCommitInterval time.Duration
+	}
+
+	// Journal is an append-only local file of the mutations of an InMemoryStorage,
+	// it is replayed by Load on top of the Dumper snapshot, and the mutations
+	// saved by a successful Save are dropped from it
+	Journal[T any] struct {
+		opt JournalOptions
+
+		mu   sync.Mutex
+		path string
+		file *os.File
+		w    *bufio.Writer
+		// size is the length of the records written, including the buffered ones
+		size   int64
+		closed bool
+		err    error
+
+		stop chan struct{}
+		done chan struct{}
+	}
+
+	// journalRecord is a mutation in the journal
+	journalRecord[T any] struct {
+		Op        string `json:"op"`
+		User      UID    `json:"user"`
+		StoreName string `json:"store,omitempty"`
+		Value     *T     `json:"value,omitempty"`
+		ExpireAt  int64  `json:"expire_at,omitempty"`
+		Version   uint64 `json:"version,omitempty"`
+		// Ops is the set and del records of a transaction, they are applied
+		// all together. User is empty if the transaction changes several users
+		Ops []journalRecord[T] `json:"ops,omitempty"`
+	}
+)
+
+// OpenJournal opens or creates the journal file at path, the existing
+// records are kept so that they can be replayed
+func OpenJournal[T any](path string, opt JournalOptions) (*Journal[T], error) {
+	if opt.GroupCommitInterval <= 0 {
+		opt.GroupCommitInterval = DefaultGroupCommitInterval
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open journal %s error: %w", path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("stat journal %s error: %w", path, err)
+	}
+	j := &Journal[T]{
+		opt:  opt,
+		path: path,
+		file: file,
+		w:    bufio.NewWriter(file),
+		size: info.Size(),
+	}
+	if opt.Sync != JournalSyncEveryWrite {
+		j.stop, j.done = make(chan struct{}), make(chan struct{})
+		go j.runGroupCommit()
+	}
+	return j, nil
+}
+
+// runGroupCommit flushes the buffered records periodically
+func (j *Journal[T]) runGroupCommit() {
+	defer close(j.done)
+
+	ticker := time.NewTicker(j.opt.GroupCommitInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-ticker.C:
+			j.mu.Lock()
+			if !j.closed {
+				j.err = j.syncLocked(j.opt.Sync == JournalSyncGroup)
+			}
+			j.mu.Unlock()
+		}
+	}
+}
+
+// syncLocked flushes the buffer, and fsyncs the file if fsync is true
+func (j *Journal[T]) syncLocked(fsync bool) error {
+	if j.w.Buffered() == 0 {
+		return nil
+	}
+	if err := j.w.Flush(); err != nil {
+		return err
+	}
+	if fsync {
+		return j.file.Sync()
+	}
+	return nil
+}
+
+// Sync flushes and fsyncs the buffered records
+func (j *Journal[T]) Sync() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return ErrJournalClosed
+	}
+	return j.syncLocked(true)
+}
+
+// Close flushes the buffered records and closes the file
+func (j *Journal[T]) Close() error {
+	j.mu.Lock()
+	if j.closed {
+		j.mu.Unlock()
+		return nil
+	}
+	j.closed = true
+	err := j.syncLocked(true)
+	j.mu.Unlock()
+
+	if j.stop != nil {
+		close(j.stop)
+		<-j.done
+	}
+	if errClose := j.file.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+// append writes a record to the journal according to the sync policy
+func (j *Journal[T]) append(rec journalRecord[T]) error {
+	line, err := jsonex.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("marshal journal record error: %w", err)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return ErrJournalClosed
+	}
+	// a failed group commit is reported by the next append
+	if j.err != nil {
+		err, j.err = j.err, nil
+		return fmt.Errorf("write journal error: %w", err)
+	}
+	n, err := j.w.Write(append(line, '\n'))
+	j.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write journal error: %w", err)
+	}
+	if j.opt.Sync == JournalSyncEveryWrite {
+		if err = j.syncLocked(true); err != nil {
+			return fmt.Errorf("sync journal error: %w", err)
+		}
+	}
+	return nil
+}
+
+// offset returns the end of the records written so far, it is the
+// checkpoint of the records taken in a snapshot
+func (j *Journal[T]) offset() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.size
+}
+
+// checkpoint drops the records before offset, they are saved. the records
+// after offset are written since the snapshot, they are kept in a new file
+// which replaces the journal atomically
+func (j *Journal[T]) checkpoint(offset int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return ErrJournalClosed
+	}
+	if err := j.syncLocked(false); err != nil {
+		return fmt.Errorf("flush journal error: %w", err)
+	}
+	j.err = nil
+
+	// nothing is written since the snapshot, truncate the file in place
+	if offset >= j.size {
+		if err := j.file.Truncate(0); err != nil {
+			return fmt.Errorf("truncate journal error: %w", err)
+		}
+		j.size = 0
+		return j.file.Sync()
+	}
+
+	tail := make([]byte, j.size-offset)
+	if _, err := j.file.ReadAt(tail, offset); err != nil {
+		return fmt.Errorf("read journal error: %w", err)
+	}
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, tail, 0o644); err != nil {
+		return fmt.Errorf("write journal error: %w", err)
+	}
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open journal error: %w", err)
+	}
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("sync journal error: %w", err)
+	}
+	// the old file is kept if the rename is lost by a crash, replaying it
+	// again changes nothing
+	if err = os.Rename(tmp, j.path); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("replace journal error: %w", err)
+	}
+	_ = j.file.Close()
+	j.file, j.size = file, int64(len(tail))
+	j.w.Reset(file)
+	return nil
+}
+
+// replay reads all the records in order, a broken record at the tail is the
+// partial write of a crash, it is ignored and cut off from the file
+func (j *Journal[T]) replay(fn func(rec journalRecord[T]) error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return ErrJournalClosed
+	}
+	if err := j.syncLocked(false); err != nil {
+		return err
+	}
+	f, err := os.Open(j.path)
+	if err != nil {
+		return fmt.Errorf("open journal error: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	offset := int64(0)
+	for n := 1; ; n++ {
+		line, errRead := r.ReadBytes('\n')
+		if errRead != nil && !errors.Is(errRead, io.EOF) {
+			return fmt.Errorf("read journal error: %w", errRead)
+		}
+		// the last line is not terminated, it is a partial write
+		if errRead != nil && len(line) > 0 {
+			if err = j.file.Truncate(offset); err != nil {
+				return fmt.Errorf("truncate journal error: %w", err)
+			}
+			j.size = offset
+			return nil
+		}
+		offset += int64(len(line))
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			var rec journalRecord[T]
+			if err = jsonex.Unmarshal(line, &rec); err != nil {
+				return fmt.Errorf("%w, line %d: %v", ErrJournalCorrupted, n, err)
+			}
+			if err = fn(rec); err != nil {
+				return err
+			}
+		}
+		if errRead != nil {
+			return nil
+		}
+	}
+}
+
+// users returns the users changed by the record, a transaction may change several users
+func (rec journalRecord[T]) users() []UID {
+	if rec.Op != journalOpTxn || rec.User != "" {
+		return []UID{rec.User}
+	}
+	users := make([]UID, 0, 1)
+	for _, op := range rec.Ops {
+		if len(users) == 0 || users[len(users)-1] != op.User {
+			users = append(users, op.User)
+		}
+	}
+	return users
+}
+
+// journalLocked writes ahead a mutation to the journal if it is set,
+// the caller must hold the write lock
+func (s *InMemoryStorage[TData]) journalLocked(rec journalRecord[TData]) error {
+	if s.Journal == nil {
+		return nil
+	}
+	return s.Journal.append(rec)
+}
+
+// checkpointCleanJournal drops all the records of the journal if no user is
+// dirty, since the mutations journaled are all saved then. the caller must
+// hold saveMu, so that it does not race with the checkpoint of Save
+func (s *InMemoryStorage[TData]) checkpointCleanJournal() error {
+	if s.Journal == nil {
+		return nil
+	}
+	// lock the mutex
+	s.mu.Lock()
+	clean, offset := !s.IsDirty(), s.Journal.offset()
+	s.mu.Unlock()
+
+	if !clean || offset == 0 {
+		return nil
+	}
+	return s.Journal.checkpoint(offset)
+}
+
+// replayJournalLocked applies the journal on top of the loaded data, and
+// marks the replayed users dirty. the caller must hold the write lock
+func (s *InMemoryStorage[TData]) replayJournalLocked(ctx context.Context) error {
+	if s.Journal == nil {
+		return nil
+	}
+	err := s.Journal.replay(func(rec journalRecord[TData]) error {
+		for _, user := range rec.users() {
+			// the records can not be applied on a user that failed to be loaded
+			if err := s.checkAvailableLocked(user); err != nil && rec.Op != journalOpPurge {
+				return err
+			}
+			if err := s.replayLoadUserLocked(ctx, user); err != nil {
+				return err
+			}
+			s.markDirty(user)
+		}
+		return s.applyJournalLocked(rec)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to replay journal, err: %w", err)
+	}
+	return nil
+}
+
+// applyJournalLocked applies a record to the data, the caller must hold the write lock
+func (s *InMemoryStorage[TData]) applyJournalLocked(rec journalRecord[TData]) error {
+	switch rec.Op {
+	case journalOpSet:
+		if rec.Value == nil {
+			return fmt.Errorf("%w, set without value, user: %s", ErrJournalCorrupted, rec.User)
+		}
+		r := s.userDataLocked(rec.User)
+		r[rec.StoreName] = *rec.Value
+		s.setMetaLocked(rec.User, rec.StoreName, ResourceMeta{ExpireAt: rec.ExpireAt, Version: rec.Version})
+		s.raiseWriteSeq(rec.Version)
+	case journalOpDel:
+		if r, ok := s.writableLocked(rec.User); ok {
+			delete(r, rec.StoreName)
+		}
+		s.setMetaLocked(rec.User, rec.StoreName, ResourceMeta{})
+	case journalOpPurge:
+		sh := s.shardOf(rec.User)
+		delete(sh.data, rec.User)
+		delete(sh.meta, rec.User)
+		s.clearFailureLocked(rec.User)
+		s.purgeEpoch.Add(1)
+	case journalOpTxn:
+		for _, op := range rec.Ops {
+			if op.Op != journalOpSet && op.Op != journalOpDel {
+				return fmt.Errorf("%w, unknown op %q in transaction", ErrJournalCorrupted, op.Op)
+			}
+			if op.User == "" {
+				op.User = rec.User
+			}
+			if err := s.applyJournalLocked(op); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w, unknown op %q", ErrJournalCorrupted, rec.Op)
+	}
+	s.resize(rec.User)
+	return nil
+}
+
+// replayLoadUserLocked loads a user that is not in memory before its records
+// are replayed, in case the users are loaded on demand
+func (s *InMemoryStorage[TData]) replayLoadUserLocked(ctx context.Context, user UID) error {
+	if !s.LazyLoad && !s.Capacity.enabled() {
+		return nil
+	}
+	sh := s.shardOf(user)
+	if _, loaded := sh.data[user]; loaded {
+		return nil
+	}
+	// the user is purged by a previous record
+	if _, dirty := sh.dirty[user]; dirty {
+		return nil
+	}
+	r, err := s.Dumper.LoadUser(ctx, s.PersistentKey, user)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load user %s from permanent storage, err: %w", user, err)
+	}
+	meta, err := s.loadMeta(ctx, []UID{user})
+	if err != nil {
+		return fmt.Errorf("failed to load metadata of user %s from permanent storage, err: %w", user, err)
+	}
+	if r == nil {
+		r = make(DataMap[TData])
+	}
+	sh.data[user] = r
+	if m, ok := meta[user]; ok {
+		sh.meta[user] = m
+	}
+	s.raiseWriteSeqByMeta(meta)
+	return nil
+}
@@ -0,0 +1,227 @@
+package memstore_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/khgame/memstore"
+	"github.com/khgame/memstore/dumper"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_InMemStorage_JournalReplay tests that the mutations after the last save are replayed by Load
+func Test_InMemStorage_JournalReplay(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test_storage.journal")
+	journal, err := memstore.OpenJournal[TestDataType](path, memstore.JournalOptions{})
+	assert.NoError(t, err)
+
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = createCacheDumper[TestDataType]()
+	storage.Journal = journal
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: 1}))
+	assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "res001", Quantity: 2}))
+	assert.NoError(t, storage.Set("uid003", &TestDataType{Name: "res001", Quantity: 3}))
+	assert.NoError(t, storage.Save(ctx))
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+
+	// the mutations after the save
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res002", Quantity: 10}))
+	assert.NoError(t, storage.Update("uid001", "res001", func(org *TestDataType) (*TestDataType, error) {
+		org.Quantity += 100
+		return org, nil
+	}))
+	assert.NoError(t, storage.SetWithTTL("uid002", &TestDataType{Name: "buff", Quantity: 1}, time.Hour))
+	assert.NoError(t, storage.Delete("uid002", "res001"))
+	assert.NoError(t, storage.Purge("uid003"))
+	assert.NoError(t, storage.Set("uid004", &TestDataType{Name: "res001", Quantity: 4}))
+
+	// crash without saving
+	assert.NoError(t, journal.Close())
+
+	for _, lazy := range []bool{false, true} {
+		journal, err = memstore.OpenJournal[TestDataType](path, memstore.JournalOptions{})
+		assert.NoError(t, err)
+		storage2 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+		storage2.Dumper = storage.Dumper
+		storage2.Journal = journal
+		storage2.LazyLoad = lazy
+		assert.NoError(t, storage2.Load(ctx))
+		assert.Equal(t, []memstore.UID{"uid001", "uid002", "uid003", "uid004"}, storage2.DirtyUsers())
+
+		data := TestDataType{Name: "res001"}
+		assert.NoError(t, storage2.Get("uid001", &data))
+		assert.Equal(t, int64(101), data.Quantity)
+		resources, err := storage2.List("uid002")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"buff"}, resources)
+		expireAt, err := storage2.GetExpiry("uid002", "buff")
+		assert.NoError(t, err)
+		assert.False(t, expireAt.IsZero())
+		_, err = storage2.List("uid003")
+		assert.ErrorIs(t, err, memstore.ErrUserNotFound)
+		data = TestDataType{Name: "res001"}
+		assert.NoError(t, storage2.Get("uid004", &data))
+		assert.Equal(t, int64(4), data.Quantity)
+		assert.NoError(t, journal.Close())
+	}
+
+	// the replayed storage is saved, and the journal is truncated
+	journal, err = memstore.OpenJournal[TestDataType](path, memstore.JournalOptions{})
+	assert.NoError(t, err)
+	defer journal.Close()
+	storage3 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage3.Dumper = storage.Dumper
+	storage3.Journal = journal
+	assert.NoError(t, storage3.Load(ctx))
+	assert.NoError(t, storage3.Save(ctx))
+	info, err = os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+}
+
+// Test_InMemStorage_JournalReplayBeforeFirstSave tests that the mutations are replayed when nothing is saved yet
+func Test_InMemStorage_JournalReplayBeforeFirstSave(t *testing.T) {
+	ctx := context.Background()
+	dumpers := map[string]memstore.Dumper[TestDataType]{
+		"cache": createCacheDumper[TestDataType](),
+		"file":  dumper.CreateFileDumper[TestDataType](t.TempDir()),
+	}
+	for name, dp := range dumpers {
+		path := filepath.Join(t.TempDir(), "test_storage.journal")
+		journal, err := memstore.OpenJournal[TestDataType](path, memstore.JournalOptions{})
+		assert.NoError(t, err)
+		storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+		storage.Dumper = dp
+		storage.Journal = journal
+		assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: 1}))
+		assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "res001", Quantity: 2}))
+
+		// crash before the first save
+		assert.NoError(t, journal.Close())
+
+		journal, err = memstore.OpenJournal[TestDataType](path, memstore.JournalOptions{})
+		assert.NoError(t, err)
+		storage2 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+		storage2.Dumper = dp
+		storage2.Journal = journal
+		assert.NoError(t, storage2.Load(ctx), name)
+		assert.Equal(t, []memstore.UID{"uid001", "uid002"}, storage2.DirtyUsers(), name)
+		data := TestDataType{Name: "res001"}
+		assert.NoError(t, storage2.Get("uid002", &data), name)
+		assert.Equal(t, int64(2), data.Quantity, name)
+		assert.NoError(t, storage2.Save(ctx), name)
+		assert.NoError(t, journal.Close())
+	}
+}
+
+// Test_InMemStorage_JournalWriteBack tests that the journal is checkpointed when the write-backs make every user clean
+func Test_InMemStorage_JournalWriteBack(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test_storage.journal")
+	journal, err := memstore.OpenJournal[TestDataType](path, memstore.JournalOptions{})
+	assert.NoError(t, err)
+	defer journal.Close()
+
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = createCacheDumper[TestDataType]()
+	storage.Journal = journal
+	storage.Capacity = memstore.Capacity[TestDataType]{MaxUsers: 1}
+	size := func() int64 {
+		assert.NoError(t, journal.Sync())
+		info, err := os.Stat(path)
+		assert.NoError(t, err)
+		return info.Size()
+	}
+
+	// uid001 is written back when uid002 is set, uid002 is still dirty
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: 1}))
+	assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "res001", Quantity: 2}))
+	assert.Equal(t, uint64(1), storage.CapacityStats().WriteBacks)
+	assert.Greater(t, size(), int64(0))
+
+	// uid002 is written back when uid001 is loaded back, no user is dirty then
+	data := TestDataType{Name: "res001"}
+	assert.NoError(t, storage.Get("uid001", &data))
+	assert.Equal(t, uint64(2), storage.CapacityStats().WriteBacks)
+	assert.False(t, storage.IsDirty())
+	assert.Equal(t, int64(0), size())
+	assert.NoError(t, storage.Save(ctx))
+}
+
+// Test_Journal_BrokenRecords tests that a partial tail is cut off, and a broken record in the middle is reported
+func Test_Journal_BrokenRecords(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test_storage.journal")
+	journal, err := memstore.OpenJournal[TestDataType](path, memstore.JournalOptions{})
+	assert.NoError(t, err)
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = createCacheDumper[TestDataType]()
+	storage.Journal = journal
+	assert.NoError(t, storage.Set("uid000", &TestDataType{Name: "res001", Quantity: 0}))
+	assert.NoError(t, storage.Save(ctx))
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: 1}))
+	assert.NoError(t, journal.Close())
+
+	// a crash in the middle of a write
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	assert.NoError(t, err)
+	_, err = f.WriteString(`{"op":"set","user":"uid0`)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	journal, err = memstore.OpenJournal[TestDataType](path, memstore.JournalOptions{})
+	assert.NoError(t, err)
+	storage2 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage2.Dumper = storage.Dumper
+	storage2.Journal = journal
+	assert.NoError(t, storage2.Load(ctx))
+	assert.Equal(t, []memstore.UID{"uid001"}, storage2.DirtyUsers())
+
+	// the next record is appended after the last complete one
+	assert.NoError(t, storage2.Set("uid002", &TestDataType{Name: "res001", Quantity: 2}))
+	assert.NoError(t, journal.Close())
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"op":"set","user":"uid001","store":"res001","value":{"Name":"res001","Quantity":1},"version":2}
+{"op":"set","user":"uid002","store":"res001","value":{"Name":"res001","Quantity":2},"version":3}
+`, string(content))
+
+	// a broken record in the middle
+	assert.NoError(t, os.WriteFile(path, []byte("{broken}\n"+string(content)), 0o644))
+	journal, err = memstore.OpenJournal[TestDataType](path, memstore.JournalOptions{})
+	assert.NoError(t, err)
+	defer journal.Close()
+	storage3 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage3.Dumper = storage.Dumper
+	storage3.Journal = journal
+	assert.ErrorIs(t, storage3.Load(ctx), memstore.ErrJournalCorrupted)
+}
+
+// Test_Journal_GroupCommit tests that the buffered records are flushed by the group commit
+func Test_Journal_GroupCommit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test_storage.journal")
+	journal, err := memstore.OpenJournal[TestDataType](path, memstore.JournalOptions{
+		Sync:                memstore.JournalSyncGroup,
+		GroupCommitInterval: 10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Journal = journal
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: 1}))
+	assert.Eventually(t, func() bool {
+		info, err := os.Stat(path)
+		return err == nil && info.Size() > 0
+	}, time.Second, 5*time.Millisecond)
+
+	assert.NoError(t, journal.Close())
+	assert.ErrorIs(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: 2}), memstore.ErrJournalClosed)
+	data := TestDataType{Name: "res001"}
+	assert.NoError(t, storage.Get("uid001", &data))
+	assert.Equal(t, int64(1), data.Quantity)
+}
@@ -0,0 +1,288 @@
+package memstore
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/khgame/memstore/cache"
+	"github.com/khgame/memstore/cachekey"
+)
+
+var (
+	// ErrLeaseHeld is returned by Load when the lease of the storage is held
+	// by another owner
+	ErrLeaseHeld = fmt.Errorf("lease held by another owner")
+	// ErrLeaseLost is returned by Save when the lease of the storage has
+	// expired or been taken over by another owner
+	ErrLeaseLost = fmt.Errorf("lease lost")
+)
+
+const (
+	// SchemeLease is the key of the ownership lease of a storage, its value
+	// is the owner and the fencing token of the holder
+	SchemeLease cachekey.KeyFormat = "store_lease:%s"
+	// SchemeLeaseFence is the key of the counter that issues the fencing tokens
+	SchemeLeaseFence cachekey.KeyFormat = "store_lease_fence:%s"
+
+	// defaultLeaseTTL is the TTL of a lease created without one
+	defaultLeaseTTL = 10 * time.Second
+)
+
+var (
+	// acquireScript sets the lease with a new fencing token if no one holds
+	// it, and returns the token. the value of the holder is returned otherwise
+	acquireScript = redis.NewScript(`
+local cur = redis.call('GET', KEYS[1])
+if cur then
+	return cur
+end
+local token = redis.call('INCR', KEYS[2])
+redis.call('SET', KEYS[1], ARGV[1] .. '#' .. token, 'PX', ARGV[2])
+return token
+`)
+	// renewScript extends the lease if it is still held with the token,
+	// 0 is returned otherwise
+	renewScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+	// releaseScript deletes the lease if it is still held with the token
+	releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+)
+
+type (
+	// Lease is the ownership lease of a storage kept in redis, which makes
+	// sure only one instance saves a PersistentKey at a time. Load acquires
+	// it, a background loop renews it, and Save verifies it before writing
+	// to the Dumper. each acquisition gets a fencing token larger than all
+	// the previous ones. the writes of a ChangeDumper are fenced by it, so
+	// that they are dropped if the lease is lost after the verification
+	Lease struct {
+		// Cache is where the lease is kept. the writes of a dumper are fenced
+		// only if the dumper writes through the same *cache.Cache, the others
+		// rely on the verification of the lease before the write
+		Cache *cache.Cache
+		// Owner identifies the instance, such as the host name and the pid
+		Owner string
+		// TTL is how long the lease is kept without being renewed, the
+		// renewal runs every third of it
+		TTL time.Duration
+
+		// mu protects the following fields
+		mu sync.Mutex
+		// key is the key of the lease, empty if it is not acquired
+		key string
+		// token is the fencing token of the acquisition
+		token int64
+		// lost is set once the lease is found lost
+		lost bool
+		// stop stops the renewal loop, nil if it is not running
+		stop chan struct{}
+	}
+
+	// Fence identifies the holder of a Lease, the writes fenced by it are
+	// made only while the lease is still held by the holder
+	Fence struct {
+		// Key is the key of the lease
+		Key string
+		// Value is the value of the lease while it is held by the holder
+		Value string
+		// Token is the fencing token of the holder
+		Token int64
+		// Cache is where the lease is kept, the dumpers writing to another
+		// client can not fence their writes by the lease
+		Cache *cache.Cache
+	}
+)
+
+// NewLease creates a lease kept in c for the given owner, a non-positive
+// ttl means the default TTL of 10 seconds
+func NewLease(c *cache.Cache, owner string, ttl time.Duration) *Lease {
+	if ttl <= 0 {
+		ttl = defaultLeaseTTL
+	}
+	return &Lease{
+		Cache: c,
+		Owner: owner,
+		TTL:   ttl,
+	}
+}
+
+// Token returns the fencing token of the lease, zero if it is not held
+func (l *Lease) Token() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.key == "" || l.lost {
+		return 0
+	}
+	return l.token
+}
+
+// Held returns true if the lease is acquired and not found lost
+func (l *Lease) Held() bool {
+	return l.Token() != 0
+}
+
+// value returns the value of the lease in redis, the caller must hold the mutex
+func (l *Lease) value() string {
+	return l.Owner + "#" + strconv.FormatInt(l.token, 10)
+}
+
+// acquire acquires the lease of the persistent key and starts the renewal,
+// a lease that is already held is verified instead
+func (l *Lease) acquire(ctx context.Context, persistentKey string) error {
+	// validate input
+	if l.Cache == nil {
+		return fmt.Errorf("%w, lease cache is not set", ErrStatusError)
+	}
+	if l.Owner == "" {
+		return fmt.Errorf("%w, lease owner cannot be empty", ErrInvalidInput)
+	}
+	// lock the mutex
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := SchemeLease.Make(persistentKey)
+	if l.key == key && !l.lost {
+		return l.renewLocked(ctx)
+	}
+	l.stopLocked()
+
+	res, err := acquireScript.Run(ctx, l.Cache, []string{key, SchemeLeaseFence.Make(persistentKey)},
+		l.Owner, l.TTL.Milliseconds()).Result()
+	if err != nil {
+		return fmt.Errorf("failed to acquire lease, key: %s, err: %w", key, err)
+	}
+	token, ok := res.(int64)
+	if !ok {
+		return fmt.Errorf("%w, key: %s, holder: %v", ErrLeaseHeld, key, res)
+	}
+	l.key, l.token, l.lost = key, token, false
+	l.stop = make(chan struct{})
+	go l.runRenewal(l.stop)
+	return nil
+}
+
+// verify extends the lease atomically if it is still held with the token,
+// so that the following writes are made within the TTL, and returns the
+// fence of the holder. ErrLeaseLost is returned otherwise
+func (l *Lease) verify(ctx context.Context) (*Fence, error) {
+	// lock the mutex
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.renewLocked(ctx); err != nil {
+		return nil, err
+	}
+	return &Fence{Key: l.key, Value: l.value(), Token: l.token, Cache: l.Cache}, nil
+}
+
+// markLost marks the lease lost, it is called when a fenced write finds the
+// lease held by another owner
+func (l *Lease) markLost(fence *Fence) {
+	// lock the mutex
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.key == fence.Key && l.token == fence.Token {
+		l.lost = true
+		l.stopLocked()
+	}
+}
+
+// renewLocked extends the lease, the lease is marked lost if it is not held
+// with the token anymore. the caller must hold the mutex
+func (l *Lease) renewLocked(ctx context.Context) error {
+	if l.key == "" {
+		return fmt.Errorf("%w, lease is not acquired", ErrLeaseLost)
+	}
+	if l.lost {
+		return fmt.Errorf("%w, key: %s, token: %d", ErrLeaseLost, l.key, l.token)
+	}
+	ok, err := renewScript.Run(ctx, l.Cache, []string{l.key}, l.value(), l.TTL.Milliseconds()).Int64()
+	if err != nil {
+		return fmt.Errorf("failed to renew lease, key: %s, err: %w", l.key, err)
+	}
+	if ok == 0 {
+		l.lost = true
+		return fmt.Errorf("%w, key: %s, token: %d", ErrLeaseLost, l.key, l.token)
+	}
+	return nil
+}
+
+// release stops the renewal, and deletes the lease if it is still held
+func (l *Lease) release(ctx context.Context) error {
+	// lock the mutex
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.stopLocked()
+	if l.key == "" || l.lost {
+		return nil
+	}
+	key, value := l.key, l.value()
+	l.key = ""
+	if err := releaseScript.Run(ctx, l.Cache, []string{key}, value).Err(); err != nil {
+		return fmt.Errorf("failed to release lease, key: %s, err: %w", key, err)
+	}
+	return nil
+}
+
+// stopLocked stops the renewal loop if it is running, the caller must hold the mutex
+func (l *Lease) stopLocked() {
+	if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+}
+
+// runRenewal renews the lease every third of the TTL until it is stopped or
+// lost. a failed renewal is retried on the next tick, since Save verifies the
+// lease anyway
+func (l *Lease) runRenewal(stop <-chan struct{}) {
+	ticker := time.NewTicker(l.TTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if !l.renewOnce(stop) {
+			return
+		}
+	}
+}
+
+// renewOnce renews the lease by the renewal loop, false is returned if the
+// loop is stopped or the lease is lost
+func (l *Lease) renewOnce(stop <-chan struct{}) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), l.TTL/3)
+	defer cancel()
+	// lock the mutex
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// the loop may be stopped while waiting for the mutex
+	select {
+	case <-stop:
+		return false
+	default:
+	}
+	_ = l.renewLocked(ctx)
+	return !l.lost
+}
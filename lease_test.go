@@ -0,0 +1,213 @@
+package memstore_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/khgame/memstore"
+	"github.com/khgame/memstore/cache"
+	"github.com/khgame/memstore/dumper"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_InMemStorage_Lease tests the ownership lease of InMemStorage with testify
+func Test_InMemStorage_Lease(t *testing.T) {
+	ctx := context.Background()
+	mini, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer mini.Close()
+	c := cache.NewClient(mini.Addr())
+	defer c.Close()
+
+	seed := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	seed.Dumper = dumper.CreateCacheDumperByCacheInstance[TestDataType](c)
+	assert.NoError(t, seed.Set("uid001", &TestDataType{Name: "gold", Quantity: 1}))
+	assert.NoError(t, seed.Save(ctx))
+
+	// the storage can not be saved before the lease is acquired
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = seed.Dumper
+	storage.Lease = memstore.NewLease(c, "node1", time.Minute)
+	assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "gold", Quantity: 1}))
+	assert.ErrorIs(t, storage.Save(ctx), memstore.ErrLeaseLost)
+	storage = memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = seed.Dumper
+	storage.Lease = memstore.NewLease(c, "node1", time.Minute)
+	assert.NoError(t, storage.Load(ctx))
+	assert.True(t, storage.Lease.Held())
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "gold", Quantity: 10}))
+	assert.NoError(t, storage.Save(ctx))
+
+	// the lease is held by the first instance
+	storage2 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage2.Dumper = storage.Dumper
+	storage2.Lease = memstore.NewLease(c, "node2", time.Minute)
+	assert.ErrorIs(t, storage2.Load(ctx), memstore.ErrLeaseHeld)
+
+	// the second instance takes over once the lease expires, with a larger token
+	mini.FastForward(2 * time.Minute)
+	assert.NoError(t, storage2.Load(ctx))
+	assert.Greater(t, storage2.Lease.Token(), storage.Lease.Token())
+
+	// the first instance can not save anymore, and its changes stay dirty
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "gold", Quantity: 100}))
+	assert.ErrorIs(t, storage.Save(ctx), memstore.ErrLeaseLost)
+	assert.True(t, storage.IsDirty())
+	assert.False(t, storage.Lease.Held())
+	assert.ErrorIs(t, storage.Save(ctx), memstore.ErrLeaseLost)
+
+	// the data of the new owner is kept
+	assert.NoError(t, storage2.Set("uid001", &TestDataType{Name: "gold", Quantity: 2}))
+	assert.NoError(t, storage2.Save(ctx))
+	data := TestDataType{Name: "gold"}
+	assert.NoError(t, storage2.Get("uid001", &data))
+	assert.Equal(t, int64(2), data.Quantity)
+
+	// Close releases the lease
+	assert.NoError(t, storage2.Close(ctx))
+	assert.False(t, mini.Exists(memstore.SchemeLease.Make("test_storage")))
+}
+
+// takeoverDumper runs takeover before each dump, as if the owner paused
+// between the verification of the lease and the dump
+type takeoverDumper[T any] struct {
+	*dumper.CacheDumper[T]
+	takeover func()
+}
+
+func (d *takeoverDumper[T]) DumpChangedWithMeta(ctx context.Context, permanentKey string, changed map[memstore.UID]memstore.DataMap[T], meta map[memstore.UID]memstore.MetaMap, opt memstore.DumpOptions) error {
+	if d.takeover != nil {
+		d.takeover()
+	}
+	return d.CacheDumper.DumpChangedWithMeta(ctx, permanentKey, changed, meta, opt)
+}
+
+// Test_InMemStorage_LeaseFencing tests that the writes are dropped if the lease is lost after the verification with testify
+func Test_InMemStorage_LeaseFencing(t *testing.T) {
+	ctx := context.Background()
+	mini, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer mini.Close()
+	c := cache.NewClient(mini.Addr())
+	defer c.Close()
+
+	dp := &takeoverDumper[TestDataType]{CacheDumper: dumper.CreateCacheDumperByCacheInstance[TestDataType](c)}
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = dp
+	storage.Lease = memstore.NewLease(c, "node1", time.Minute)
+	assert.NoError(t, storage.Load(ctx))
+	assert.NoError(t, storage.SetWithTTL("uid001", &TestDataType{Name: "gold", Quantity: 1}, time.Hour))
+	assert.NoError(t, storage.Save(ctx))
+
+	// the lease expires and is taken over after it is verified by Save
+	storage2 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage2.Dumper = dumper.CreateCacheDumperByCacheInstance[TestDataType](c)
+	storage2.Lease = memstore.NewLease(c, "node2", time.Minute)
+	dp.takeover = func() {
+		mini.FastForward(2 * time.Minute)
+		assert.NoError(t, storage2.Load(ctx))
+	}
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "gold", Quantity: 10}))
+	assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "gold", Quantity: 2}))
+	assert.ErrorIs(t, storage.Save(ctx), memstore.ErrLeaseLost)
+	assert.True(t, storage.IsDirty())
+	assert.False(t, storage.Lease.Held())
+
+	// nothing of the stale owner lands
+	saved := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	saved.Dumper = storage2.Dumper
+	assert.NoError(t, saved.Load(ctx))
+	data := TestDataType{Name: "gold"}
+	assert.NoError(t, saved.Get("uid001", &data))
+	assert.Equal(t, int64(1), data.Quantity)
+	expireAt, err := saved.GetExpiry("uid001", "gold")
+	assert.NoError(t, err)
+	assert.False(t, expireAt.IsZero())
+	_, err = saved.List("uid002")
+	assert.ErrorIs(t, err, memstore.ErrUserNotFound)
+	assert.NoError(t, storage2.Close(ctx))
+}
+
+// Test_InMemStorage_LeaseOtherRedis tests that the writes are saved if the lease is kept in another redis with testify
+func Test_InMemStorage_LeaseOtherRedis(t *testing.T) {
+	ctx := context.Background()
+	mini, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer mini.Close()
+	miniLease, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer miniLease.Close()
+	c := cache.NewClient(mini.Addr())
+	defer c.Close()
+	cl := cache.NewClient(miniLease.Addr())
+	defer cl.Close()
+
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = dumper.CreateCacheDumperByCacheInstance[TestDataType](c)
+	storage.Lease = memstore.NewLease(cl, "node1", time.Minute)
+	assert.NoError(t, storage.Load(ctx))
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "gold", Quantity: 1}))
+	assert.NoError(t, storage.Save(ctx))
+	assert.True(t, storage.Lease.Held())
+	assert.False(t, storage.IsDirty())
+	assert.True(t, mini.Exists(dumper.SchemeMemStoreSaving.Make("test_storage", "uid001")))
+	assert.NoError(t, storage.Close(ctx))
+}
+
+// Test_InMemStorage_LeaseRenewal tests the background renewal of the lease with testify
+func Test_InMemStorage_LeaseRenewal(t *testing.T) {
+	ctx := context.Background()
+	mini, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer mini.Close()
+	c := cache.NewClient(mini.Addr())
+	defer c.Close()
+
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = dumper.CreateCacheDumperByCacheInstance[TestDataType](c)
+	storage.Lease = memstore.NewLease(c, "node1", 300*time.Millisecond)
+	storage.LazyLoad = true
+	assert.NoError(t, storage.Load(ctx))
+
+	// the lease is extended before it expires
+	key := memstore.SchemeLease.Make("test_storage")
+	mini.FastForward(200 * time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return mini.TTL(key) == 300*time.Millisecond
+	}, time.Second, 10*time.Millisecond)
+	mini.FastForward(200 * time.Millisecond)
+	assert.True(t, mini.Exists(key))
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "gold", Quantity: 1}))
+	assert.NoError(t, storage.Close(ctx))
+}
+
+// Test_InMemStorage_LeaseLoad tests the lease taken by the loading of a new or a broken storage with testify
+func Test_InMemStorage_LeaseLoad(t *testing.T) {
+	ctx := context.Background()
+	mini, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer mini.Close()
+	c := cache.NewClient(mini.Addr())
+	defer c.Close()
+
+	// a storage with nothing stored yet is loaded as empty
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = dumper.CreateCacheDumperByCacheInstance[TestDataType](c)
+	storage.Lease = memstore.NewLease(c, "node1", time.Minute)
+	assert.NoError(t, storage.Load(ctx))
+	assert.True(t, storage.Lease.Held())
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "gold", Quantity: 1}))
+	assert.NoError(t, storage.Save(ctx))
+	assert.NoError(t, storage.Close(ctx))
+
+	// the lease is released if the storage fails to be loaded
+	assert.NoError(t, c.Set(ctx, dumper.SchemeMemStoreSaving.Make("test_storage", "uid001"), `{"gold":`, 0).Err())
+	storage = memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = dumper.CreateCacheDumperByCacheInstance[TestDataType](c)
+	storage.Lease = memstore.NewLease(c, "node1", time.Minute)
+	assert.Error(t, storage.Load(ctx))
+	assert.False(t, storage.Lease.Held())
+	assert.False(t, mini.Exists(memstore.SchemeLease.Make("test_storage")))
+}
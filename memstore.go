@@ -2,14 +2,21 @@ package memstore
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/sync/singleflight"
 )
 
 var (
 	// ErrUserNotFound is returned when a user is not found
 	ErrUserNotFound = fmt.Errorf("user not found")
+	// ErrResourceNotFound is returned when a resource of a user is not found
+	ErrResourceNotFound = fmt.Errorf("resource not found")
 
 	// ErrInvalidInput is returned when the input is invalid
 	ErrInvalidInput = fmt.Errorf("invalid input")
@@ -33,10 +40,20 @@ type (
 	// Dumper is a function that dumps memory data to a permanent storage,
 	// or loads data from a permanent storage to memory
 	Dumper[T any] interface {
-		// Dump dumps memory data to a permanent storage
+		// Dump dumps memory data to a permanent storage, the data of users
+		// that are not in data should be removed from the permanent storage
 		Dump(ctx context.Context, permanentKey string, data map[UID]DataMap[T]) error
-		// Load loads data from a permanent storage to memory
+		// DumpChanged dumps only the given users to a permanent storage, users
+		// that are not in changed are kept as they are. a nil DataMap means the
+		// user has been purged, and its data should be removed from the permanent
+		// storage. the index is updated to match the changes
+		DumpChanged(ctx context.Context, permanentKey string, changed map[UID]DataMap[T]) error
+		// Load loads data from a permanent storage to memory, nothing is
+		// loaded without error if nothing is stored for the permanent key yet
 		Load(ctx context.Context, permanentKey string, out *map[UID]DataMap[T]) error
+		// LoadUser loads the data of a single user from a permanent storage,
+		// ErrUserNotFound is returned if the user is not in the permanent storage
+		LoadUser(ctx context.Context, permanentKey string, uid UID) (DataMap[T], error)
 	}
 
 	// InMemoryStorage is an in-memory implementation of Storage
@@ -44,18 +61,78 @@ type (
 		// PersistentKey is the permanent key of the storage
 		PersistentKey string
 
-		// mu is a mutex that protects the data map
+		// mu is the storage lock, the operations on a user hold it for reading
+		// with the lock of the user's shard, and the storage-wide operations
+		// hold it for writing, which excludes all the others
 		mu sync.RWMutex
-		// data is the actual data map
-		data map[UID]DataMap[TData]
-
-		// dirty is a flag that indicates if the storage has been modified since
-		dirty bool
+		// shards hold the users, distributed by the hash of their uid
+		shards []*shard[TData]
+
+		// writeSeq is the sequence number of the last modification
+		writeSeq atomic.Uint64
+		// dirtyMu protects dirtyCount and dirtySince
+		dirtyMu sync.Mutex
+		// dirtyCount is the count of the users modified since the last save
+		dirtyCount int
+		// dirtySince is the time of the first modification since the last save
+		dirtySince time.Time
 		// saveTime is the last time the storage was saved
-		saveTime int64
+		saveTime time.Time
+		// saveErr is the error of the last save, nil if it succeeded
+		saveErr error
+
+		// autoSave is the running background auto-save loop, nil if not started
+		autoSave *autoSaver
 
 		// Dumper is a function that dumps memory data to a permanent storage,
 		Dumper Dumper[TData]
+
+		// LazyLoad enables the on-demand mode, in which Load does not load any
+		// user, and a user is loaded from the Dumper on the first access
+		LazyLoad bool
+		// loadGroup merges the concurrent loading of the same user
+		loadGroup singleflight.Group
+		// failedCount is the count of the users that failed to be loaded, it
+		// is read without the lock, so that the accesses skip the check of
+		// the failures if there is none
+		failedCount atomic.Int64
+		// purgeEpoch is increased on every purge, so that a loading that
+		// overlaps with a purge does not bring the purged data back
+		purgeEpoch atomic.Uint64
+
+		// Capacity bounds the users kept in memory, the least recently
+		// accessed users are evicted and loaded back on demand
+		Capacity Capacity[TData]
+		// lru records the access order and the sizes of the users in memory
+		lru lruTracker
+		// evictMu makes sure only one eviction pass runs at a time
+		evictMu sync.Mutex
+		// saveMu serializes the writings to the Dumper
+		saveMu sync.Mutex
+
+		// OnExpire is called for each resource removed by the expiry reaper,
+		// it can be nil
+		OnExpire func(user UID, expired TData)
+		// reaper is the running background expiry reaper, nil if not started
+		reaper *expiryReaper
+
+		// watchers receive the changes of the storage
+		watchers watcherSet[TData]
+		// broadcast is the running publisher of the invalidations, nil if not started
+		broadcast *broadcaster[TData]
+		// unsubscribe stops the subscription of the invalidations, nil if not started
+		unsubscribe func() error
+
+		// indexes are the secondary indexes added by AddIndex
+		indexes indexes[TData]
+
+		// Journal records the mutations between saves, it is replayed by Load
+		// and checkpointed by a successful Save. it is optional
+		Journal *Journal[TData]
+
+		// Lease makes sure only one instance saves the PersistentKey, it is
+		// acquired by Load, and verified by every write to the Dumper. it is optional
+		Lease *Lease
 	}
 )
 
@@ -63,11 +140,88 @@ type (
 func NewInMemoryStorage[TData StorableType](persistentKey string) *InMemoryStorage[TData] {
 	return &InMemoryStorage[TData]{
 		PersistentKey: persistentKey,
-		data:          make(map[UID]DataMap[TData]),
+		shards:        newShards[TData](),
+	}
+}
+
+// loadUser makes sure the user is in memory when LazyLoad or Capacity is enabled,
+// the concurrent callers of the same user share one fetch from the Dumper.
+// the user is kept from eviction until release is called
+func (s *InMemoryStorage[TData]) loadUser(user UID) (release func(), err error) {
+	// the user failed to be loaded is not accessed, so that its payload is kept
+	if err = s.checkAvailable(user); err != nil {
+		return nil, err
+	}
+	if !s.LazyLoad && !s.Capacity.enabled() {
+		return func() {}, nil
+	}
+	release = s.pin(user)
+
+	// the user is in memory, or it has been purged
+	sh := s.shardOf(user)
+	unlock := s.rlockUser(user)
+	_, loaded := sh.data[user]
+	_, dirty := sh.dirty[user]
+	epoch := s.purgeEpoch.Load()
+	unlock()
+	if loaded || dirty {
+		return release, nil
+	}
+
+	// if the dumper is not set, return an error
+	if s.Dumper == nil {
+		release()
+		return nil, fmt.Errorf("%w, dumper is not set", ErrStatusError)
+	}
+
+	_, err, _ = s.loadGroup.Do(user, func() (any, error) {
+		ctx := context.Background()
+		r, err := s.Dumper.LoadUser(ctx, s.PersistentKey, user)
+		if errors.Is(err, ErrUserNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load user %s from permanent storage, err: %w", user, err)
+		}
+		meta, err := s.loadMeta(ctx, []UID{user})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load metadata of user %s from permanent storage, err: %w", user, err)
+		}
+
+		// lock the user
+		unlock := s.lockUser(user)
+		defer unlock()
+
+		// do not override the modifications or the purges made during the fetch
+		_, loaded := sh.data[user]
+		_, dirty := sh.dirty[user]
+		if loaded || dirty || epoch != s.purgeEpoch.Load() {
+			return nil, nil
+		}
+		if r == nil {
+			r = make(DataMap[TData])
+		}
+		sh.data[user] = r
+		if m, ok := meta[user]; ok {
+			sh.meta[user] = m
+		}
+		s.raiseWriteSeqByMeta(meta)
+		s.indexUserLocked(user)
+		s.resize(user)
+		return nil, nil
+	})
+	if err != nil {
+		release()
+		return nil, err
 	}
+
+	// the loaded user may exceed the capacity
+	s.evictIfNeeded()
+	return release, nil
 }
 
-// Get retrieves a resource for a given user
+// Get retrieves a resource for a given user, ErrResourceNotFound is returned
+// if the resource does not exist or is expired, and out is set to the zero value
 func (s *InMemoryStorage[TData]) Get(user string, out *TData) error {
 	// validate input
 	if user == "" {
@@ -76,50 +230,89 @@ func (s *InMemoryStorage[TData]) Get(user string, out *TData) error {
 	if out == nil {
 		return fmt.Errorf("%w, output cannot be nil", ErrInvalidInput)
 	}
-	// lock the mutex
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	// load the user if it is not in memory
+	release, err := s.loadUser(user)
+	if err != nil {
+		return err
+	}
+	defer release()
+	// lock the user
+	unlock := s.rlockUser(user)
+	defer unlock()
+
+	return s.getLocked(user, out)
+}
 
+// getLocked retrieves a resource for a given user, the caller must hold the lock of the user
+func (s *InMemoryStorage[TData]) getLocked(user UID, out *TData) error {
 	storeName := (*out).StoreName()
 	// get the resources of the user
-	r, ok := s.data[user]
+	r, ok := s.shardOf(user).data[user]
 	if !ok {
 		return fmt.Errorf("%w, user: %s", ErrUserNotFound, user)
 	}
 
-	// get the resource
-	*out = r[storeName]
+	// record the access
+	s.touch(user)
+
+	// get the resource, an expired resource is treated as missing
+	v, ok := r[storeName]
+	if !ok || s.expiredLocked(user, storeName, time.Now()) {
+		var zero TData
+		*out = zero
+		return fmt.Errorf("%w, user: %s, storeName: %s", ErrResourceNotFound, user, storeName)
+	}
+	*out = v
 
 	return nil
 }
 
-// List retrieves all resources' StoreName() for a given user
+// List retrieves all resources' StoreName() for a given user, sorted by name
 func (s *InMemoryStorage[TData]) List(user UID) ([]string, error) {
 	// validate input
 	if user == "" {
 		return nil, fmt.Errorf("%w, user cannot be empty", ErrInvalidUser)
 	}
-	// lock the mutex
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	// load the user if it is not in memory
+	release, err := s.loadUser(user)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	// lock the user
+	unlock := s.rlockUser(user)
+	defer unlock()
 
 	// get the resources of the user
-	res, ok := s.data[user]
+	res, ok := s.shardOf(user).data[user]
 	if !ok {
 		return nil, fmt.Errorf("%w, user: %s", ErrUserNotFound, user)
 	}
 
-	// get the resource names
+	// record the access
+	s.touch(user)
+
+	// get the resource names, the expired resources are hidden
+	now := time.Now()
 	ret := make([]string, 0, len(res))
 	for k := range res {
+		if s.expiredLocked(user, k, now) {
+			continue
+		}
 		ret = append(ret, k)
 	}
+	sort.Strings(ret)
 
 	return ret, nil
 }
 
-// Set stores a resource for a given user
+// Set stores a resource for a given user, the expiry of the resource is cleared
 func (s *InMemoryStorage[TData]) Set(user string, in *TData) error {
+	return s.set(user, in, ResourceMeta{})
+}
+
+// set stores a resource with the given metadata for a given user
+func (s *InMemoryStorage[TData]) set(user string, in *TData, meta ResourceMeta) error {
 	// validate input
 	if user == "" {
 		return fmt.Errorf("%w, user cannot be empty", ErrInvalidUser)
@@ -127,26 +320,52 @@ func (s *InMemoryStorage[TData]) Set(user string, in *TData) error {
 	if in == nil {
 		return fmt.Errorf("%w, output cannot be nil", ErrInvalidInput)
 	}
-	// lock the mutex
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	// mark the storage as dirty
-	s.dirty = true
+	// load the user if it is not in memory
+	release, err := s.loadUser(user)
+	if err != nil {
+		return err
+	}
+	defer release()
+	// the new resource may exceed the capacity, check it after unlocking
+	defer s.evictIfNeeded()
+	// lock the user
+	unlock := s.lockUser(user)
+	defer unlock()
+
+	_, err = s.setLocked(user, in, meta)
+	return err
+}
 
+// setLocked stores a resource with the given metadata, and returns its new
+// version. the caller must hold the write lock of the user
+func (s *InMemoryStorage[TData]) setLocked(user UID, in *TData, meta ResourceMeta) (uint64, error) {
 	storeName := (*in).StoreName()
 
-	// get the resources of the user
-	r, ok := s.data[user]
-	if !ok {
-		r = make(DataMap[TData])
-		s.data[user] = r
+	// write ahead to the journal
+	v := *in
+	meta.Version = s.writeSeq.Add(1)
+	if err := s.journalLocked(journalRecord[TData]{Op: journalOpSet, User: user, StoreName: storeName, Value: &v, ExpireAt: meta.ExpireAt, Version: meta.Version}); err != nil {
+		return 0, err
 	}
 
+	// mark the user as dirty
+	s.markDirty(user)
+
+	// get the resources of the user
+	r := s.userDataLocked(user)
+
 	// store the resource
-	r[storeName] = *in
+	var old *TData
+	if v, exist := r[storeName]; exist && !s.expiredLocked(user, storeName, time.Now()) {
+		old = &v
+	}
+	r[storeName] = v
+	s.setMetaLocked(user, storeName, meta)
+	s.indexResourceLocked(user, storeName, &v)
+	s.resize(user)
+	s.emitLocked(ChangeSet, user, storeName, old, &v)
 
-	return nil
+	return meta.Version, nil
 }
 
 // Update updates a resource for a given user
@@ -161,43 +380,69 @@ func (s *InMemoryStorage[TData]) Update(user string, storeName string, updateFn
 	if updateFn == nil {
 		return fmt.Errorf("%w, updateFn cannot be nil", ErrInvalidInput)
 	}
-	// lock the mutex
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	// load the user if it is not in memory
+	release, err := s.loadUser(user)
+	if err != nil {
+		return err
+	}
+	defer release()
+	// the updated resource may exceed the capacity, check it after unlocking
+	defer s.evictIfNeeded()
+	// lock the user
+	unlock := s.lockUser(user)
+	defer unlock()
 
-	// mark the storage as dirty
-	s.dirty = true
+	// mark the user as dirty
+	s.markDirty(user)
 
-	// get the resources of the user
-	r, ok := s.data[user]
-	if !ok {
-		// upsert the user
-		r = make(DataMap[TData])
-		s.data[user] = r
-	}
+	// get the resources of the user, upsert the user if it does not exist
+	r := s.userDataLocked(user)
 
-	var (
-		rp  *TData
-		err error
-	)
-	// get the resource, if it's not there, rp will be nil
+	var rp *TData
+	// get the resource, if it's not there or expired, rp will be nil
 	res, exist := r[storeName]
+	if exist && s.expiredLocked(user, storeName, time.Now()) {
+		// the expired resource is replaced by a new one
+		s.setMetaLocked(user, storeName, ResourceMeta{})
+		delete(r, storeName)
+		s.indexResourceLocked(user, storeName, nil)
+		exist = false
+	}
+	var old *TData
 	if exist {
-		rp = &res
+		org := res
+		rp, old = &res, &org
 	}
-	// update the resource
+	// update the resource, the user is resized whatever the result is
+	defer s.resize(user)
 	if rp, err = updateFn(rp); err != nil {
 		return err
 	}
 	// if the resource is nil, delete it
 	if rp == nil {
 		if exist {
+			if err = s.journalLocked(journalRecord[TData]{Op: journalOpDel, User: user, StoreName: storeName}); err != nil {
+				return err
+			}
 			delete(r, storeName)
+			s.setMetaLocked(user, storeName, ResourceMeta{})
+			s.indexResourceLocked(user, storeName, nil)
+			s.emitLocked(ChangeDelete, user, storeName, old, nil)
 		}
 		return nil
 	}
-	// store the resource
-	r[storeName] = *rp
+	// store the resource, the expiry is kept
+	v := *rp
+	meta := s.metaLocked(user, storeName)
+	meta.Version = s.writeSeq.Add(1)
+	rec := journalRecord[TData]{Op: journalOpSet, User: user, StoreName: storeName, Value: &v, ExpireAt: meta.ExpireAt, Version: meta.Version}
+	if err = s.journalLocked(rec); err != nil {
+		return err
+	}
+	r[storeName] = v
+	s.setMetaLocked(user, storeName, meta)
+	s.indexResourceLocked(user, storeName, &v)
+	s.emitLocked(ChangeUpdate, user, storeName, old, &v)
 
 	return nil
 }
@@ -211,73 +456,211 @@ func (s *InMemoryStorage[TData]) Delete(user string, storeName string) error {
 	if storeName == "" {
 		return fmt.Errorf("%w, storeName cannot be empty", ErrInvalidInput)
 	}
-	// lock the mutex
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	// mark the storage as dirty
-	s.dirty = true
+	// load the user if it is not in memory
+	release, err := s.loadUser(user)
+	if err != nil {
+		return err
+	}
+	defer release()
+	// lock the user
+	unlock := s.lockUser(user)
+	defer unlock()
 
 	// get the resources of the user
-	r, ok := s.data[user]
+	r, ok := s.writableLocked(user)
 	if !ok {
 		return nil
 	}
 
+	// write ahead to the journal
+	if err := s.journalLocked(journalRecord[TData]{Op: journalOpDel, User: user, StoreName: storeName}); err != nil {
+		return err
+	}
+
+	// mark the user as dirty
+	s.markDirty(user)
+
 	// delete the resource
-	delete(r, storeName)
+	if v, exist := r[storeName]; exist {
+		if !s.expiredLocked(user, storeName, time.Now()) {
+			s.emitLocked(ChangeDelete, user, storeName, &v, nil)
+		}
+		delete(r, storeName)
+	}
+	s.setMetaLocked(user, storeName, ResourceMeta{})
+	s.indexResourceLocked(user, storeName, nil)
+	s.resize(user)
 
 	// :: if the user has no more resources, do not delete the user
 	return nil
 }
 
+// Purge deletes all resources of a given user, and removes the user from
+// the permanent storage on the next save
+func (s *InMemoryStorage[TData]) Purge(user string) error {
+	// validate input
+	if user == "" {
+		return fmt.Errorf("%w, user cannot be empty", ErrInvalidUser)
+	}
+	// lock the user
+	unlock := s.lockUser(user)
+	defer unlock()
+
+	// write ahead to the journal
+	if err := s.journalLocked(journalRecord[TData]{Op: journalOpPurge, User: user}); err != nil {
+		return err
+	}
+
+	// mark the user as dirty even if it is not in memory,
+	// so that the permanent data is removed anyway
+	s.markDirty(user)
+
+	// notify the deletion of the resources in memory
+	sh := s.shardOf(user)
+	now := time.Now()
+	for storeName, v := range sh.data[user] {
+		if !s.expiredLocked(user, storeName, now) {
+			v := v
+			s.emitLocked(ChangeDelete, user, storeName, &v, nil)
+		}
+	}
+
+	// delete the user, and discard the loadings in flight
+	delete(sh.data, user)
+	delete(sh.meta, user)
+	s.clearFailureLocked(user)
+	s.indexUserLocked(user)
+	s.lru.forget(user)
+	s.purgeEpoch.Add(1)
+
+	return nil
+}
+
 // IsDirty returns true if the storage has been modified since
 func (s *InMemoryStorage[TData]) IsDirty() bool {
 	// lock the mutex
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.dirtyMu.Lock()
+	defer s.dirtyMu.Unlock()
 
-	return s.dirty
+	return s.dirtyCount > 0
 }
 
-// Save persists the storage to permanent storage
-// if the storage is not dirty, this function does nothing
-func (s *InMemoryStorage[TData]) Save(ctx context.Context) error {
+// markDirty marks the user as modified, the caller must hold the write lock of the user
+func (s *InMemoryStorage[TData]) markDirty(user UID) {
+	sh := s.shardOf(user)
+	if _, dirty := sh.dirty[user]; !dirty {
+		s.dirtyMu.Lock()
+		if s.dirtyCount == 0 {
+			s.dirtySince = time.Now()
+		}
+		s.dirtyCount++
+		s.dirtyMu.Unlock()
+	}
+	sh.seq++
+	sh.dirty[user] = sh.seq
+	sh.written[user] = sh.seq
+}
+
+// markClean marks the user as saved, the caller must hold the write lock of the user
+func (s *InMemoryStorage[TData]) markClean(user UID) {
+	sh := s.shardOf(user)
+	if _, dirty := sh.dirty[user]; !dirty {
+		return
+	}
+	delete(sh.dirty, user)
+	// the purged user is no longer tracked once it is saved
+	if _, ok := sh.data[user]; !ok {
+		delete(sh.written, user)
+	}
+	s.dirtyMu.Lock()
+	if s.dirtyCount--; s.dirtyCount == 0 {
+		s.dirtySince = time.Time{}
+	}
+	s.dirtyMu.Unlock()
+}
+
+// userDataLocked returns the resources of the user to modify, the user is
+// created if it does not exist. the caller must hold the write lock of the user
+func (s *InMemoryStorage[TData]) userDataLocked(user UID) DataMap[TData] {
+	r, ok := s.writableLocked(user)
+	if !ok {
+		r = make(DataMap[TData])
+		s.shardOf(user).data[user] = r
+	}
+	return r
+}
+
+// DirtyUsers returns the users that have been modified since the last save
+func (s *InMemoryStorage[TData]) DirtyUsers() []UID {
 	// lock the mutex
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	// if the storage is not dirty, do nothing
-	if !s.dirty {
-		return nil
+	ret := make([]UID, 0)
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for user := range sh.dirty {
+			ret = append(ret, user)
+		}
+		sh.mu.RUnlock()
 	}
+	sort.Strings(ret)
+	return ret
+}
 
-	// if the dumper is not set, return an error
-	if s.Dumper == nil {
-		return fmt.Errorf("%w, dumper is not set", ErrStatusError)
+// Save persists the users modified since the last save to permanent storage
+// if the storage is not dirty, this function does nothing. the storage is
+// only locked while the snapshot of the changed users is taken, the writes
+// during the dump are kept dirty for the next save
+func (s *InMemoryStorage[TData]) Save(ctx context.Context) error {
+	// the dirty users are not evicted during the save, check them after unlocking
+	defer s.evictIfNeeded()
+	// serialize with the other saves and the write-backs of eviction
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	// take the snapshot of the changed users, the journal is still
+	// checkpointed if the users are already saved by the write-backs
+	snap, err := s.snapshot()
+	if err != nil {
+		return err
+	}
+	if snap == nil {
+		return s.checkpointCleanJournal()
 	}
 
-	// dump the data to permanent storage
-	if err := s.Dumper.Dump(ctx, s.PersistentKey, s.data); err != nil {
-		return fmt.Errorf("failed to dump data to permanent storage, err: %w", err)
+	// dump the changed users to permanent storage without the lock
+	if err = s.dumpChanged(ctx, snap.changed, snap.meta, false); err != nil {
+		err = fmt.Errorf("failed to dump data to permanent storage, err: %w", err)
+		s.finishSnapshot(snap, false, err)
+		return err
 	}
 
-	// mark the storage as clean
-	s.dirty = false
+	// the journaled mutations in the snapshot are saved, the ones made during
+	// the dump are kept. a journal failed to be checkpointed is harmless,
+	// since replaying the saved mutations changes nothing
+	if s.Journal != nil {
+		err = s.Journal.checkpoint(snap.journalOffset)
+	}
 
-	// update the save time
-	s.saveTime = time.Now().Unix()
-	return nil
+	// mark the users in the snapshot as clean, and tell the other instances
+	s.finishSnapshot(snap, true, err)
+	s.publishSaved(snap.changed)
+	return err
 }
 
-// Load loads the storage from permanent storage
+// Load loads the storage from permanent storage,
+// when LazyLoad is enabled, the users are loaded on their first access instead.
+// the mutations in the Journal are replayed afterward, and the replayed users are dirty
 func (s *InMemoryStorage[TData]) Load(ctx context.Context) error {
+	// the loaded users may exceed the capacity, check it after unlocking
+	defer s.evictIfNeeded()
 	// lock the mutex
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	// check if the storage is dirty
-	if s.dirty {
+	if s.IsDirty() {
 		return fmt.Errorf("%w, cannot load data when storage is dirty", ErrStatusError)
 	}
 
@@ -286,13 +669,86 @@ func (s *InMemoryStorage[TData]) Load(ctx context.Context) error {
 		return fmt.Errorf("%w, dumper is not set", ErrStatusError)
 	}
 
-	// load the data from permanent storage
-	if err := s.Dumper.Load(ctx, s.PersistentKey, &s.data); err != nil {
+	// take the ownership before reading, so that no one else is writing
+	if s.Lease == nil {
+		return s.loadLocked(ctx)
+	}
+	if err := s.Lease.acquire(ctx, s.PersistentKey); err != nil {
+		return err
+	}
+	// the storage failed to be loaded is not owned, nor renewed
+	err := s.loadLocked(ctx)
+	if err != nil {
+		if errRelease := s.Lease.release(ctx); errRelease != nil {
+			err = fmt.Errorf("%w, and %v", err, errRelease)
+		}
+	}
+	return err
+}
+
+// loadLocked loads the storage from permanent storage, and replays the
+// journal. the caller must hold the storage lock for writing
+func (s *InMemoryStorage[TData]) loadLocked(ctx context.Context) error {
+	// the versions never go back, even for the users not loaded yet
+	if err := s.raiseWriteSeqByDumper(ctx); err != nil {
+		return err
+	}
+	// load the data from permanent storage, unless the users are loaded on demand
+	if s.LazyLoad {
+		s.setFailuresLocked(nil)
+		s.saveTime = time.Now()
+		return s.replayAndIndexLocked(ctx)
+	}
+	data := make(map[UID]DataMap[TData])
+	if err := s.loadDataLocked(ctx, &data); err != nil {
 		return fmt.Errorf("failed to load data from permanent storage, err: %w", err)
 	}
+	users := make([]UID, 0, len(data))
+	for user, r := range data {
+		users = append(users, user)
+		s.shardOf(user).data[user] = r
+		s.resize(user)
+	}
+	meta, err := s.loadMeta(ctx, users)
+	if err != nil {
+		return fmt.Errorf("failed to load metadata from permanent storage, err: %w", err)
+	}
+	for user, m := range meta {
+		s.shardOf(user).meta[user] = m
+	}
+	s.raiseWriteSeqByMeta(meta)
 
 	// set the save time, since we are loading from permanent storage
 	// we assume the data is clean, so we set the save time to now
-	s.saveTime = time.Now().Unix()
-	return nil
+	s.saveTime = time.Now()
+
+	// the mutations after the last save are replayed on top of the loaded data
+	return s.replayAndIndexLocked(ctx)
+}
+
+// replayAndIndexLocked replays the journal, and rebuilds the indexes from
+// the loaded users. the caller must hold the storage lock for writing
+func (s *InMemoryStorage[TData]) replayAndIndexLocked(ctx context.Context) error {
+	err := s.replayJournalLocked(ctx)
+	s.rebuildIndexesLocked()
+	return err
+}
+
+// LastSaveTime returns the last time the storage was saved or loaded,
+// the zero time is returned if neither happened
+func (s *InMemoryStorage[TData]) LastSaveTime() time.Time {
+	// lock the mutex
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.saveTime
+}
+
+// LastSaveError returns the error of the last save, nil if it succeeded
+func (s *InMemoryStorage[TData]) LastSaveError() error {
+	// lock the mutex
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.saveErr
 }
@@ -2,6 +2,7 @@ package memstore_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/khgame/memstore"
@@ -16,8 +17,8 @@ func (p GameUserPackageSlot) StoreName() string {
 	return p.ItemName
 }
 
-// Example_InMemStorage the testable example for InMemStorage
-func Example_InMemStorage() {
+// ExampleInMemoryStorage the testable example for InMemStorage
+func ExampleInMemoryStorage() {
 	gameAndUsageSample := "the_rpg_game"
 	resourceStore := memstore.NewInMemoryStorage[GameUserPackageSlot](gameAndUsageSample)
 	resourceStore.Dumper = createCacheDumper[GameUserPackageSlot]()
@@ -61,14 +62,15 @@ func Example_InMemStorage() {
 		panic(err)
 	}
 	fmt.Println(item002.Quantity)
-	if err = resourceStore2.Get(user002, item002); err != nil {
+	// user002 has no item002
+	if err = resourceStore2.Get(user002, item002); !errors.Is(err, memstore.ErrResourceNotFound) {
 		panic(err)
 	}
-	fmt.Println(item002.Quantity)
+	fmt.Println(err)
 
 	// Output:
 	// 1
 	// 100
 	// 2
-	// 0
+	// resource not found, user: user002, storeName: item002
 }
@@ -2,7 +2,11 @@ package memstore_test
 
 import (
 	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/alicebob/miniredis"
 
@@ -23,6 +27,22 @@ func (t TestDataType) StoreName() string {
 	return t.Name
 }
 
+// recordingDumper is a dumper that records the users of each DumpChanged call
+type recordingDumper[T any] struct {
+	memstore.Dumper[T]
+	dumped [][]memstore.UID
+}
+
+func (d *recordingDumper[T]) DumpChanged(ctx context.Context, permanentKey string, changed map[memstore.UID]memstore.DataMap[T]) error {
+	users := make([]memstore.UID, 0, len(changed))
+	for uid := range changed {
+		users = append(users, uid)
+	}
+	sort.Strings(users)
+	d.dumped = append(d.dumped, users)
+	return d.Dumper.DumpChanged(ctx, permanentKey, changed)
+}
+
 func createCacheDumper[T memstore.StorableType]() memstore.Dumper[T] {
 	// create mini redis server
 	mini, err := miniredis.Run()
@@ -70,6 +90,48 @@ func Test_InMemStorage_SetGetListDelete(t *testing.T) {
 	assert.Equal(t, "res002", resources[0])
 }
 
+// Test_InMemStorage_ResourceNotFound tests that InMemStorage distinguishes missing resources from zero values with testify
+func Test_InMemStorage_ResourceNotFound(t *testing.T) {
+	ctx := context.Background()
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = createCacheDumper[TestDataType]()
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001"}))
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res002", Quantity: 2}))
+
+	// a zero value is found, a missing resource is not
+	data := TestDataType{Name: "res001"}
+	assert.NoError(t, storage.Get("uid001", &data))
+	assert.Equal(t, TestDataType{Name: "res001"}, data)
+	data = TestDataType{Name: "res003", Quantity: 3}
+	assert.ErrorIs(t, storage.Get("uid001", &data), memstore.ErrResourceNotFound)
+	assert.Equal(t, TestDataType{}, data)
+	assert.ErrorIs(t, storage.Get("uid002", &data), memstore.ErrUserNotFound)
+
+	// a deleted resource is not found
+	assert.NoError(t, storage.Delete("uid001", "res002"))
+	data = TestDataType{Name: "res002"}
+	assert.ErrorIs(t, storage.Get("uid001", &data), memstore.ErrResourceNotFound)
+
+	// the same after the round trip of the dumper
+	assert.NoError(t, storage.Save(ctx))
+	storage2 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage2.Dumper = storage.Dumper
+	assert.NoError(t, storage2.Load(ctx))
+	data = TestDataType{Name: "res001"}
+	assert.NoError(t, storage2.Get("uid001", &data))
+	assert.Equal(t, TestDataType{Name: "res001"}, data)
+	data = TestDataType{Name: "res002"}
+	assert.ErrorIs(t, storage2.Get("uid001", &data), memstore.ErrResourceNotFound)
+
+	// and in a transaction
+	assert.NoError(t, storage2.Txn("uid001", func(tx *memstore.Txn[TestDataType]) error {
+		assert.NoError(t, tx.Delete("res001"))
+		data = TestDataType{Name: "res001"}
+		assert.ErrorIs(t, tx.Get(&data), memstore.ErrResourceNotFound)
+		return nil
+	}))
+}
+
 // Test_InMemStorage_SaveLoad tests the Save & Load method of InMemStorage with testify
 func Test_InMemStorage_SaveLoad(t *testing.T) {
 	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
@@ -124,3 +186,148 @@ func Test_InMemStorage_SaveLoad(t *testing.T) {
 	assert.Equal(t, "res001", resources[0])
 	assert.Equal(t, "res002", resources[1])
 }
+
+// Test_InMemStorage_IncrementalSave tests that Save only dumps the users modified since the last save
+func Test_InMemStorage_IncrementalSave(t *testing.T) {
+	ctx := context.Background()
+	dp := &recordingDumper[TestDataType]{Dumper: createCacheDumper[TestDataType]()}
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = dp
+
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: 1}))
+	assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "res001", Quantity: 2}))
+	assert.Equal(t, []memstore.UID{"uid001", "uid002"}, storage.DirtyUsers())
+	assert.NoError(t, storage.Save(ctx))
+	assert.False(t, storage.IsDirty())
+
+	// only uid002 is modified
+	assert.NoError(t, storage.Update("uid002", "res001", func(org *TestDataType) (*TestDataType, error) {
+		org.Quantity++
+		return org, nil
+	}))
+	// deleting from an unknown user changes nothing
+	assert.NoError(t, storage.Delete("uid003", "res001"))
+	assert.Equal(t, []memstore.UID{"uid002"}, storage.DirtyUsers())
+	assert.NoError(t, storage.Save(ctx))
+
+	// a clean storage does not dump at all
+	assert.NoError(t, storage.Save(ctx))
+	assert.Equal(t, [][]memstore.UID{{"uid001", "uid002"}, {"uid002"}}, dp.dumped)
+
+	// all users can be loaded back
+	storage2 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage2.Dumper = dp
+	assert.NoError(t, storage2.Load(ctx))
+	data := TestDataType{Name: "res001"}
+	assert.NoError(t, storage2.Get("uid001", &data))
+	assert.Equal(t, int64(1), data.Quantity)
+	assert.NoError(t, storage2.Get("uid002", &data))
+	assert.Equal(t, int64(3), data.Quantity)
+}
+
+// Test_InMemStorage_Purge tests that Purge removes the user from memory and from the permanent storage
+func Test_InMemStorage_Purge(t *testing.T) {
+	ctx := context.Background()
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = createCacheDumper[TestDataType]()
+
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: 1}))
+	assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "res001", Quantity: 2}))
+	assert.NoError(t, storage.Save(ctx))
+
+	assert.ErrorIs(t, storage.Purge(""), memstore.ErrInvalidUser)
+	assert.NoError(t, storage.Purge("uid001"))
+	_, err := storage.List("uid001")
+	assert.ErrorIs(t, err, memstore.ErrUserNotFound)
+	assert.Equal(t, []memstore.UID{"uid001"}, storage.DirtyUsers())
+	assert.NoError(t, storage.Save(ctx))
+
+	cli := storage.Dumper.(*dumper.CacheDumper[TestDataType]).Cache
+	assert.Equal(t, int64(0), cli.Exists(ctx, dumper.SchemeMemStoreSaving.Make("test_storage", "uid001")).Val())
+
+	storage2 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage2.Dumper = storage.Dumper
+	assert.NoError(t, storage2.Load(ctx))
+	_, err = storage2.List("uid001")
+	assert.ErrorIs(t, err, memstore.ErrUserNotFound)
+	resources, err := storage2.List("uid002")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"res001"}, resources)
+}
+
+// countingLoadDumper is a dumper that counts the LoadUser calls, and blocks them until release is closed
+type countingLoadDumper[T any] struct {
+	memstore.Dumper[T]
+	loads   atomic.Int32
+	release chan struct{}
+}
+
+func (d *countingLoadDumper[T]) LoadUser(ctx context.Context, permanentKey string, uid memstore.UID) (memstore.DataMap[T], error) {
+	d.loads.Add(1)
+	if d.release != nil {
+		<-d.release
+	}
+	return d.Dumper.LoadUser(ctx, permanentKey, uid)
+}
+
+// Test_InMemStorage_LazyLoad tests that users are loaded on demand when LazyLoad is enabled
+func Test_InMemStorage_LazyLoad(t *testing.T) {
+	ctx := context.Background()
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = createCacheDumper[TestDataType]()
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: 1}))
+	assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "res001", Quantity: 2}))
+	assert.NoError(t, storage.Save(ctx))
+
+	dp := &countingLoadDumper[TestDataType]{Dumper: storage.Dumper, release: make(chan struct{})}
+	storage2 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage2.Dumper = dp
+	storage2.LazyLoad = true
+	assert.NoError(t, storage2.Load(ctx))
+	assert.Equal(t, int32(0), dp.loads.Load())
+
+	// concurrent callers share one fetch
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := TestDataType{Name: "res001"}
+			assert.NoError(t, storage2.Get("uid001", &data))
+			assert.Equal(t, int64(1), data.Quantity)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(dp.release)
+	wg.Wait()
+	assert.Equal(t, int32(1), dp.loads.Load())
+
+	// set on a user that is not in memory keeps the persisted resources
+	assert.NoError(t, storage2.Set("uid002", &TestDataType{Name: "res002", Quantity: 20}))
+	resources, err := storage2.List("uid002")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"res001", "res002"}, resources)
+	assert.Equal(t, int32(2), dp.loads.Load())
+
+	// unknown users are still not found
+	_, err = storage2.List("uid003")
+	assert.ErrorIs(t, err, memstore.ErrUserNotFound)
+
+	// a purged user is not loaded back
+	assert.NoError(t, storage2.Purge("uid001"))
+	_, err = storage2.List("uid001")
+	assert.ErrorIs(t, err, memstore.ErrUserNotFound)
+	assert.NoError(t, storage2.Save(ctx))
+	_, err = storage2.List("uid001")
+	assert.ErrorIs(t, err, memstore.ErrUserNotFound)
+
+	// the saved changes are visible to a full load
+	storage3 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage3.Dumper = storage.Dumper
+	assert.NoError(t, storage3.Load(ctx))
+	_, err = storage3.List("uid001")
+	assert.ErrorIs(t, err, memstore.ErrUserNotFound)
+	resources, err = storage3.List("uid002")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"res001", "res002"}, resources)
+}
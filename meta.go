@@ -0,0 +1,158 @@
+package memstore
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+type (
+	// ResourceMeta is the metadata of a stored resource
+	ResourceMeta struct {
+		// ExpireAt is the expiry time of the resource in unix milliseconds,
+		// zero means the resource never expires
+		ExpireAt int64 `json:"expire_at,omitempty"`
+		// Version is the version of the resource, it is increased by every
+		// write of the resource, zero means the resource does not exist
+		Version uint64 `json:"version,omitempty"`
+	}
+
+	// MetaMap is a map that maps a resource's saving name to its metadata
+	MetaMap map[string]ResourceMeta
+
+	// MetaDumper is implemented by the dumpers that can persist the metadata
+	// of resources, the metadata of a storage whose Dumper does not implement
+	// MetaDumper is not persisted
+	MetaDumper interface {
+		// DumpMeta dumps the metadata of the given users to a permanent storage,
+		// the previous metadata of each user is replaced, and a nil MetaMap
+		// means the user has been purged
+		DumpMeta(ctx context.Context, permanentKey string, changed map[UID]MetaMap) error
+		// LoadMeta loads the metadata of the given users from a permanent storage,
+		// the users without metadata are not in the result
+		LoadMeta(ctx context.Context, permanentKey string, users []UID) (map[UID]MetaMap, error)
+	}
+
+	// DumpOptions are the options of ChangeDumper.DumpChangedWithMeta
+	DumpOptions struct {
+		// Fence is the holder of the Lease of the storage, nil if there is no
+		// lease. the dumpers writing through Fence.Cache, the client of the
+		// lease, make the write only if the lease is still held by it, and
+		// return ErrLeaseLost otherwise. the others rely on the verification
+		// of the lease before the write
+		Fence *Fence
+		// WriteBack is true if the users are written back to be evicted, the
+		// dumpers keeping generations make no generation for a write-back
+		WriteBack bool
+		// WriteSeq is the write sequence of the storage, no version handed
+		// out so far is larger than it. the dumpers implementing
+		// WriteSeqDumper keep the largest one with the write
+		WriteSeq uint64
+	}
+
+	// ChangeDumper is implemented by the dumpers that dump the changed users
+	// together with their metadata in one write, it is preferred to
+	// DumpChanged and DumpMeta by Save
+	ChangeDumper[T any] interface {
+		// DumpChangedWithMeta dumps the changed users like DumpChanged, and
+		// replaces their metadata like MetaDumper.DumpMeta, all at once
+		DumpChangedWithMeta(ctx context.Context, permanentKey string, changed map[UID]DataMap[T], meta map[UID]MetaMap, opt DumpOptions) error
+	}
+)
+
+// IsZero returns true if the metadata holds nothing
+func (m ResourceMeta) IsZero() bool {
+	return m == ResourceMeta{}
+}
+
+// expired returns true if the resource is expired at the given time
+func (m ResourceMeta) expired(now time.Time) bool {
+	return m.ExpireAt > 0 && now.UnixMilli() >= m.ExpireAt
+}
+
+// metaLocked returns the metadata of a resource, the caller must hold the lock of the user
+func (s *InMemoryStorage[TData]) metaLocked(user UID, storeName string) ResourceMeta {
+	return s.shardOf(user).meta[user][storeName]
+}
+
+// setMetaLocked records the metadata of a resource, the zero metadata is
+// removed instead. the caller must hold the write lock of the user
+func (s *InMemoryStorage[TData]) setMetaLocked(user UID, storeName string, meta ResourceMeta) {
+	sh := s.shardOf(user)
+	mm, ok := sh.meta[user]
+	if meta.IsZero() {
+		if ok {
+			delete(mm, storeName)
+			if len(mm) == 0 {
+				delete(sh.meta, user)
+			}
+		}
+		return
+	}
+	if !ok {
+		mm = make(MetaMap)
+		sh.meta[user] = mm
+	}
+	mm[storeName] = meta
+}
+
+// expiredLocked returns true if the resource is expired, the caller must hold the lock of the user
+func (s *InMemoryStorage[TData]) expiredLocked(user UID, storeName string, now time.Time) bool {
+	return s.metaLocked(user, storeName).expired(now)
+}
+
+// collectMetaLocked copies the metadata of the changed users, the purged
+// users are collected as nil. the caller must hold the lock
+func (s *InMemoryStorage[TData]) collectMetaLocked(changed map[UID]DataMap[TData]) map[UID]MetaMap {
+	ret := make(map[UID]MetaMap, len(changed))
+	for user, r := range changed {
+		if r == nil {
+			ret[user] = nil
+			continue
+		}
+		src := s.shardOf(user).meta[user]
+		mm := make(MetaMap, len(src))
+		for k, v := range src {
+			mm[k] = v
+		}
+		ret[user] = mm
+	}
+	return ret
+}
+
+// dumpChanged dumps the changed users and their metadata to permanent storage,
+// the lease is verified first if it is set, and fences the write of a ChangeDumper.
+// writeBack is true if the users are written back to be evicted
+func (s *InMemoryStorage[TData]) dumpChanged(ctx context.Context, changed map[UID]DataMap[TData], meta map[UID]MetaMap, writeBack bool) error {
+	opt := DumpOptions{WriteBack: writeBack, WriteSeq: s.writeSeq.Load()}
+	if s.Lease != nil {
+		fence, err := s.Lease.verify(ctx)
+		if err != nil {
+			return err
+		}
+		opt.Fence = fence
+	}
+	if cd, ok := s.Dumper.(ChangeDumper[TData]); ok {
+		err := cd.DumpChangedWithMeta(ctx, s.PersistentKey, changed, meta, opt)
+		if opt.Fence != nil && errors.Is(err, ErrLeaseLost) {
+			s.Lease.markLost(opt.Fence)
+		}
+		return err
+	}
+	if err := s.Dumper.DumpChanged(ctx, s.PersistentKey, changed); err != nil {
+		return err
+	}
+	if md, ok := s.Dumper.(MetaDumper); ok {
+		return md.DumpMeta(ctx, s.PersistentKey, meta)
+	}
+	return nil
+}
+
+// loadMeta loads the metadata of the given users from permanent storage
+func (s *InMemoryStorage[TData]) loadMeta(ctx context.Context, users []UID) (map[UID]MetaMap, error) {
+	md, ok := s.Dumper.(MetaDumper)
+	if !ok || len(users) == 0 {
+		return nil, nil
+	}
+	return md.LoadMeta(ctx, s.PersistentKey, users)
+}
@@ -0,0 +1,196 @@
+package memstore
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+var (
+	// errStopRange stops the iteration of Range
+	errStopRange = fmt.Errorf("stop range")
+)
+
+type (
+	// Entry is a resource of a user in the storage
+	Entry[TData any] struct {
+		User      UID
+		StoreName string
+		Value     TData
+	}
+
+	// rangeSnapshot is the copy-on-write snapshot of all the users in memory
+	// taken by Range, the resources are shared with the storage until they are modified
+	rangeSnapshot[TData any] struct {
+		users []UID
+		data  map[UID]DataMap[TData]
+		meta  map[UID]MetaMap
+		now   time.Time
+	}
+)
+
+// Range calls fn for each resource in memory, ordered by user and store name,
+// until fn returns false. the resources are visited as they are at the call of
+// Range, the writes during the iteration are not visible to it, and fn may call
+// the methods of the storage. the users that are not in memory, because of
+// LazyLoad or Capacity, are not visited
+func (s *InMemoryStorage[TData]) Range(fn func(user UID, storeName string, value TData) bool) {
+	_ = s.ForEach(func(user UID, storeName string, value TData) error {
+		if !fn(user, storeName, value) {
+			return errStopRange
+		}
+		return nil
+	})
+}
+
+// ForEach is the same as Range, but the iteration is stopped by the first
+// error returned by fn, and the error is returned
+func (s *InMemoryStorage[TData]) ForEach(fn func(user UID, storeName string, value TData) error) error {
+	// validate input
+	if fn == nil {
+		return fmt.Errorf("%w, fn cannot be nil", ErrInvalidInput)
+	}
+	snap := s.snapshotAll()
+	for _, user := range snap.users {
+		r := snap.data[user]
+		for _, storeName := range sortedStoreNames(r) {
+			// an expired resource is treated as missing
+			if snap.meta[user][storeName].expired(snap.now) {
+				continue
+			}
+			if err := fn(user, storeName, r[storeName]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Query returns the resources in memory that match pred, ordered by user and
+// store name, the same as Range
+func (s *InMemoryStorage[TData]) Query(pred func(user UID, storeName string, value TData) bool) ([]Entry[TData], error) {
+	// validate input
+	if pred == nil {
+		return nil, fmt.Errorf("%w, pred cannot be nil", ErrInvalidInput)
+	}
+	var ret []Entry[TData]
+	s.Range(func(user UID, storeName string, value TData) bool {
+		if pred(user, storeName, value) {
+			ret = append(ret, Entry[TData]{User: user, StoreName: storeName, Value: value})
+		}
+		return true
+	})
+	return ret, nil
+}
+
+// UpdateWhere applies updateFn to every resource in memory that matches pred,
+// the same as Update, and returns the count of the updated resources. the
+// updates are applied all together as a transaction, an error returned by
+// updateFn aborts all of them. pred and updateFn must not call the methods
+// of the storage, since the storage is locked while they run
+func (s *InMemoryStorage[TData]) UpdateWhere(pred func(user UID, storeName string, value TData) bool, updateFn func(user UID, org *TData) (*TData, error)) (int, error) {
+	// validate input
+	if pred == nil {
+		return 0, fmt.Errorf("%w, pred cannot be nil", ErrInvalidInput)
+	}
+	if updateFn == nil {
+		return 0, fmt.Errorf("%w, updateFn cannot be nil", ErrInvalidInput)
+	}
+	// the updated resources may exceed the capacity, check it after unlocking
+	defer s.evictIfNeeded()
+	// lock the mutex
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// collect the updates of each user in a transaction
+	now := time.Now()
+	count := 0
+	var txs []*Txn[TData]
+	for _, user := range s.usersLocked() {
+		r := s.shardOf(user).data[user]
+		tx := newTxn(s, user, now)
+		for _, storeName := range sortedStoreNames(r) {
+			if s.expiredLocked(user, storeName, now) || !pred(user, storeName, r[storeName]) {
+				continue
+			}
+			if err := tx.Update(storeName, func(org *TData) (*TData, error) {
+				return updateFn(user, org)
+			}); err != nil {
+				return 0, err
+			}
+			count++
+		}
+		if len(tx.writes) > 0 {
+			txs = append(txs, tx)
+		}
+	}
+	if len(txs) == 0 {
+		return 0, nil
+	}
+
+	// write ahead to the journal as a single record
+	rec := journalRecord[TData]{Op: journalOpTxn}
+	version := s.writeSeq.Add(1)
+	for _, tx := range txs {
+		tx.stamp(version)
+		rec.Ops = append(rec.Ops, tx.journalOps()...)
+	}
+	if err := s.journalLocked(rec); err != nil {
+		return 0, err
+	}
+	for _, tx := range txs {
+		tx.applyLocked()
+	}
+	return count, nil
+}
+
+// snapshotAll takes the snapshot of all the users in memory, the writers
+// are blocked only while the snapshot is taken
+func (s *InMemoryStorage[TData]) snapshotAll() *rangeSnapshot[TData] {
+	// lock the mutex
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := &rangeSnapshot[TData]{
+		users: s.usersLocked(),
+		data:  make(map[UID]DataMap[TData]),
+		meta:  make(map[UID]MetaMap),
+		now:   time.Now(),
+	}
+	for _, user := range snap.users {
+		sh := s.shardOf(user)
+		sh.shared[user] = struct{}{}
+		snap.data[user] = sh.data[user]
+		if mm, ok := sh.meta[user]; ok {
+			cp := make(MetaMap, len(mm))
+			for k, v := range mm {
+				cp[k] = v
+			}
+			snap.meta[user] = cp
+		}
+	}
+	return snap
+}
+
+// usersLocked returns the users in memory in ascending order, the caller
+// must hold the storage lock for writing
+func (s *InMemoryStorage[TData]) usersLocked() []UID {
+	users := make([]UID, 0)
+	for _, sh := range s.shards {
+		for user := range sh.data {
+			users = append(users, user)
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+// sortedStoreNames returns the store names of the resources in ascending order
+func sortedStoreNames[TData any](r DataMap[TData]) []string {
+	names := make([]string, 0, len(r))
+	for storeName := range r {
+		names = append(names, storeName)
+	}
+	sort.Strings(names)
+	return names
+}
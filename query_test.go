@@ -0,0 +1,115 @@
+package memstore_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/khgame/memstore"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_InMemStorage_Range tests the Range, ForEach and Query method of InMemStorage with testify
+func Test_InMemStorage_Range(t *testing.T) {
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "gold", Quantity: 20}))
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "wood", Quantity: 1}))
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "gold", Quantity: 10}))
+	assert.NoError(t, storage.SetWithExpiry("uid001", &TestDataType{Name: "ticket", Quantity: 1}, time.Now().Add(-time.Second)))
+
+	// the writes during the iteration are not visible, and do not block
+	var visited []string
+	storage.Range(func(user memstore.UID, storeName string, value TestDataType) bool {
+		visited = append(visited, user+"/"+storeName)
+		assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "wood", Quantity: 100}))
+		assert.NoError(t, storage.Set("uid003", &TestDataType{Name: "gold", Quantity: 30}))
+		if storeName == "wood" {
+			assert.Equal(t, int64(1), value.Quantity)
+		}
+		return true
+	})
+	assert.Equal(t, []string{"uid001/gold", "uid001/wood", "uid002/gold"}, visited)
+
+	// the iteration is stopped by fn
+	visited = visited[:0]
+	storage.Range(func(user memstore.UID, storeName string, value TestDataType) bool {
+		visited = append(visited, user+"/"+storeName)
+		return len(visited) < 2
+	})
+	assert.Equal(t, []string{"uid001/gold", "uid001/wood"}, visited)
+	errStop := errors.New("stop")
+	assert.ErrorIs(t, storage.ForEach(func(user memstore.UID, storeName string, value TestDataType) error {
+		return errStop
+	}), errStop)
+
+	entries, err := storage.Query(func(user memstore.UID, storeName string, value TestDataType) bool {
+		return storeName == "gold" && value.Quantity >= 20
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []memstore.Entry[TestDataType]{
+		{User: "uid002", StoreName: "gold", Value: TestDataType{Name: "gold", Quantity: 20}},
+		{User: "uid003", StoreName: "gold", Value: TestDataType{Name: "gold", Quantity: 30}},
+	}, entries)
+}
+
+// Test_InMemStorage_UpdateWhere tests the UpdateWhere method of InMemStorage with testify
+func Test_InMemStorage_UpdateWhere(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test_storage.journal")
+	journal, err := memstore.OpenJournal[TestDataType](path, memstore.JournalOptions{})
+	assert.NoError(t, err)
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = createCacheDumper[TestDataType]()
+	storage.Journal = journal
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "gold", Quantity: 10}))
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "wood", Quantity: 1}))
+	assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "gold", Quantity: 20}))
+	assert.NoError(t, storage.Set("uid003", &TestDataType{Name: "wood", Quantity: 3}))
+	assert.NoError(t, storage.Save(ctx))
+
+	isGold := func(user memstore.UID, storeName string, value TestDataType) bool {
+		return storeName == "gold"
+	}
+
+	// an error of updateFn aborts all the updates
+	n, err := storage.UpdateWhere(isGold, func(user memstore.UID, org *TestDataType) (*TestDataType, error) {
+		if user == "uid002" {
+			return nil, errNotEnough
+		}
+		org.Quantity = 0
+		return org, nil
+	})
+	assert.ErrorIs(t, err, errNotEnough)
+	assert.Equal(t, 0, n)
+	assert.False(t, storage.IsDirty())
+
+	// the season reset grants a compensation to every gold owner
+	w := storage.Watch(memstore.WatchOptions{})
+	defer w.Close()
+	n, err = storage.UpdateWhere(isGold, func(user memstore.UID, org *TestDataType) (*TestDataType, error) {
+		org.Quantity += 5
+		return org, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []memstore.UID{"uid001", "uid002"}, storage.DirtyUsers())
+	assert.Equal(t, 2, len(drain(w)))
+
+	// the updates are replayed from the journal as a whole
+	assert.NoError(t, journal.Close())
+	journal, err = memstore.OpenJournal[TestDataType](path, memstore.JournalOptions{})
+	assert.NoError(t, err)
+	defer journal.Close()
+	storage2 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage2.Dumper = storage.Dumper
+	storage2.Journal = journal
+	assert.NoError(t, storage2.Load(ctx))
+	entries, err := storage2.Query(isGold)
+	assert.NoError(t, err)
+	assert.Equal(t, []memstore.Entry[TestDataType]{
+		{User: "uid001", StoreName: "gold", Value: TestDataType{Name: "gold", Quantity: 15}},
+		{User: "uid002", StoreName: "gold", Value: TestDataType{Name: "gold", Quantity: 25}},
+	}, entries)
+}
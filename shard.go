@@ -0,0 +1,153 @@
+package memstore
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// shardCount is the count of the shards of a storage, the users are
+// distributed to the shards by the hash of their uid
+const shardCount = 64
+
+type (
+	// shard holds the users of a storage with the same hash, the users in
+	// different shards are modified concurrently
+	shard[TData any] struct {
+		// mu protects the maps of the shard
+		mu sync.RWMutex
+		// data is the actual data map
+		data map[UID]DataMap[TData]
+		// meta is the metadata of the resources, only the resources
+		// with non-zero metadata are recorded
+		meta map[UID]MetaMap
+		// seq is the sequence number of the last modification in the shard,
+		// it is protected by mu rather than shared by the shards
+		seq uint64
+		// dirty records the users that have been modified since the last save,
+		// with the sequence number of their last modification
+		dirty map[UID]uint64
+		// written records the sequence number of the last modification of
+		// the users in memory, it is kept after they are saved, so that a
+		// reloading that is started before a modification is discarded
+		written map[UID]uint64
+		// failed records the users that failed to be loaded by the last Load
+		failed map[UID]LoadFailure
+		// shared records the users whose resources are referenced by a
+		// snapshot, they are copied before modified
+		shared map[UID]struct{}
+	}
+)
+
+// newShards creates the empty shards of a storage
+func newShards[TData any]() []*shard[TData] {
+	shards := make([]*shard[TData], shardCount)
+	for i := range shards {
+		shards[i] = &shard[TData]{
+			data:    make(map[UID]DataMap[TData]),
+			meta:    make(map[UID]MetaMap),
+			dirty:   make(map[UID]uint64),
+			written: make(map[UID]uint64),
+			failed:  make(map[UID]LoadFailure),
+			shared:  make(map[UID]struct{}),
+		}
+	}
+	return shards
+}
+
+// shardIndex returns the index of the shard of a user
+func shardIndex(user UID) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(user))
+	return int(h.Sum32() % shardCount)
+}
+
+// shardOf returns the shard of a user
+func (s *InMemoryStorage[TData]) shardOf(user UID) *shard[TData] {
+	return s.shards[shardIndex(user)]
+}
+
+// lockUser locks the user for writing, and returns the unlock function.
+// the storage lock is held for reading, so that the storage-wide
+// operations are excluded
+func (s *InMemoryStorage[TData]) lockUser(user UID) (unlock func()) {
+	sh := s.shardOf(user)
+	s.mu.RLock()
+	sh.mu.Lock()
+	return func() {
+		sh.mu.Unlock()
+		s.mu.RUnlock()
+	}
+}
+
+// rlockUser locks the user for reading, and returns the unlock function
+func (s *InMemoryStorage[TData]) rlockUser(user UID) (unlock func()) {
+	sh := s.shardOf(user)
+	s.mu.RLock()
+	sh.mu.RLock()
+	return func() {
+		sh.mu.RUnlock()
+		s.mu.RUnlock()
+	}
+}
+
+// lockUsers locks the given users for writing, and returns the unlock function.
+// the shards are locked in ascending order of their indexes, so that the
+// callers locking overlapping users do not deadlock
+func (s *InMemoryStorage[TData]) lockUsers(users []UID) (unlock func()) {
+	indexes := shardIndexes(users)
+	s.mu.RLock()
+	for _, i := range indexes {
+		s.shards[i].mu.Lock()
+	}
+	return func() {
+		for j := len(indexes) - 1; j >= 0; j-- {
+			s.shards[indexes[j]].mu.Unlock()
+		}
+		s.mu.RUnlock()
+	}
+}
+
+// rlockUsers locks the given users for reading, and returns the unlock function
+func (s *InMemoryStorage[TData]) rlockUsers(users []UID) (unlock func()) {
+	indexes := shardIndexes(users)
+	s.mu.RLock()
+	for _, i := range indexes {
+		s.shards[i].mu.RLock()
+	}
+	return func() {
+		for j := len(indexes) - 1; j >= 0; j-- {
+			s.shards[indexes[j]].mu.RUnlock()
+		}
+		s.mu.RUnlock()
+	}
+}
+
+// shardIndexes returns the distinct shard indexes of the users in ascending order
+func shardIndexes(users []UID) []int {
+	indexes := make([]int, 0, len(users))
+	seen := make(map[int]struct{}, len(users))
+	for _, user := range users {
+		i := shardIndex(user)
+		if _, ok := seen[i]; !ok {
+			seen[i] = struct{}{}
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// countUsers returns the count of the users in memory
+func (s *InMemoryStorage[TData]) countUsers() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	n := 0
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		n += len(sh.data)
+		sh.mu.RUnlock()
+	}
+	return n
+}
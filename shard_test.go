@@ -0,0 +1,147 @@
+package memstore_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/khgame/memstore"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_InMemStorage_ConcurrentUsers tests the concurrent writes of different users with testify
+func Test_InMemStorage_ConcurrentUsers(t *testing.T) {
+	ctx := context.Background()
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = createCacheDumper[TestDataType]()
+
+	// the writers of different users run along with the saves
+	wg := sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(user string) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				assert.NoError(t, storage.Update(user, "gold", func(org *TestDataType) (*TestDataType, error) {
+					if org == nil {
+						org = &TestDataType{Name: "gold"}
+					}
+					org.Quantity++
+					return org, nil
+				}))
+			}
+		}(fmt.Sprintf("uid%03d", i))
+	}
+	stop := make(chan struct{})
+	saved := make(chan struct{})
+	go func() {
+		defer close(saved)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				assert.NoError(t, storage.Save(ctx))
+			}
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	<-saved
+	assert.NoError(t, storage.Save(ctx))
+	assert.False(t, storage.IsDirty())
+
+	// every user is saved with all of its writes
+	storage2 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage2.Dumper = storage.Dumper
+	assert.NoError(t, storage2.Load(ctx))
+	for i := 0; i < 16; i++ {
+		data := TestDataType{Name: "gold"}
+		assert.NoError(t, storage2.Get(fmt.Sprintf("uid%03d", i), &data))
+		assert.Equal(t, int64(100), data.Quantity)
+	}
+}
+
+// benchmarkUsers are the users written by the benchmarks
+var benchmarkUsers = func() []string {
+	users := make([]string, 1024)
+	for i := range users {
+		users[i] = fmt.Sprintf("uid%04d", i)
+	}
+	return users
+}()
+
+// runParallelUsers runs fn in parallel with the users of each goroutine, the
+// goroutines start at different offsets and walk the users on their own, so
+// that they write different users without sharing a counter
+func runParallelUsers(b *testing.B, fn func(user string)) {
+	offset := atomic.Uint64{}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(offset.Add(97))
+		for pb.Next() {
+			fn(benchmarkUsers[i%len(benchmarkUsers)])
+			i++
+		}
+	})
+}
+
+// lockedMap is the baseline of the benchmarks, a map of the users guarded
+// by a single lock like the storage before it is sharded
+type lockedMap struct {
+	mu   sync.RWMutex
+	data map[string]map[string]TestDataType
+}
+
+// BenchmarkLockedMap_Set is the baseline of BenchmarkInMemStorage_Set
+func BenchmarkLockedMap_Set(b *testing.B) {
+	m := &lockedMap{data: make(map[string]map[string]TestDataType)}
+	runParallelUsers(b, func(user string) {
+		m.mu.Lock()
+		r, ok := m.data[user]
+		if !ok {
+			r = make(map[string]TestDataType)
+			m.data[user] = r
+		}
+		r["gold"] = TestDataType{Name: "gold", Quantity: 1}
+		m.mu.Unlock()
+	})
+}
+
+// BenchmarkInMemStorage_Set benchmarks the parallel Set of different users,
+// run it with -cpu=1,2,4,8 and compare it with BenchmarkLockedMap_Set to see
+// the throughput on multiple cores
+func BenchmarkInMemStorage_Set(b *testing.B) {
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	runParallelUsers(b, func(user string) {
+		_ = storage.Set(user, &TestDataType{Name: "gold", Quantity: 1})
+	})
+}
+
+// BenchmarkInMemStorage_Get benchmarks the parallel Get of different users
+func BenchmarkInMemStorage_Get(b *testing.B) {
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	for _, user := range benchmarkUsers {
+		_ = storage.Set(user, &TestDataType{Name: "gold", Quantity: 1})
+	}
+	runParallelUsers(b, func(user string) {
+		data := TestDataType{Name: "gold"}
+		_ = storage.Get(user, &data)
+	})
+}
+
+// BenchmarkInMemStorage_Update benchmarks the parallel Update of different users
+func BenchmarkInMemStorage_Update(b *testing.B) {
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	runParallelUsers(b, func(user string) {
+		_ = storage.Update(user, "gold", func(org *TestDataType) (*TestDataType, error) {
+			if org == nil {
+				org = &TestDataType{Name: "gold"}
+			}
+			org.Quantity++
+			return org, nil
+		})
+	})
+}
@@ -0,0 +1,101 @@
+package memstore
+
+import (
+	"fmt"
+	"time"
+)
+
+type (
+	// saveSnapshot is the copy-on-write snapshot of the changed users taken by
+	// Save. the resources are shared with the storage until they are modified
+	saveSnapshot[TData any] struct {
+		// changed is the resources of the changed users, the purged users are nil
+		changed map[UID]DataMap[TData]
+		// meta is the copied metadata of the changed users
+		meta map[UID]MetaMap
+		// seqs is the sequence number of the last modification of each user
+		seqs map[UID]uint64
+		// journalOffset is the end of the journaled mutations in the snapshot
+		journalOffset int64
+	}
+)
+
+// snapshot takes the snapshot of the changed users, nil is returned if the
+// storage is not dirty. the writers are blocked only while the snapshot is taken
+func (s *InMemoryStorage[TData]) snapshot() (*saveSnapshot[TData], error) {
+	// lock the mutex
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// if the storage is not dirty, do nothing
+	if !s.IsDirty() {
+		return nil, nil
+	}
+
+	// if the dumper is not set, return an error
+	if s.Dumper == nil {
+		s.saveErr = fmt.Errorf("%w, dumper is not set", ErrStatusError)
+		return nil, s.saveErr
+	}
+
+	// collect the changed users, the purged users are collected as nil
+	snap := &saveSnapshot[TData]{
+		changed: make(map[UID]DataMap[TData]),
+		seqs:    make(map[UID]uint64),
+	}
+	for _, sh := range s.shards {
+		for user, seq := range sh.dirty {
+			r, ok := sh.data[user]
+			if ok {
+				sh.shared[user] = struct{}{}
+			}
+			snap.changed[user] = r
+			snap.seqs[user] = seq
+		}
+	}
+	snap.meta = s.collectMetaLocked(snap.changed)
+	if s.Journal != nil {
+		snap.journalOffset = s.Journal.offset()
+	}
+	return snap, nil
+}
+
+// finishSnapshot marks the users clean if the snapshot is saved, the users
+// modified after the snapshot stay dirty. the resources stay shared, since
+// other snapshots may reference them, they are copied on the next write
+func (s *InMemoryStorage[TData]) finishSnapshot(snap *saveSnapshot[TData], saved bool, err error) {
+	// lock the mutex
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for user, seq := range snap.seqs {
+		if cur, dirty := s.shardOf(user).dirty[user]; saved && dirty && cur == seq {
+			s.markClean(user)
+		}
+	}
+	if saved {
+		s.saveTime = time.Now()
+	}
+	s.saveErr = err
+}
+
+// writableLocked returns the resources of the user to modify, they are copied
+// first if they are shared with a snapshot. false is returned if the user
+// does not exist. the caller must hold the write lock of the user
+func (s *InMemoryStorage[TData]) writableLocked(user UID) (DataMap[TData], bool) {
+	sh := s.shardOf(user)
+	r, ok := sh.data[user]
+	if !ok {
+		return nil, false
+	}
+	if _, shared := sh.shared[user]; shared {
+		cp := make(DataMap[TData], len(r))
+		for k, v := range r {
+			cp[k] = v
+		}
+		r = cp
+		sh.data[user] = r
+		delete(sh.shared, user)
+	}
+	return r, true
+}
@@ -0,0 +1,84 @@
+package memstore_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/khgame/memstore"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingDumper is a dumper that blocks DumpChanged until it is released
+type blockingDumper[T any] struct {
+	memstore.Dumper[T]
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *blockingDumper[T]) DumpChanged(ctx context.Context, permanentKey string, changed map[memstore.UID]memstore.DataMap[T]) error {
+	d.started <- struct{}{}
+	<-d.release
+	return d.Dumper.DumpChanged(ctx, permanentKey, changed)
+}
+
+// Test_InMemStorage_SaveSnapshot tests that Save does not block the writers and keeps their writes dirty with testify
+func Test_InMemStorage_SaveSnapshot(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test_storage.journal")
+	journal, err := memstore.OpenJournal[TestDataType](path, memstore.JournalOptions{})
+	assert.NoError(t, err)
+	dp := &blockingDumper[TestDataType]{
+		Dumper:  createCacheDumper[TestDataType](),
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = dp
+	storage.Journal = journal
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: 1}))
+	assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "res001", Quantity: 2}))
+
+	saved := make(chan error)
+	go func() { saved <- storage.Save(ctx) }()
+	<-dp.started
+
+	// the writers are not blocked by the dump
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: 10}))
+	assert.NoError(t, storage.Delete("uid001", "res002"))
+	assert.NoError(t, storage.Set("uid003", &TestDataType{Name: "res001", Quantity: 3}))
+	data := TestDataType{Name: "res001"}
+	assert.NoError(t, storage.Get("uid001", &data))
+	assert.Equal(t, int64(10), data.Quantity)
+
+	close(dp.release)
+	assert.NoError(t, <-saved)
+	assert.NoError(t, storage.LastSaveError())
+
+	// the users written during the dump stay dirty
+	assert.Equal(t, []memstore.UID{"uid001", "uid003"}, storage.DirtyUsers())
+
+	// the snapshot is saved without the writes made during the dump
+	storage2 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage2.Dumper = dp.Dumper
+	assert.NoError(t, storage2.Load(ctx))
+	assert.NoError(t, storage2.Get("uid001", &data))
+	assert.Equal(t, int64(1), data.Quantity)
+	_, err = storage2.List("uid003")
+	assert.ErrorIs(t, err, memstore.ErrUserNotFound)
+
+	// the journal keeps the writes made during the dump
+	assert.NoError(t, journal.Close())
+	journal, err = memstore.OpenJournal[TestDataType](path, memstore.JournalOptions{})
+	assert.NoError(t, err)
+	defer journal.Close()
+	storage3 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage3.Dumper = dp.Dumper
+	storage3.Journal = journal
+	assert.NoError(t, storage3.Load(ctx))
+	assert.Equal(t, []memstore.UID{"uid001", "uid003"}, storage3.DirtyUsers())
+	assert.NoError(t, storage3.Get("uid001", &data))
+	assert.Equal(t, int64(10), data.Quantity)
+	assert.NoError(t, storage3.Get("uid003", &data))
+	assert.Equal(t, int64(3), data.Quantity)
+}
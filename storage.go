@@ -5,19 +5,37 @@ import "context"
 type (
 	// Storage is an interface that all storage implementations must implement
 	Storage[DataType StorableType] interface {
-		// Get retrieves a resource for a given user
+		// Get retrieves a resource for a given user, it returns ErrUserNotFound
+		// if the user does not exist, and ErrResourceNotFound if the resource does not exist
 		Get(user string, out *DataType) error
 		// List retrieves all resources' StoreName() for a given user
 		List(user string) ([]string, error)
+		// GetMany retrieves several resources for a given user at once,
+		// the resources that do not exist are reported as missing
+		GetMany(user string, storeNames []string) (found map[string]DataType, missing []string, err error)
+		// GetForUsers retrieves a resource for several users at once, the
+		// users that do not have the resource are reported as missing
+		GetForUsers(users []string, storeName string) (found map[string]DataType, missing []string, err error)
 
 		// Set sets a resource for a given user
 		Set(user string, in *DataType) error
+		// SetMany sets several resources for a given user at once
+		SetMany(user string, values []*DataType) error
+
+		// GetWithVersion retrieves a resource for a given user with its version
+		GetWithVersion(user string, out *DataType) (uint64, error)
+		// CompareAndSet sets a resource for a given user only if its version
+		// is expectedVersion, and returns the new version
+		CompareAndSet(user string, in *DataType, expectedVersion uint64) (uint64, error)
 
 		// Update updates a resource for a given user, using the updateFn
 		// to ensure that the resource is updated atomically (CAS)
 		Update(user string, storeName string, updateFn func(org *DataType) (updated *DataType, err error)) error
 		// Delete deletes a resource for a given user
 		Delete(user string, storeName string) error
+		// Purge deletes a given user with all its resources, including
+		// the data in the permanent storage
+		Purge(user string) error
 
 		// IsDirty returns true if the storage has been modified since
 		IsDirty() bool
@@ -0,0 +1,397 @@
+package memstore
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+type (
+	// Txn is a transaction on the resources of a user, the writes are
+	// buffered and applied all together when the transaction commits.
+	// a Txn is only valid inside the function passed to InMemoryStorage.Txn
+	Txn[TData StorableType] struct {
+		s    *InMemoryStorage[TData]
+		user UID
+		now  time.Time
+		done *bool
+		// err is the first error returned by an update function, the
+		// transaction is aborted with it even if the function ignores it
+		err error
+
+		// writes is the pending writes by store name, in the order of the first write
+		writes map[string]*txnWrite[TData]
+		order  []string
+	}
+
+	// txnWrite is the pending write of a resource in a transaction
+	txnWrite[TData any] struct {
+		kind ChangeKind
+		// value is the resource after the write, nil if it is deleted
+		value *TData
+		meta  ResourceMeta
+	}
+
+	// MultiTxn is a transaction on the resources of several users, the writes
+	// of all the users are applied all together when the transaction commits.
+	// a MultiTxn is only valid inside the function passed to InMemoryStorage.TxnUsers
+	MultiTxn[TData StorableType] struct {
+		txs  map[UID]*Txn[TData]
+		done bool
+	}
+)
+
+// Txn runs fn in a transaction on the resources of a user. the resources read
+// and written by fn through tx are isolated from the other writers, and the
+// writes are applied all together if fn returns nil, or discarded if it
+// returns an error. fn must not call the methods of the storage, since the
+// users of the transaction are locked while it runs
+func (s *InMemoryStorage[TData]) Txn(user string, fn func(tx *Txn[TData]) error) error {
+	// validate input
+	if user == "" {
+		return fmt.Errorf("%w, user cannot be empty", ErrInvalidUser)
+	}
+	if fn == nil {
+		return fmt.Errorf("%w, fn cannot be nil", ErrInvalidInput)
+	}
+	// load the user if it is not in memory
+	release, err := s.loadUser(user)
+	if err != nil {
+		return err
+	}
+	defer release()
+	// the written resources may exceed the capacity, check it after unlocking
+	defer s.evictIfNeeded()
+	// lock the user
+	unlock := s.lockUsers([]UID{user})
+	defer unlock()
+
+	tx := newTxn(s, user, time.Now())
+	defer func() { *tx.done = true }()
+	if err = fn(tx); err != nil {
+		return err
+	}
+	if tx.err != nil {
+		return tx.err
+	}
+	if len(tx.writes) == 0 {
+		return nil
+	}
+	tx.stamp(s.writeSeq.Add(1))
+	// write ahead to the journal as a single record
+	if err = s.journalLocked(journalRecord[TData]{Op: journalOpTxn, User: user, Ops: tx.journalOps()}); err != nil {
+		return err
+	}
+	tx.applyLocked()
+	return nil
+}
+
+// TxnUsers runs fn in a transaction on the resources of several users, the
+// same as Txn. the users are locked in ascending order, so that the
+// concurrent transactions on overlapping users do not deadlock. the writes
+// of all the users are applied if fn returns nil, or none of them otherwise
+func (s *InMemoryStorage[TData]) TxnUsers(users []UID, fn func(tx *MultiTxn[TData]) error) error {
+	// validate input
+	if len(users) == 0 {
+		return fmt.Errorf("%w, users cannot be empty", ErrInvalidUser)
+	}
+	for _, user := range users {
+		if user == "" {
+			return fmt.Errorf("%w, user cannot be empty", ErrInvalidUser)
+		}
+	}
+	if fn == nil {
+		return fmt.Errorf("%w, fn cannot be nil", ErrInvalidInput)
+	}
+	users = sortedUsers(users)
+	// load the users if they are not in memory
+	for _, user := range users {
+		release, err := s.loadUser(user)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	// the written resources may exceed the capacity, check it after unlocking
+	defer s.evictIfNeeded()
+	// lock the users
+	unlock := s.lockUsers(users)
+	defer unlock()
+
+	mtx := &MultiTxn[TData]{txs: make(map[UID]*Txn[TData], len(users))}
+	now := time.Now()
+	for _, user := range users {
+		tx := newTxn(s, user, now)
+		tx.done = &mtx.done
+		mtx.txs[user] = tx
+	}
+	defer func() { mtx.done = true }()
+	if err := fn(mtx); err != nil {
+		return err
+	}
+
+	// write ahead to the journal as a single record
+	rec := journalRecord[TData]{Op: journalOpTxn}
+	version := s.writeSeq.Add(1)
+	for _, user := range users {
+		tx := mtx.txs[user]
+		if tx.err != nil {
+			return tx.err
+		}
+		tx.stamp(version)
+		rec.Ops = append(rec.Ops, tx.journalOps()...)
+	}
+	if len(rec.Ops) == 0 {
+		return nil
+	}
+	if err := s.journalLocked(rec); err != nil {
+		return err
+	}
+	for _, user := range users {
+		if tx := mtx.txs[user]; len(tx.writes) > 0 {
+			tx.applyLocked()
+		}
+	}
+	return nil
+}
+
+// For returns the transaction on the resources of a user, the user must be
+// one of the users of the transaction
+func (mtx *MultiTxn[TData]) For(user UID) (*Txn[TData], error) {
+	if mtx.done {
+		return nil, fmt.Errorf("%w, transaction is finished", ErrStatusError)
+	}
+	tx, ok := mtx.txs[user]
+	if !ok {
+		return nil, fmt.Errorf("%w, user %s is not in the transaction", ErrInvalidUser, user)
+	}
+	return tx, nil
+}
+
+// sortedUsers returns the distinct users in ascending order
+func sortedUsers(users []UID) []UID {
+	ret := make([]UID, 0, len(users))
+	seen := make(map[UID]struct{}, len(users))
+	for _, user := range users {
+		if _, ok := seen[user]; !ok {
+			seen[user] = struct{}{}
+			ret = append(ret, user)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// newTxn creates a transaction on the resources of a user
+func newTxn[TData StorableType](s *InMemoryStorage[TData], user UID, now time.Time) *Txn[TData] {
+	return &Txn[TData]{
+		s:      s,
+		user:   user,
+		now:    now,
+		done:   new(bool),
+		writes: make(map[string]*txnWrite[TData]),
+	}
+}
+
+// committedLocked returns the committed resource, an expired resource is treated as missing
+func (tx *Txn[TData]) committedLocked(storeName string) (*TData, ResourceMeta) {
+	v, ok := tx.s.shardOf(tx.user).data[tx.user][storeName]
+	if !ok || tx.s.expiredLocked(tx.user, storeName, tx.now) {
+		return nil, ResourceMeta{}
+	}
+	return &v, tx.s.metaLocked(tx.user, storeName)
+}
+
+// current returns the resource seen by the transaction
+func (tx *Txn[TData]) current(storeName string) (*TData, ResourceMeta) {
+	if w, ok := tx.writes[storeName]; ok {
+		return w.value, w.meta
+	}
+	return tx.committedLocked(storeName)
+}
+
+// write records a pending write
+func (tx *Txn[TData]) write(storeName string, kind ChangeKind, value *TData, meta ResourceMeta) {
+	w, ok := tx.writes[storeName]
+	if !ok {
+		w = &txnWrite[TData]{}
+		tx.writes[storeName] = w
+		tx.order = append(tx.order, storeName)
+	}
+	w.kind, w.value, w.meta = kind, value, meta
+}
+
+// check returns an error if the transaction is already finished
+func (tx *Txn[TData]) check() error {
+	if *tx.done {
+		return fmt.Errorf("%w, transaction is finished", ErrStatusError)
+	}
+	return nil
+}
+
+// User returns the user of the transaction
+func (tx *Txn[TData]) User() UID {
+	return tx.user
+}
+
+// Get retrieves a resource in the transaction, the pending writes are visible.
+// ErrResourceNotFound is returned if the resource does not exist
+func (tx *Txn[TData]) Get(out *TData) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	if out == nil {
+		return fmt.Errorf("%w, output cannot be nil", ErrInvalidInput)
+	}
+	storeName := (*out).StoreName()
+	v, _ := tx.current(storeName)
+	if v == nil {
+		var zero TData
+		*out = zero
+		return fmt.Errorf("%w, user: %s, storeName: %s", ErrResourceNotFound, tx.user, storeName)
+	}
+	*out = *v
+	return nil
+}
+
+// List retrieves all resources' StoreName() in the transaction, sorted by name
+func (tx *Txn[TData]) List() ([]string, error) {
+	if err := tx.check(); err != nil {
+		return nil, err
+	}
+	committed := tx.s.shardOf(tx.user).data[tx.user]
+	ret := make([]string, 0, len(committed)+len(tx.writes))
+	for storeName := range committed {
+		if _, written := tx.writes[storeName]; written {
+			continue
+		}
+		if !tx.s.expiredLocked(tx.user, storeName, tx.now) {
+			ret = append(ret, storeName)
+		}
+	}
+	for storeName, w := range tx.writes {
+		if w.value != nil {
+			ret = append(ret, storeName)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// Set stores a resource in the transaction, the expiry of the resource is cleared
+func (tx *Txn[TData]) Set(in *TData) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	if in == nil {
+		return fmt.Errorf("%w, output cannot be nil", ErrInvalidInput)
+	}
+	v := *in
+	tx.write(v.StoreName(), ChangeSet, &v, ResourceMeta{})
+	return nil
+}
+
+// Update updates a resource in the transaction, the same as InMemoryStorage.Update
+// it receives nil if the resource does not exist, and returning nil deletes it.
+// an error returned by updateFn aborts the whole transaction
+func (tx *Txn[TData]) Update(storeName string, updateFn func(*TData) (*TData, error)) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	if storeName == "" {
+		return fmt.Errorf("%w, storeName cannot be empty", ErrInvalidInput)
+	}
+	if updateFn == nil {
+		return fmt.Errorf("%w, updateFn cannot be nil", ErrInvalidInput)
+	}
+	cur, meta := tx.current(storeName)
+	var rp *TData
+	if cur != nil {
+		v := *cur
+		rp = &v
+	}
+	rp, err := updateFn(rp)
+	if err != nil {
+		if tx.err == nil {
+			tx.err = err
+		}
+		return err
+	}
+	if rp == nil {
+		if cur != nil {
+			tx.write(storeName, ChangeDelete, nil, ResourceMeta{})
+		}
+		return nil
+	}
+	// the expiry is kept
+	v := *rp
+	tx.write(storeName, ChangeUpdate, &v, meta)
+	return nil
+}
+
+// Delete deletes a resource in the transaction
+func (tx *Txn[TData]) Delete(storeName string) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	if storeName == "" {
+		return fmt.Errorf("%w, storeName cannot be empty", ErrInvalidInput)
+	}
+	tx.write(storeName, ChangeDelete, nil, ResourceMeta{})
+	return nil
+}
+
+// stamp sets the version of the pending writes, the writes committed
+// together have the same version
+func (tx *Txn[TData]) stamp(version uint64) {
+	for _, w := range tx.writes {
+		if w.value != nil {
+			w.meta.Version = version
+		}
+	}
+}
+
+// journalOps returns the journal records of the pending writes
+func (tx *Txn[TData]) journalOps() []journalRecord[TData] {
+	ops := make([]journalRecord[TData], 0, len(tx.order))
+	for _, storeName := range tx.order {
+		w := tx.writes[storeName]
+		if w.value == nil {
+			ops = append(ops, journalRecord[TData]{Op: journalOpDel, User: tx.user, StoreName: storeName})
+			continue
+		}
+		ops = append(ops, journalRecord[TData]{Op: journalOpSet, User: tx.user, StoreName: storeName, Value: w.value, ExpireAt: w.meta.ExpireAt, Version: w.meta.Version})
+	}
+	return ops
+}
+
+// applyLocked applies the pending writes, the caller must hold the write lock
+func (tx *Txn[TData]) applyLocked() {
+	s, user := tx.s, tx.user
+
+	// mark the user as dirty
+	s.markDirty(user)
+
+	// get the resources of the user
+	r := s.userDataLocked(user)
+
+	// apply the writes in order
+	for _, storeName := range tx.order {
+		w := tx.writes[storeName]
+		old, _ := tx.committedLocked(storeName)
+		if w.value == nil {
+			delete(r, storeName)
+			s.setMetaLocked(user, storeName, ResourceMeta{})
+			s.indexResourceLocked(user, storeName, nil)
+			if old != nil {
+				s.emitLocked(ChangeDelete, user, storeName, old, nil)
+			}
+			continue
+		}
+		r[storeName] = *w.value
+		s.setMetaLocked(user, storeName, w.meta)
+		s.indexResourceLocked(user, storeName, w.value)
+		s.emitLocked(w.kind, user, storeName, old, w.value)
+	}
+	s.resize(user)
+}
@@ -0,0 +1,241 @@
+package memstore_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/khgame/memstore"
+	"github.com/stretchr/testify/assert"
+)
+
+var errNotEnough = errors.New("not enough")
+
+// craft consumes wood and ore to produce a sword in a transaction
+func craft(storage *memstore.InMemoryStorage[TestDataType], user string, wood, ore int64) error {
+	consume := func(tx *memstore.Txn[TestDataType], storeName string, n int64) error {
+		return tx.Update(storeName, func(org *TestDataType) (*TestDataType, error) {
+			if org == nil || org.Quantity < n {
+				return nil, errNotEnough
+			}
+			org.Quantity -= n
+			if org.Quantity == 0 {
+				return nil, nil
+			}
+			return org, nil
+		})
+	}
+	return storage.Txn(user, func(tx *memstore.Txn[TestDataType]) error {
+		if err := consume(tx, "wood", wood); err != nil {
+			return err
+		}
+		if err := consume(tx, "ore", ore); err != nil {
+			return err
+		}
+		return tx.Update("sword", func(org *TestDataType) (*TestDataType, error) {
+			if org == nil {
+				org = &TestDataType{Name: "sword"}
+			}
+			org.Quantity++
+			return org, nil
+		})
+	})
+}
+
+// Test_InMemStorage_Txn tests the transactions of InMemStorage with testify
+func Test_InMemStorage_Txn(t *testing.T) {
+	ctx := context.Background()
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = createCacheDumper[TestDataType]()
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "wood", Quantity: 3}))
+	assert.NoError(t, storage.SetWithTTL("uid001", &TestDataType{Name: "ore", Quantity: 1}, time.Hour))
+	assert.NoError(t, storage.Save(ctx))
+	w := storage.Watch(memstore.WatchOptions{})
+	defer w.Close()
+
+	// the failed transaction changes nothing
+	assert.ErrorIs(t, craft(storage, "uid001", 2, 2), errNotEnough)
+	assert.False(t, storage.IsDirty())
+	assert.Equal(t, 0, len(drain(w)))
+	data := TestDataType{Name: "wood"}
+	assert.NoError(t, storage.Get("uid001", &data))
+	assert.Equal(t, int64(3), data.Quantity)
+
+	// the committed transaction applies all the changes
+	assert.NoError(t, craft(storage, "uid001", 2, 1))
+	assert.Equal(t, []memstore.UID{"uid001"}, storage.DirtyUsers())
+	resources, err := storage.List("uid001")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sword", "wood"}, resources)
+	events := drain(w)
+	assert.Equal(t, []memstore.ChangeEvent[TestDataType]{
+		{Kind: memstore.ChangeUpdate, User: "uid001", StoreName: "wood", Old: &TestDataType{Name: "wood", Quantity: 3}, New: &TestDataType{Name: "wood", Quantity: 1}},
+		{Kind: memstore.ChangeDelete, User: "uid001", StoreName: "ore", Old: &TestDataType{Name: "ore", Quantity: 1}},
+		{Kind: memstore.ChangeUpdate, User: "uid001", StoreName: "sword", New: &TestDataType{Name: "sword", Quantity: 1}},
+	}, events)
+
+	// the pending writes are visible inside the transaction only
+	var leaked *memstore.Txn[TestDataType]
+	err = storage.Txn("uid002", func(tx *memstore.Txn[TestDataType]) error {
+		leaked = tx
+		assert.NoError(t, tx.Set(&TestDataType{Name: "res001", Quantity: 1}))
+		assert.NoError(t, tx.Set(&TestDataType{Name: "res002", Quantity: 2}))
+		assert.NoError(t, tx.Delete("res002"))
+		v := TestDataType{Name: "res001"}
+		assert.NoError(t, tx.Get(&v))
+		assert.Equal(t, int64(1), v.Quantity)
+		names, err := tx.List()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"res001"}, names)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.ErrorIs(t, leaked.Set(&TestDataType{Name: "res003"}), memstore.ErrStatusError)
+	resources, err = storage.List("uid002")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"res001"}, resources)
+
+	// the expiry is kept by Update and cleared by Set
+	assert.NoError(t, storage.SetWithTTL("uid003", &TestDataType{Name: "buff", Quantity: 1}, time.Hour))
+	assert.NoError(t, storage.SetWithTTL("uid003", &TestDataType{Name: "shield", Quantity: 1}, time.Hour))
+	assert.NoError(t, storage.Txn("uid003", func(tx *memstore.Txn[TestDataType]) error {
+		if err := tx.Update("buff", func(org *TestDataType) (*TestDataType, error) {
+			org.Quantity++
+			return org, nil
+		}); err != nil {
+			return err
+		}
+		return tx.Set(&TestDataType{Name: "shield", Quantity: 2})
+	}))
+	expireAt, err := storage.GetExpiry("uid003", "buff")
+	assert.NoError(t, err)
+	assert.False(t, expireAt.IsZero())
+	expireAt, err = storage.GetExpiry("uid003", "shield")
+	assert.NoError(t, err)
+	assert.True(t, expireAt.IsZero())
+}
+
+// Test_InMemStorage_TxnJournal tests that a transaction is replayed from the journal as a whole
+func Test_InMemStorage_TxnJournal(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test_storage.journal")
+	journal, err := memstore.OpenJournal[TestDataType](path, memstore.JournalOptions{})
+	assert.NoError(t, err)
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = createCacheDumper[TestDataType]()
+	storage.Journal = journal
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "wood", Quantity: 2}))
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "ore", Quantity: 1}))
+	assert.NoError(t, storage.Save(ctx))
+	assert.NoError(t, craft(storage, "uid001", 2, 1))
+	assert.NoError(t, journal.Close())
+
+	journal, err = memstore.OpenJournal[TestDataType](path, memstore.JournalOptions{})
+	assert.NoError(t, err)
+	defer journal.Close()
+	storage2 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage2.Dumper = storage.Dumper
+	storage2.Journal = journal
+	assert.NoError(t, storage2.Load(ctx))
+	resources, err := storage2.List("uid001")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sword"}, resources)
+}
+
+// transfer moves n of a resource from one user to another in a transaction
+func transfer(storage *memstore.InMemoryStorage[TestDataType], from, to, storeName string, n int64) error {
+	return storage.TxnUsers([]memstore.UID{from, to}, func(mtx *memstore.MultiTxn[TestDataType]) error {
+		src, err := mtx.For(from)
+		if err != nil {
+			return err
+		}
+		dst, err := mtx.For(to)
+		if err != nil {
+			return err
+		}
+		// the error of the update function aborts the transaction, even if it is ignored
+		_ = src.Update(storeName, func(org *TestDataType) (*TestDataType, error) {
+			if org == nil || org.Quantity < n {
+				return nil, errNotEnough
+			}
+			org.Quantity -= n
+			return org, nil
+		})
+		return dst.Update(storeName, func(org *TestDataType) (*TestDataType, error) {
+			if org == nil {
+				org = &TestDataType{Name: storeName}
+			}
+			org.Quantity += n
+			return org, nil
+		})
+	})
+}
+
+// Test_InMemStorage_TxnUsers tests the cross-user transactions of InMemStorage with testify
+func Test_InMemStorage_TxnUsers(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test_storage.journal")
+	journal, err := memstore.OpenJournal[TestDataType](path, memstore.JournalOptions{})
+	assert.NoError(t, err)
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = createCacheDumper[TestDataType]()
+	storage.Journal = journal
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "gold", Quantity: 100}))
+	assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "gold", Quantity: 100}))
+	assert.NoError(t, storage.Save(ctx))
+
+	// nothing is applied when a part of the transaction fails
+	assert.ErrorIs(t, transfer(storage, "uid001", "uid003", "gold", 1000), errNotEnough)
+	assert.False(t, storage.IsDirty())
+	_, err = storage.List("uid003")
+	assert.ErrorIs(t, err, memstore.ErrUserNotFound)
+
+	// the users out of the transaction are rejected
+	err = storage.TxnUsers([]memstore.UID{"uid001"}, func(mtx *memstore.MultiTxn[TestDataType]) error {
+		_, err := mtx.For("uid002")
+		return err
+	})
+	assert.ErrorIs(t, err, memstore.ErrInvalidUser)
+
+	// the concurrent transfers in both directions do not deadlock, and the total is kept
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_ = transfer(storage, "uid001", "uid002", "gold", 3)
+		}()
+		go func() {
+			defer wg.Done()
+			_ = transfer(storage, "uid002", "uid001", "gold", 2)
+		}()
+	}
+	wg.Wait()
+	total := func(s *memstore.InMemoryStorage[TestDataType]) int64 {
+		a, b := TestDataType{Name: "gold"}, TestDataType{Name: "gold"}
+		assert.NoError(t, s.Get("uid001", &a))
+		assert.NoError(t, s.Get("uid002", &b))
+		return a.Quantity + b.Quantity
+	}
+	assert.Equal(t, int64(200), total(storage))
+	assert.Equal(t, []memstore.UID{"uid001", "uid002"}, storage.DirtyUsers())
+
+	// the transfers are replayed from the journal
+	assert.NoError(t, journal.Close())
+	journal, err = memstore.OpenJournal[TestDataType](path, memstore.JournalOptions{})
+	assert.NoError(t, err)
+	defer journal.Close()
+	storage2 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage2.Dumper = storage.Dumper
+	storage2.Journal = journal
+	assert.NoError(t, storage2.Load(ctx))
+	assert.Equal(t, []memstore.UID{"uid001", "uid002"}, storage2.DirtyUsers())
+	assert.Equal(t, int64(200), total(storage2))
+	a, b := TestDataType{Name: "gold"}, TestDataType{Name: "gold"}
+	assert.NoError(t, storage.Get("uid001", &a))
+	assert.NoError(t, storage2.Get("uid001", &b))
+	assert.Equal(t, a, b)
+}
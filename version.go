@@ -0,0 +1,146 @@
+package memstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrVersionConflict is matched by the VersionConflictError returned by
+	// CompareAndSet when the resource has been changed
+	ErrVersionConflict = fmt.Errorf("version conflict")
+)
+
+type (
+	// WriteSeqDumper is implemented by the ChangeDumpers keeping
+	// DumpOptions.WriteSeq, so that the versions handed out after a restart
+	// never reuse the ones handed out before it, even if the users holding
+	// them are not loaded yet. the versions of a storage on the other
+	// dumpers are only raised by the metadata of the loaded users
+	WriteSeqDumper interface {
+		// LoadWriteSeq loads the largest DumpOptions.WriteSeq written, zero
+		// if there is none
+		LoadWriteSeq(ctx context.Context, permanentKey string) (uint64, error)
+	}
+
+	// VersionConflictError is returned by CompareAndSet when the version of
+	// the resource is not the expected one
+	VersionConflictError struct {
+		User      UID
+		StoreName string
+		// Expected is the version given to CompareAndSet
+		Expected uint64
+		// Actual is the current version of the resource, zero if it does not exist
+		Actual uint64
+	}
+)
+
+// Error implements the error interface
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("%v, user: %s, storeName: %s, expected: %d, actual: %d",
+		ErrVersionConflict, e.User, e.StoreName, e.Expected, e.Actual)
+}
+
+// Is makes errors.Is(err, ErrVersionConflict) true
+func (e *VersionConflictError) Is(target error) bool {
+	return target == ErrVersionConflict
+}
+
+// GetWithVersion retrieves a resource for a given user the same as Get, and
+// returns its version, which is passed to CompareAndSet to write it back
+func (s *InMemoryStorage[TData]) GetWithVersion(user string, out *TData) (uint64, error) {
+	// validate input
+	if user == "" {
+		return 0, fmt.Errorf("%w, user cannot be empty", ErrInvalidUser)
+	}
+	if out == nil {
+		return 0, fmt.Errorf("%w, output cannot be nil", ErrInvalidInput)
+	}
+	// load the user if it is not in memory
+	release, err := s.loadUser(user)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	// lock the user
+	unlock := s.rlockUser(user)
+	defer unlock()
+
+	if err = s.getLocked(user, out); err != nil {
+		return 0, err
+	}
+	return s.metaLocked(user, (*out).StoreName()).Version, nil
+}
+
+// CompareAndSet stores a resource for a given user the same as Set, only if
+// the current version of the resource is expectedVersion, and returns the new
+// version. zero expectedVersion means the resource must not exist, or is
+// stored without a version. a *VersionConflictError matching
+// ErrVersionConflict is returned otherwise
+func (s *InMemoryStorage[TData]) CompareAndSet(user string, in *TData, expectedVersion uint64) (uint64, error) {
+	// validate input
+	if user == "" {
+		return 0, fmt.Errorf("%w, user cannot be empty", ErrInvalidUser)
+	}
+	if in == nil {
+		return 0, fmt.Errorf("%w, input cannot be nil", ErrInvalidInput)
+	}
+	// load the user if it is not in memory
+	release, err := s.loadUser(user)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	// the new resource may exceed the capacity, check it after unlocking
+	defer s.evictIfNeeded()
+	// lock the user
+	unlock := s.lockUser(user)
+	defer unlock()
+
+	// check the version, an expired resource is treated as missing
+	storeName := (*in).StoreName()
+	actual := uint64(0)
+	if _, ok := s.shardOf(user).data[user][storeName]; ok && !s.expiredLocked(user, storeName, time.Now()) {
+		actual = s.metaLocked(user, storeName).Version
+	}
+	if actual != expectedVersion {
+		return 0, &VersionConflictError{User: user, StoreName: storeName, Expected: expectedVersion, Actual: actual}
+	}
+	return s.setLocked(user, in, ResourceMeta{})
+}
+
+// raiseWriteSeq raises the write sequence to at least the given version, so
+// that the versions of the loaded resources keep increasing
+func (s *InMemoryStorage[TData]) raiseWriteSeq(version uint64) {
+	for {
+		cur := s.writeSeq.Load()
+		if cur >= version || s.writeSeq.CompareAndSwap(cur, version) {
+			return
+		}
+	}
+}
+
+// raiseWriteSeqByDumper raises the write sequence to the one kept by the
+// Dumper if it is a WriteSeqDumper
+func (s *InMemoryStorage[TData]) raiseWriteSeqByDumper(ctx context.Context) error {
+	wd, ok := s.Dumper.(WriteSeqDumper)
+	if !ok {
+		return nil
+	}
+	seq, err := wd.LoadWriteSeq(ctx, s.PersistentKey)
+	if err != nil {
+		return fmt.Errorf("failed to load write sequence from permanent storage, err: %w", err)
+	}
+	s.raiseWriteSeq(seq)
+	return nil
+}
+
+// raiseWriteSeqByMeta raises the write sequence to the versions of the loaded metadata
+func (s *InMemoryStorage[TData]) raiseWriteSeqByMeta(meta map[UID]MetaMap) {
+	for _, mm := range meta {
+		for _, m := range mm {
+			s.raiseWriteSeq(m.Version)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package memstore_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/khgame/memstore"
+	"github.com/khgame/memstore/dumper"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_InMemStorage_CompareAndSet tests the versions and CompareAndSet of InMemStorage with testify
+func Test_InMemStorage_CompareAndSet(t *testing.T) {
+	ctx := context.Background()
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage.Dumper = createCacheDumper[TestDataType]()
+
+	// zero version creates a resource that does not exist
+	v1, err := storage.CompareAndSet("uid001", &TestDataType{Name: "gold", Quantity: 1}, 0)
+	assert.NoError(t, err)
+	assert.NotZero(t, v1)
+	_, err = storage.CompareAndSet("uid001", &TestDataType{Name: "gold", Quantity: 2}, 0)
+	assert.ErrorIs(t, err, memstore.ErrVersionConflict)
+
+	// every write increases the version
+	data := TestDataType{Name: "gold"}
+	version, err := storage.GetWithVersion("uid001", &data)
+	assert.NoError(t, err)
+	assert.Equal(t, v1, version)
+	assert.NoError(t, storage.Update("uid001", "gold", func(org *TestDataType) (*TestDataType, error) {
+		org.Quantity++
+		return org, nil
+	}))
+	v2, err := storage.GetWithVersion("uid001", &data)
+	assert.NoError(t, err)
+	assert.Greater(t, v2, v1)
+
+	// the write based on a stale read is rejected
+	_, err = storage.CompareAndSet("uid001", &TestDataType{Name: "gold", Quantity: 100}, v1)
+	var conflict *memstore.VersionConflictError
+	assert.True(t, errors.As(err, &conflict))
+	assert.Equal(t, memstore.VersionConflictError{User: "uid001", StoreName: "gold", Expected: v1, Actual: v2}, *conflict)
+	v3, err := storage.CompareAndSet("uid001", &TestDataType{Name: "gold", Quantity: 100}, v2)
+	assert.NoError(t, err)
+	assert.Greater(t, v3, v2)
+
+	// a deleted resource does not get its version back
+	assert.NoError(t, storage.Delete("uid001", "gold"))
+	_, err = storage.GetWithVersion("uid001", &data)
+	assert.ErrorIs(t, err, memstore.ErrResourceNotFound)
+	data = TestDataType{Name: "gold"}
+	v4, err := storage.CompareAndSet("uid001", &TestDataType{Name: "gold", Quantity: 1}, 0)
+	assert.NoError(t, err)
+	assert.Greater(t, v4, v3)
+
+	// the versions are persisted through the dumper, and keep increasing after Load
+	assert.NoError(t, storage.Save(ctx))
+	storage2 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	storage2.Dumper = storage.Dumper
+	assert.NoError(t, storage2.Load(ctx))
+	version, err = storage2.GetWithVersion("uid001", &data)
+	assert.NoError(t, err)
+	assert.Equal(t, v4, version)
+	assert.NoError(t, storage2.Set("uid002", &TestDataType{Name: "gold", Quantity: 1}))
+	version, err = storage2.GetWithVersion("uid002", &data)
+	assert.NoError(t, err)
+	assert.Greater(t, version, v4)
+}
+
+// Test_InMemStorage_VersionsAfterLazyLoad tests that the versions handed out after a restart never reuse the ones before it, even if the users holding them are not loaded
+func Test_InMemStorage_VersionsAfterLazyLoad(t *testing.T) {
+	ctx := context.Background()
+	dumpers := map[string]memstore.Dumper[TestDataType]{
+		"cache": createCacheDumper[TestDataType](),
+		"file":  dumper.CreateFileDumper[TestDataType](t.TempDir()),
+	}
+	for name, dp := range dumpers {
+		storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+		storage.Dumper = dp
+		v1, err := storage.CompareAndSet("uid001", &TestDataType{Name: "gold", Quantity: 1}, 0)
+		assert.NoError(t, err, name)
+		assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "silver", Quantity: 1}), name)
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "gold", Quantity: int64(i)}), name)
+		}
+		v2, err := storage.GetWithVersion("uid002", &TestDataType{Name: "gold"})
+		assert.NoError(t, err, name)
+		// the version of the deleted resource is not stored
+		assert.NoError(t, storage.Delete("uid001", "gold"), name)
+		assert.NoError(t, storage.Save(ctx), name)
+
+		// only uid001 is loaded, the new version is still larger than the ones of uid002
+		storage2 := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+		storage2.Dumper = dp
+		storage2.LazyLoad = true
+		assert.NoError(t, storage2.Load(ctx), name)
+		v3, err := storage2.CompareAndSet("uid001", &TestDataType{Name: "gold", Quantity: 2}, 0)
+		assert.NoError(t, err, name)
+		assert.Greater(t, v3, v2, name)
+		_, err = storage2.CompareAndSet("uid001", &TestDataType{Name: "gold", Quantity: 3}, v1)
+		assert.ErrorIs(t, err, memstore.ErrVersionConflict, name)
+	}
+}
@@ -0,0 +1,260 @@
+package memstore
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// ChangeSet is the kind of a resource stored by Set
+	ChangeSet ChangeKind = iota + 1
+	// ChangeUpdate is the kind of a resource modified by Update
+	ChangeUpdate
+	// ChangeDelete is the kind of a resource removed by Delete, Purge or
+	// an Update that returns nil
+	ChangeDelete
+	// ChangeExpire is the kind of a resource removed by the expiry reaper
+	ChangeExpire
+	// ChangeReload is the kind of a resource reloaded from the Dumper on an
+	// invalidation from another instance, New is nil if it is removed
+	ChangeReload
+)
+
+const (
+	// OverflowDropNewest drops the incoming event when the buffer is full
+	OverflowDropNewest OverflowPolicy = iota
+	// OverflowDropOldest drops the oldest buffered event to make room for the incoming one
+	OverflowDropOldest
+	// OverflowClose closes the watcher when the buffer is full, and Err
+	// returns ErrWatcherOverflow afterward
+	OverflowClose
+)
+
+// DefaultWatchBuffer is the buffer size of a watcher if it is not specified
+const DefaultWatchBuffer = 64
+
+var (
+	// ErrWatcherOverflow is returned by Watcher.Err when the watcher is closed by OverflowClose
+	ErrWatcherOverflow = fmt.Errorf("watcher overflow")
+)
+
+type (
+	// ChangeKind is the kind of a change
+	ChangeKind int
+
+	// OverflowPolicy defines what a watcher does when its buffer is full,
+	// the writers of the storage are never blocked by watchers
+	OverflowPolicy int
+
+	// ChangeEvent is a change of a resource, the values are shared by all
+	// the watchers and must not be modified
+	ChangeEvent[T any] struct {
+		// Kind is the kind of the change
+		Kind ChangeKind
+		// User is the owner of the resource
+		User UID
+		// StoreName is the name of the resource
+		StoreName string
+		// Old is the value before the change, nil if the resource did not exist
+		Old *T
+		// New is the value after the change, nil if the resource is removed
+		New *T
+	}
+
+	// WatchOptions configures a watcher
+	WatchOptions struct {
+		// Users filters the events by user, empty means all users
+		Users []UID
+		// StoreNames filters the events by store name, empty means all resources
+		StoreNames []string
+		// Buffer is the buffer size of the event channel,
+		// DefaultWatchBuffer is used when it is not positive
+		Buffer int
+		// Overflow is the policy applied when the buffer is full
+		Overflow OverflowPolicy
+	}
+
+	// Watcher receives the change events of a storage
+	Watcher[T any] struct {
+		users      map[UID]struct{}
+		storeNames map[string]struct{}
+		overflow   OverflowPolicy
+
+		// mu protects ch from being sent after it is closed
+		mu      sync.Mutex
+		ch      chan ChangeEvent[T]
+		closed  bool
+		err     error
+		dropped atomic.Uint64
+
+		unregister func()
+	}
+
+	// watcherSet is the registered watchers of a storage
+	watcherSet[T any] struct {
+		mu    sync.RWMutex
+		items map[*Watcher[T]]struct{}
+	}
+)
+
+// String returns the name of the change kind
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeSet:
+		return "set"
+	case ChangeUpdate:
+		return "update"
+	case ChangeDelete:
+		return "delete"
+	case ChangeExpire:
+		return "expire"
+	case ChangeReload:
+		return "reload"
+	default:
+		return fmt.Sprintf("ChangeKind(%d)", int(k))
+	}
+}
+
+// Watch registers a watcher that receives the changes of the storage, the
+// events of a user are delivered in the order they are applied, while the
+// events of different users may interleave in any order. the watcher must be
+// closed by Watcher.Close when it is no longer used
+func (s *InMemoryStorage[TData]) Watch(opt WatchOptions) *Watcher[TData] {
+	if opt.Buffer <= 0 {
+		opt.Buffer = DefaultWatchBuffer
+	}
+	w := &Watcher[TData]{
+		overflow: opt.Overflow,
+		ch:       make(chan ChangeEvent[TData], opt.Buffer),
+	}
+	if len(opt.Users) > 0 {
+		w.users = make(map[UID]struct{}, len(opt.Users))
+		for _, user := range opt.Users {
+			w.users[user] = struct{}{}
+		}
+	}
+	if len(opt.StoreNames) > 0 {
+		w.storeNames = make(map[string]struct{}, len(opt.StoreNames))
+		for _, storeName := range opt.StoreNames {
+			w.storeNames[storeName] = struct{}{}
+		}
+	}
+
+	s.watchers.mu.Lock()
+	defer s.watchers.mu.Unlock()
+	if s.watchers.items == nil {
+		s.watchers.items = make(map[*Watcher[TData]]struct{})
+	}
+	s.watchers.items[w] = struct{}{}
+	w.unregister = func() {
+		s.watchers.mu.Lock()
+		defer s.watchers.mu.Unlock()
+		delete(s.watchers.items, w)
+	}
+	return w
+}
+
+// Events returns the channel of the change events, it is closed when the watcher is closed
+func (w *Watcher[T]) Events() <-chan ChangeEvent[T] {
+	return w.ch
+}
+
+// Dropped returns the count of the events dropped by the overflow policy
+func (w *Watcher[T]) Dropped() uint64 {
+	return w.dropped.Load()
+}
+
+// Err returns ErrWatcherOverflow if the watcher is closed by OverflowClose, nil otherwise
+func (w *Watcher[T]) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.err
+}
+
+// Close unregisters the watcher and closes its channel
+func (w *Watcher[T]) Close() {
+	w.unregister()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closeLocked(nil)
+}
+
+// closeLocked closes the channel, the caller must hold w.mu
+func (w *Watcher[T]) closeLocked(err error) {
+	if w.closed {
+		return
+	}
+	w.closed, w.err = true, err
+	close(w.ch)
+}
+
+// match returns true if the event passes the filters
+func (w *Watcher[T]) match(user UID, storeName string) bool {
+	if w.users != nil {
+		if _, ok := w.users[user]; !ok {
+			return false
+		}
+	}
+	if w.storeNames != nil {
+		if _, ok := w.storeNames[storeName]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// deliver sends the event without blocking, the overflow policy is applied when the buffer is full
+func (w *Watcher[T]) deliver(ev ChangeEvent[T]) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return
+	}
+	select {
+	case w.ch <- ev:
+		return
+	default:
+	}
+
+	switch w.overflow {
+	case OverflowDropOldest:
+		// the receiver may take an event meanwhile, so both operations are non-blocking
+		select {
+		case <-w.ch:
+			w.dropped.Add(1)
+		default:
+		}
+		select {
+		case w.ch <- ev:
+		default:
+			w.dropped.Add(1)
+		}
+	case OverflowClose:
+		w.dropped.Add(1)
+		w.closeLocked(ErrWatcherOverflow)
+		go w.unregister()
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+// emitLocked delivers a change to the matched watchers, it is called with the
+// write lock of the user held, so that the events of a user are in the order of the changes
+func (s *InMemoryStorage[TData]) emitLocked(kind ChangeKind, user UID, storeName string, old, new *TData) {
+	s.watchers.mu.RLock()
+	defer s.watchers.mu.RUnlock()
+
+	if len(s.watchers.items) == 0 {
+		return
+	}
+	ev := ChangeEvent[TData]{Kind: kind, User: user, StoreName: storeName, Old: old, New: new}
+	for w := range s.watchers.items {
+		if w.match(user, storeName) {
+			w.deliver(ev)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package memstore_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/khgame/memstore"
+	"github.com/stretchr/testify/assert"
+)
+
+// drain receives the buffered events of a watcher
+func drain[T any](w *memstore.Watcher[T]) []memstore.ChangeEvent[T] {
+	var ret []memstore.ChangeEvent[T]
+	for {
+		select {
+		case ev, ok := <-w.Events():
+			if !ok {
+				return ret
+			}
+			ret = append(ret, ev)
+		default:
+			return ret
+		}
+	}
+}
+
+// Test_InMemStorage_Watch tests the change events of InMemStorage with testify
+func Test_InMemStorage_Watch(t *testing.T) {
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	all := storage.Watch(memstore.WatchOptions{})
+	defer all.Close()
+	byUser := storage.Watch(memstore.WatchOptions{Users: []memstore.UID{"uid002"}})
+	defer byUser.Close()
+	byName := storage.Watch(memstore.WatchOptions{StoreNames: []string{"res002"}})
+	defer byName.Close()
+
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: 1}))
+	assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: 2}))
+	assert.NoError(t, storage.Update("uid001", "res001", func(org *TestDataType) (*TestDataType, error) {
+		org.Quantity++
+		return org, nil
+	}))
+	assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "res002", Quantity: 1}))
+	assert.NoError(t, storage.Delete("uid001", "res001"))
+	assert.NoError(t, storage.Delete("uid001", "res001"))
+	assert.NoError(t, storage.Update("uid002", "res002", func(org *TestDataType) (*TestDataType, error) {
+		return nil, nil
+	}))
+	assert.NoError(t, storage.SetWithExpiry("uid002", &TestDataType{Name: "res003", Quantity: 1}, time.Now().Add(-time.Second)))
+	assert.Equal(t, 1, storage.ReapExpired())
+	assert.NoError(t, storage.Set("uid003", &TestDataType{Name: "res002", Quantity: 3}))
+	assert.NoError(t, storage.Purge("uid003"))
+
+	q := func(v int64) *TestDataType { return &TestDataType{Name: "res001", Quantity: v} }
+	events := drain(all)
+	assert.Equal(t, []memstore.ChangeEvent[TestDataType]{
+		{Kind: memstore.ChangeSet, User: "uid001", StoreName: "res001", New: q(1)},
+		{Kind: memstore.ChangeSet, User: "uid001", StoreName: "res001", Old: q(1), New: q(2)},
+		{Kind: memstore.ChangeUpdate, User: "uid001", StoreName: "res001", Old: q(2), New: q(3)},
+		{Kind: memstore.ChangeSet, User: "uid002", StoreName: "res002", New: &TestDataType{Name: "res002", Quantity: 1}},
+		{Kind: memstore.ChangeDelete, User: "uid001", StoreName: "res001", Old: q(3)},
+		{Kind: memstore.ChangeDelete, User: "uid002", StoreName: "res002", Old: &TestDataType{Name: "res002", Quantity: 1}},
+		{Kind: memstore.ChangeSet, User: "uid002", StoreName: "res003", New: &TestDataType{Name: "res003", Quantity: 1}},
+		{Kind: memstore.ChangeExpire, User: "uid002", StoreName: "res003", Old: &TestDataType{Name: "res003", Quantity: 1}},
+		{Kind: memstore.ChangeSet, User: "uid003", StoreName: "res002", New: &TestDataType{Name: "res002", Quantity: 3}},
+		{Kind: memstore.ChangeDelete, User: "uid003", StoreName: "res002", Old: &TestDataType{Name: "res002", Quantity: 3}},
+	}, events)
+	assert.Equal(t, "expire", events[7].Kind.String())
+
+	// filters
+	assert.Equal(t, 4, len(drain(byUser)))
+	events = drain(byName)
+	assert.Equal(t, 4, len(events))
+	for _, ev := range events {
+		assert.Equal(t, "res002", ev.StoreName)
+	}
+
+	// a closed watcher receives nothing
+	byUser.Close()
+	assert.NoError(t, storage.Set("uid002", &TestDataType{Name: "res002", Quantity: 1}))
+	_, ok := <-byUser.Events()
+	assert.False(t, ok)
+	assert.NoError(t, byUser.Err())
+}
+
+// Test_InMemStorage_WatchOverflow tests the overflow policies of watchers
+func Test_InMemStorage_WatchOverflow(t *testing.T) {
+	storage := memstore.NewInMemoryStorage[TestDataType]("test_storage")
+	dropNewest := storage.Watch(memstore.WatchOptions{Buffer: 2})
+	defer dropNewest.Close()
+	dropOldest := storage.Watch(memstore.WatchOptions{Buffer: 2, Overflow: memstore.OverflowDropOldest})
+	defer dropOldest.Close()
+	closeOnFull := storage.Watch(memstore.WatchOptions{Buffer: 2, Overflow: memstore.OverflowClose})
+
+	// the writers are never blocked
+	for i := int64(1); i <= 5; i++ {
+		assert.NoError(t, storage.Set("uid001", &TestDataType{Name: "res001", Quantity: i}))
+	}
+
+	quantities := func(events []memstore.ChangeEvent[TestDataType]) []int64 {
+		ret := make([]int64, 0, len(events))
+		for _, ev := range events {
+			ret = append(ret, ev.New.Quantity)
+		}
+		return ret
+	}
+	assert.Equal(t, []int64{1, 2}, quantities(drain(dropNewest)))
+	assert.Equal(t, uint64(3), dropNewest.Dropped())
+	assert.Equal(t, []int64{4, 5}, quantities(drain(dropOldest)))
+	assert.Equal(t, uint64(3), dropOldest.Dropped())
+
+	// the buffered events are still readable before the channel is closed
+	assert.Equal(t, []int64{1, 2}, quantities(drain(closeOnFull)))
+	_, ok := <-closeOnFull.Events()
+	assert.False(t, ok)
+	assert.ErrorIs(t, closeOnFull.Err(), memstore.ErrWatcherOverflow)
+	closeOnFull.Close()
+}